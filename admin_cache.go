@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+type (
+	adminCacheEntryResponse struct {
+		metrics.CacheEntry
+		Value       json.RawMessage `json:"value,omitempty"`
+		ValueBase64 []byte          `json:"valueBase64,omitempty"`
+	}
+
+	adminCachePurgeResponse struct {
+		Purged  int                  `json:"purged"`
+		Entries []metrics.CacheEntry `json:"entries"`
+	}
+)
+
+// adminAuth allows only requests with the admin token (Authorization: Bearer <token>)
+func adminAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(opts.Server.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="azure-metrics-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminCacheHandler lists (GET) or purges (DELETE) cache entries
+//
+// parameters: prefix (both), key and subscription (purge only)
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	contextLogger := buildContextLoggerFromRequest(r)
+	params := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := cacheAdmin.Entries(params.Get("prefix"))
+		if err != nil {
+			contextLogger.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+		adminWriteJson(w, r, entries)
+	case http.MethodDelete:
+		filter := metrics.CachePurgeFilter{
+			Key:            params.Get("key"),
+			Prefix:         params.Get("prefix"),
+			SubscriptionId: params.Get("subscription"),
+		}
+		if filter.Key == "" && filter.Prefix == "" && filter.SubscriptionId == "" {
+			http.Error(w, `parameter "key", "prefix" or "subscription" is missing`, http.StatusBadRequest)
+			return
+		}
+
+		entries, err := cacheAdmin.Purge(filter)
+		if err != nil {
+			contextLogger.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		contextLogger.Infof("purged %d cache entries (key: %q, prefix: %q, subscription: %q)", len(entries), filter.Key, filter.Prefix, filter.SubscriptionId)
+		adminWriteJson(w, r, adminCachePurgeResponse{
+			Purged:  len(entries),
+			Entries: entries,
+		})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminCacheEntryHandler returns a single cache entry with its value (parameter key)
+func adminCacheEntryHandler(w http.ResponseWriter, r *http.Request) {
+	contextLogger := buildContextLoggerFromRequest(r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := paramsGetRequired(r.URL.Query(), "key")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, value, found, err := cacheAdmin.Entry(key)
+	if err != nil {
+		contextLogger.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("cache entry \"%s\" not found", key), http.StatusNotFound)
+		return
+	}
+
+	response := adminCacheEntryResponse{CacheEntry: *entry}
+	if json.Valid(value) {
+		response.Value = value
+	} else {
+		response.ValueBase64 = value
+	}
+	adminWriteJson(w, r, response)
+}
+
+func adminWriteJson(w http.ResponseWriter, r *http.Request, payload interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		buildContextLoggerFromRequest(r).Error(err)
+	}
+}
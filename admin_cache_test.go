@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+const testAdminToken = "secret"
+
+// newTestCacheAdmin sets up the admin api globals with a memory cache containing the entries
+func newTestCacheAdmin(t *testing.T, entries map[string]string) http.Handler {
+	t.Helper()
+
+	prevLogger, prevToken, prevCacheAdmin := logger, opts.Server.AdminToken, cacheAdmin
+	t.Cleanup(func() {
+		logger, opts.Server.AdminToken, cacheAdmin = prevLogger, prevToken, prevCacheAdmin
+	})
+
+	backend := metrics.NewMemoryCache(metrics.MemoryCacheConfig{})
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	logger = zap.NewNop().Sugar()
+	opts.Server.AdminToken = testAdminToken
+	cacheAdmin = metrics.NewInstrumentedCache(logger, backend, prometheus.NewRegistry())
+
+	for key, value := range entries {
+		if err := cacheAdmin.Set(key, []byte(value), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/cache", adminAuth(http.HandlerFunc(adminCacheHandler)))
+	mux.Handle("/admin/cache/entry", adminAuth(http.HandlerFunc(adminCacheEntryHandler)))
+	return mux
+}
+
+func serveTestAdminRequest(handler http.Handler, method, url, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func cacheEntryKeys(entries []metrics.CacheEntry) []string {
+	ret := []string{}
+	for _, entry := range entries {
+		ret = append(ret, entry.Key)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+func TestAdminAuth(t *testing.T) {
+	handler := newTestCacheAdmin(t, nil)
+
+	testCases := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{"without token", "", http.StatusUnauthorized},
+		{"invalid token", "invalid", http.StatusUnauthorized},
+		{"valid token", testAdminToken, http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := serveTestAdminRequest(handler, http.MethodGet, "/admin/cache", testCase.token)
+			if recorder.Code != testCase.statusCode {
+				t.Errorf("expected status code %d, got %d", testCase.statusCode, recorder.Code)
+			}
+			if testCase.statusCode == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAdminCacheHandlerList(t *testing.T) {
+	handler := newTestCacheAdmin(t, map[string]string{
+		"list:b":             "{}",
+		"list:a":             "{}",
+		"servicediscovery:a": "[]",
+	})
+
+	testCases := []struct {
+		url      string
+		expected []string
+	}{
+		{"/admin/cache", []string{"list:a", "list:b", "servicediscovery:a"}},
+		{"/admin/cache?prefix=list:", []string{"list:a", "list:b"}},
+		{"/admin/cache?prefix=scrape:", []string{}},
+	}
+
+	for _, testCase := range testCases {
+		recorder := serveTestAdminRequest(handler, http.MethodGet, testCase.url, testAdminToken)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code 200, got %d", testCase.url, recorder.Code)
+		}
+
+		entries := []metrics.CacheEntry{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		// sorted by key
+		if !slices.Equal(keys, testCase.expected) {
+			t.Errorf("%s: expected %v, got %v", testCase.url, testCase.expected, keys)
+		}
+	}
+}
+
+func TestAdminCacheHandlerPurge(t *testing.T) {
+	testCases := []struct {
+		name       string
+		url        string
+		statusCode int
+		purged     []string
+	}{
+		{"without filter", "/admin/cache", http.StatusBadRequest, nil},
+		{"key", "/admin/cache?key=list:a", http.StatusOK, []string{"list:a"}},
+		{"missing key", "/admin/cache?key=list:missing", http.StatusOK, []string{}},
+		{"prefix", "/admin/cache?prefix=list:", http.StatusOK, []string{"list:a", "list:b"}},
+		{"subscription", "/admin/cache?subscription=00000000-0000-0000-0000-00000000000A", http.StatusOK, []string{"list:b", "servicediscovery:a"}},
+		{"subscription and prefix", "/admin/cache?subscription=00000000-0000-0000-0000-00000000000a&prefix=list:", http.StatusOK, []string{"list:b"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := newTestCacheAdmin(t, map[string]string{
+				"list:a":             `{"list":{"metric":[{"labels":{"subscriptionID":"00000000-0000-0000-0000-000000000001"}}]}}`,
+				"list:b":             `{"list":{"metric":[{"labels":{"subscriptionID":"00000000-0000-0000-0000-00000000000a"}}]}}`,
+				"servicediscovery:a": `["/subscriptions/00000000-0000-0000-0000-00000000000A/resourceGroups/rg"]`,
+			})
+
+			recorder := serveTestAdminRequest(handler, http.MethodDelete, testCase.url, testAdminToken)
+			if recorder.Code != testCase.statusCode {
+				t.Fatalf("expected status code %d, got %d", testCase.statusCode, recorder.Code)
+			}
+			if testCase.statusCode != http.StatusOK {
+				return
+			}
+
+			response := adminCachePurgeResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if keys := cacheEntryKeys(response.Entries); response.Purged != len(testCase.purged) || !slices.Equal(keys, testCase.purged) {
+				t.Errorf("expected purged %v, got %d %v", testCase.purged, response.Purged, keys)
+			}
+
+			for _, key := range testCase.purged {
+				if _, found, _ := cacheAdmin.Get(key); found {
+					t.Errorf("expected %s to be purged", key)
+				}
+			}
+			if entries, _ := cacheAdmin.Entries(""); len(entries) != 3-len(testCase.purged) {
+				t.Errorf("expected %d remaining entries, got %v", 3-len(testCase.purged), cacheEntryKeys(entries))
+			}
+		})
+	}
+}
+
+func TestAdminCacheHandlerMethodNotAllowed(t *testing.T) {
+	handler := newTestCacheAdmin(t, nil)
+
+	testCases := []struct {
+		url   string
+		allow string
+	}{
+		{"/admin/cache", "GET, DELETE"},
+		{"/admin/cache/entry?key=list:a", "GET"},
+	}
+
+	for _, testCase := range testCases {
+		recorder := serveTestAdminRequest(handler, http.MethodPost, testCase.url, testAdminToken)
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != testCase.allow {
+			t.Errorf("%s: expected status code 405 (allow %s), got %d (allow %s)", testCase.url, testCase.allow, recorder.Code, recorder.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestAdminCacheEntryHandler(t *testing.T) {
+	handler := newTestCacheAdmin(t, map[string]string{
+		"list:a":   `{"list":{}}`,
+		"binary:a": "\x00\x01",
+	})
+
+	testCases := []struct {
+		name        string
+		url         string
+		statusCode  int
+		value       string
+		valueBase64 []byte
+	}{
+		{"without key", "/admin/cache/entry", http.StatusBadRequest, "", nil},
+		{"missing key", "/admin/cache/entry?key=list:missing", http.StatusNotFound, "", nil},
+		{"json value", "/admin/cache/entry?key=list:a", http.StatusOK, `{"list":{}}`, nil},
+		{"binary value", "/admin/cache/entry?key=binary:a", http.StatusOK, "", []byte("\x00\x01")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := serveTestAdminRequest(handler, http.MethodGet, testCase.url, testAdminToken)
+			if recorder.Code != testCase.statusCode {
+				t.Fatalf("expected status code %d, got %d", testCase.statusCode, recorder.Code)
+			}
+			if testCase.statusCode != http.StatusOK {
+				return
+			}
+
+			response := adminCacheEntryResponse{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if string(response.Value) != testCase.value || !slices.Equal(response.ValueBase64, testCase.valueBase64) {
+				t.Errorf("expected value %q (base64 %q), got %q (base64 %q)", testCase.value, testCase.valueBase64, response.Value, response.ValueBase64)
+			}
+			if response.Size == 0 || response.ExpiresAt.IsZero() {
+				t.Errorf("expected size and expiry of the entry, got %+v", response.CacheEntry)
+			}
+		})
+	}
+}
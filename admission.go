@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	AdmissionRejectQueueFull    = "queuefull"
+	AdmissionRejectQueueTimeout = "queuetimeout"
+	AdmissionRejectCanceled     = "canceled"
+)
+
+var (
+	// probeAdmissionUrls are the probe endpoints with admission control
+	probeAdmissionUrls = []string{
+		config.ProbeMetricsResourceUrl,
+		config.ProbeMetricsListUrl,
+		config.ProbeMetricsSubscriptionUrl,
+		config.ProbeMetricsScrapeUrl,
+		config.ProbeMetricsResourceGraphUrl,
+		config.ProbeMetricsDefinitionsUrl,
+	}
+)
+
+type (
+	// probeStartTimeKey is the context key of the time the probe request was received
+	probeStartTimeKey struct{}
+
+	// probeAdmission limits the concurrent probes of the exporter (global and per endpoint), probes exceeding
+	// the limits wait in a bounded queue and are rejected when the queue is full or the wait takes too long
+	probeAdmission struct {
+		global   chan struct{}
+		endpoint map[string]chan struct{}
+
+		queued atomic.Int64
+		// maximum waiting probes (0 = unlimited)
+		queueSize int64
+
+		queueTimeout time.Duration
+		retryAfter   time.Duration
+
+		prometheus struct {
+			inflight *prometheus.GaugeVec
+			queued   *prometheus.GaugeVec
+			wait     *prometheus.HistogramVec
+			rejected *prometheus.CounterVec
+		}
+	}
+)
+
+// newProbeAdmission creates the admission control of all probe endpoints, returns nil if no limit is set
+func newProbeAdmission(conf config.Opts, registerer prometheus.Registerer) (*probeAdmission, error) {
+	a := &probeAdmission{
+		endpoint:     map[string]chan struct{}{},
+		queueSize:    int64(conf.Prober.Admission.QueueSize),
+		queueTimeout: conf.Prober.Admission.QueueTimeout,
+		retryAfter:   conf.Prober.Admission.RetryAfter,
+	}
+
+	if conf.Prober.Admission.MaxConcurrent > 0 {
+		a.global = make(chan struct{}, conf.Prober.Admission.MaxConcurrent)
+	}
+
+	for _, val := range conf.Prober.Admission.EndpointLimits {
+		url, limitVal, found := strings.Cut(val, "=")
+		if !found {
+			return nil, fmt.Errorf(`invalid probe endpoint limit "%s", expected format <url>=<limit>`, val)
+		}
+
+		limit, err := strconv.Atoi(strings.TrimSpace(limitVal))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf(`invalid probe endpoint limit "%s", limit must be a positive number`, val)
+		}
+
+		url = strings.TrimSpace(url)
+		if !slices.Contains(probeAdmissionUrls, url) {
+			return nil, fmt.Errorf(`invalid probe endpoint limit "%s", unknown probe endpoint "%s" (allowed: %s)`, val, url, strings.Join(probeAdmissionUrls, ", "))
+		}
+
+		a.endpoint[url] = make(chan struct{}, limit)
+	}
+
+	if a.global == nil && len(a.endpoint) == 0 {
+		return nil, nil
+	}
+
+	a.prometheus.inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurerm_probe_admission_inflight",
+			Help: "Azure metrics probes currently running by handler",
+		},
+		[]string{"handler"},
+	)
+	registerer.MustRegister(a.prometheus.inflight)
+
+	a.prometheus.queued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurerm_probe_admission_queued",
+			Help: "Azure metrics probes currently waiting for admission by handler",
+		},
+		[]string{"handler"},
+	)
+	registerer.MustRegister(a.prometheus.queued)
+
+	a.prometheus.wait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "azurerm_probe_admission_wait_seconds",
+			Help:    "Azure metrics probe wait time for admission by handler",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"handler"},
+	)
+	registerer.MustRegister(a.prometheus.wait)
+
+	a.prometheus.rejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_probe_admission_rejected_total",
+			Help: "Azure metrics probes rejected by admission control by handler and reason",
+		},
+		[]string{"handler", "reason"},
+	)
+	registerer.MustRegister(a.prometheus.rejected)
+
+	return a, nil
+}
+
+// Handler wraps the probe handler of the url with admission control
+func (a *probeAdmission) Handler(url string, handler http.Handler) http.Handler {
+	if a == nil {
+		return handler
+	}
+
+	// endpoint slot first, global slot second (same order for all probes)
+	slots := []chan struct{}{}
+	if sem, exists := a.endpoint[url]; exists {
+		slots = append(slots, sem)
+	}
+	if a.global != nil {
+		slots = append(slots, a.global)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the time waiting for admission is part of the probe timeout
+		r = r.WithContext(context.WithValue(r.Context(), probeStartTimeKey{}, time.Now()))
+
+		acquired, ok := a.tryAcquire(slots)
+		if !ok {
+			if reason, ok := a.wait(r, url, slots, acquired); !ok {
+				a.reject(w, url, reason)
+				return
+			}
+		}
+		defer a.release(slots)
+
+		a.prometheus.inflight.WithLabelValues(url).Inc()
+		defer a.prometheus.inflight.WithLabelValues(url).Dec()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// probeStartTime returns the time the probe request was received (before waiting for admission)
+func probeStartTime(r *http.Request) time.Time {
+	if startTime, ok := r.Context().Value(probeStartTimeKey{}).(time.Time); ok {
+		return startTime
+	}
+	return time.Now()
+}
+
+// tryAcquire takes all slots without waiting, returns the number of acquired slots
+func (a *probeAdmission) tryAcquire(slots []chan struct{}) (int, bool) {
+	for i, sem := range slots {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return i, false
+		}
+	}
+	return len(slots), true
+}
+
+// wait queues the probe until all slots (after the already acquired ones) are taken,
+// returns the reject reason if the probe could not be admitted
+func (a *probeAdmission) wait(r *http.Request, url string, slots []chan struct{}, acquired int) (string, bool) {
+	if queued := a.queued.Add(1); a.queueSize > 0 && queued > a.queueSize {
+		a.queued.Add(-1)
+		a.release(slots[:acquired])
+		return AdmissionRejectQueueFull, false
+	}
+	defer a.queued.Add(-1)
+
+	a.prometheus.queued.WithLabelValues(url).Inc()
+	defer a.prometheus.queued.WithLabelValues(url).Dec()
+
+	startTime := time.Now()
+	defer func() {
+		a.prometheus.wait.WithLabelValues(url).Observe(time.Since(startTime).Seconds())
+	}()
+
+	var timeout <-chan time.Time
+	if a.queueTimeout > 0 {
+		timer := time.NewTimer(a.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for i := acquired; i < len(slots); i++ {
+		select {
+		case slots[i] <- struct{}{}:
+		case <-timeout:
+			a.release(slots[:i])
+			return AdmissionRejectQueueTimeout, false
+		case <-r.Context().Done():
+			a.release(slots[:i])
+			return AdmissionRejectCanceled, false
+		}
+	}
+
+	return "", true
+}
+
+func (a *probeAdmission) release(slots []chan struct{}) {
+	for _, sem := range slots {
+		<-sem
+	}
+}
+
+// reject responds with 429 (queue full) or 503 (no slot within queue timeout) and Retry-After
+func (a *probeAdmission) reject(w http.ResponseWriter, url, reason string) {
+	a.prometheus.rejected.WithLabelValues(url, reason).Inc()
+
+	if a.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.retryAfter.Seconds()))))
+	}
+
+	switch reason {
+	case AdmissionRejectQueueFull:
+		http.Error(w, "too many concurrent probes, admission queue is full", http.StatusTooManyRequests)
+	default:
+		http.Error(w, fmt.Sprintf("probe was not admitted (%s), exporter is overloaded", reason), http.StatusServiceUnavailable)
+	}
+}
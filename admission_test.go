@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+func TestProbeAdmissionKeepsStartTimeOfQueuedProbe(t *testing.T) {
+	conf := config.Opts{}
+	conf.Prober.Admission.MaxConcurrent = 1
+	conf.Prober.Admission.QueueSize = 1
+	conf.Prober.Admission.QueueTimeout = time.Second
+
+	admission, err := newProbeAdmission(conf, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	startTimes := make(chan time.Time, 1)
+	handler := admission.Handler("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			close(started)
+			<-release
+			return
+		}
+		startTimes <- probeStartTime(r)
+	}))
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test?block=1", nil))
+	<-started
+
+	queuedTime := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	<-done
+
+	if startTime := <-startTimes; startTime.Sub(queuedTime) > 50*time.Millisecond {
+		t.Errorf("probe start time must be the time the request was received, got %s after queueing", startTime.Sub(queuedTime))
+	}
+}
+
+// testAdmissionProbe is a probe handler which blocks probes with parameter block until release is closed
+type testAdmissionProbe struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newTestAdmissionProbe() *testAdmissionProbe {
+	return &testAdmissionProbe{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (p *testAdmissionProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("block") != "" {
+		p.started <- struct{}{}
+		<-p.release
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveTestProbe runs a probe and returns the response
+func serveTestProbe(handler http.Handler, url string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+	return recorder
+}
+
+// waitForQueuedProbes waits until the expected number of probes is waiting for admission
+func waitForQueuedProbes(t *testing.T, admission *probeAdmission, queued int64) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if admission.queued.Load() == queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued probes, got %d", queued, admission.queued.Load())
+}
+
+func TestNewProbeAdmission(t *testing.T) {
+	testCases := []struct {
+		name           string
+		maxConcurrent  int
+		endpointLimits []string
+		enabled        bool
+		valid          bool
+	}{
+		{"disabled", 0, nil, false, true},
+		{"global limit", 5, nil, true, true},
+		{"endpoint limit", 0, []string{config.ProbeMetricsListUrl + "=5", " " + config.ProbeMetricsResourceUrl + " = 2"}, true, true},
+		{"missing limit", 0, []string{config.ProbeMetricsListUrl}, false, false},
+		{"invalid limit", 0, []string{config.ProbeMetricsListUrl + "=five"}, false, false},
+		{"zero limit", 0, []string{config.ProbeMetricsListUrl + "=0"}, false, false},
+		{"unknown endpoint", 0, []string{"/probe/metrics/lists=5"}, false, false},
+		{"non probe endpoint", 0, []string{config.MetricsUrl + "=5"}, false, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			conf := config.Opts{}
+			conf.Prober.Admission.MaxConcurrent = testCase.maxConcurrent
+			conf.Prober.Admission.EndpointLimits = testCase.endpointLimits
+
+			admission, err := newProbeAdmission(conf, prometheus.NewRegistry())
+			if testCase.valid != (err == nil) {
+				t.Fatalf("expected valid=%v, got error %v", testCase.valid, err)
+			}
+			if testCase.enabled != (admission != nil) {
+				t.Errorf("expected enabled=%v, got %v", testCase.enabled, admission != nil)
+			}
+		})
+	}
+}
+
+func TestProbeAdmissionRejectsWithFullQueue(t *testing.T) {
+	conf := config.Opts{}
+	conf.Prober.Admission.MaxConcurrent = 1
+	conf.Prober.Admission.QueueSize = 1
+	conf.Prober.Admission.QueueTimeout = 10 * time.Second
+	conf.Prober.Admission.RetryAfter = 5 * time.Second
+
+	admission, err := newProbeAdmission(conf, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := newTestAdmissionProbe()
+	handler := admission.Handler(config.ProbeMetricsListUrl, probe)
+
+	go serveTestProbe(handler, config.ProbeMetricsListUrl+"?block=1")
+	<-probe.started
+
+	queuedDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		queuedDone <- serveTestProbe(handler, config.ProbeMetricsListUrl)
+	}()
+	waitForQueuedProbes(t, admission, 1)
+
+	res := serveTestProbe(handler, config.ProbeMetricsListUrl)
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "5" {
+		t.Errorf("expected 429 with Retry-After, got %d (Retry-After %q)", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	close(probe.release)
+	if res := <-queuedDone; res.Code != http.StatusOK {
+		t.Errorf("expected queued probe to be admitted, got %d", res.Code)
+	}
+}
+
+func TestProbeAdmissionRejectsAfterQueueTimeout(t *testing.T) {
+	conf := config.Opts{}
+	conf.Prober.Admission.MaxConcurrent = 1
+	conf.Prober.Admission.QueueTimeout = 20 * time.Millisecond
+
+	admission, err := newProbeAdmission(conf, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := newTestAdmissionProbe()
+	defer close(probe.release)
+	handler := admission.Handler(config.ProbeMetricsListUrl, probe)
+
+	go serveTestProbe(handler, config.ProbeMetricsListUrl+"?block=1")
+	<-probe.started
+
+	if res := serveTestProbe(handler, config.ProbeMetricsListUrl); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after queue timeout, got %d", res.Code)
+	}
+	if queued := admission.queued.Load(); queued != 0 {
+		t.Errorf("expected empty queue, got %d", queued)
+	}
+}
+
+func TestProbeAdmissionEndpointLimit(t *testing.T) {
+	conf := config.Opts{}
+	conf.Prober.Admission.EndpointLimits = []string{config.ProbeMetricsListUrl + "=1"}
+	conf.Prober.Admission.QueueTimeout = 20 * time.Millisecond
+
+	admission, err := newProbeAdmission(conf, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := newTestAdmissionProbe()
+	defer close(probe.release)
+	listHandler := admission.Handler(config.ProbeMetricsListUrl, probe)
+	resourceHandler := admission.Handler(config.ProbeMetricsResourceUrl, probe)
+
+	go serveTestProbe(listHandler, config.ProbeMetricsListUrl+"?block=1")
+	<-probe.started
+
+	if res := serveTestProbe(listHandler, config.ProbeMetricsListUrl); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 of limited endpoint, got %d", res.Code)
+	}
+
+	// other endpoints are not limited
+	if res := serveTestProbe(resourceHandler, config.ProbeMetricsResourceUrl); res.Code != http.StatusOK {
+		t.Errorf("expected probe of other endpoint to be admitted, got %d", res.Code)
+	}
+}
@@ -17,4 +17,10 @@ const (
 
 	ProbeMetricsResourceGraphUrl            = "/probe/metrics/resourcegraph"
 	ProbeMetricsResourceGraphTimeoutDefault = 120
+
+	ProbeMetricsDefinitionsUrl            = "/probe/metrics/definitions"
+	ProbeMetricsDefinitionsTimeoutDefault = 30
+
+	AdminCacheUrl      = "/admin/cache"
+	AdminCacheEntryUrl = "/admin/cache/entry"
 )
@@ -22,18 +22,71 @@ type (
 				CacheDuration *time.Duration `long:"azure.servicediscovery.cache"            env:"AZURE_SERVICEDISCOVERY_CACHE"                description:"Duration for caching Azure ServiceDiscovery of workspaces to reduce API calls (time.Duration)" default:"30m"`
 			}
 			ResourceTags []string `long:"azure.resource-tag"      env:"AZURE_RESOURCE_TAG"        env-delim:" "  description:"Azure Resource tags (space delimiter)"                              default:"owner"`
+			RateLimit    struct {
+				SlowdownThreshold int64         `long:"azure.ratelimit.slowdown"          env:"AZURE_RATELIMIT_SLOWDOWN"           description:"Delay Azure requests when remaining ARM read requests of a subscription or tenant drop below this value (0 disables governor)" default:"0"`
+				PauseThreshold    int64         `long:"azure.ratelimit.pause"             env:"AZURE_RATELIMIT_PAUSE"              description:"Pause Azure requests when remaining ARM read requests of a subscription or tenant drop below this value" default:"100"`
+				MaxDelay          time.Duration `long:"azure.ratelimit.max-delay"         env:"AZURE_RATELIMIT_MAX_DELAY"          description:"Maximum delay of Azure requests while slowing down" default:"2s"`
+				PauseDuration     time.Duration `long:"azure.ratelimit.pause-duration"    env:"AZURE_RATELIMIT_PAUSE_DURATION"     description:"Pause duration of Azure requests (also used if throttled without Retry-After)" default:"30s"`
+			}
+			Retry struct {
+				MaxAttempts int           `long:"azure.retry.max-attempts"          env:"AZURE_RETRY_MAX_ATTEMPTS"           description:"Maximum attempts of Azure metric queries (1 disables retries)" default:"3"`
+				Delay       time.Duration `long:"azure.retry.delay"                 env:"AZURE_RETRY_DELAY"                  description:"Backoff of first retry of Azure metric queries (doubled for each retry, with jitter)" default:"1s"`
+				MaxDelay    time.Duration `long:"azure.retry.max-delay"             env:"AZURE_RETRY_MAX_DELAY"              description:"Maximum backoff of Azure metric query retries (Retry-After is honored)" default:"30s"`
+			}
+			Limit struct {
+				Global       int           `long:"azure.limit.global"                env:"AZURE_LIMIT_GLOBAL"                 description:"Concurrent Azure requests of all probes and jobs (0 = unlimited)" default:"0"`
+				Subscription int           `long:"azure.limit.subscription"          env:"AZURE_LIMIT_SUBSCRIPTION"           description:"Concurrent Azure requests per subscription (0 = unlimited)" default:"0"`
+				Tenant       int           `long:"azure.limit.tenant"                env:"AZURE_LIMIT_TENANT"                 description:"Concurrent Azure requests per tenant (0 = unlimited)" default:"0"`
+				MaxWait      time.Duration `long:"azure.limit.max-wait"              env:"AZURE_LIMIT_MAX_WAIT"               description:"Maximum wait for a free Azure request slot (0 = until probe timeout)" default:"30s"`
+			}
+			MetricsBatchEndpoint string `long:"azure.metrics.batch-endpoint" env:"AZURE_METRICS_BATCH_ENDPOINT" description:"Azure Monitor metrics batch api endpoint suffix (eg. metrics.monitor.azure.com, detected from environment if empty)"`
 		}
 
 		Metrics struct {
-			Template string `long:"metrics.template"               env:"METRIC_TEMPLATE"                            description:"Template for metric name"   default:"{name}"`
-			Help     string `long:"metrics.help"                   env:"METRIC_HELP"                                description:"Metric help (with template support)"   default:"Azure monitor insight metric"`
+			Template  string `long:"metrics.template"               env:"METRIC_TEMPLATE"                            description:"Template for metric name"   default:"{name}"`
+			Help      string `long:"metrics.help"                   env:"METRIC_HELP"                                description:"Metric help (with template support)"   default:"Azure monitor insight metric"`
+			Labels    string `long:"metrics.labels"                 env:"METRIC_LABELS"                              description:"Template for additional metric labels (Go template, name=value pairs)"`
+			Timestamp bool   `long:"metrics.timestamp"              env:"METRIC_TIMESTAMP"                           description:"Export metrics with timestamp of Azure datapoint instead of scrape time"`
 		}
 
 		// Prober settings
 		Prober struct {
-			ConcurrencySubscription         int  `long:"concurrency.subscription"          env:"CONCURRENCY_SUBSCRIPTION"           description:"Concurrent subscription fetches"                                  default:"5"`
-			ConcurrencySubscriptionResource int  `long:"concurrency.subscription.resource" env:"CONCURRENCY_SUBSCRIPTION_RESOURCE"  description:"Concurrent requests per resource (inside subscription requests)"  default:"10"`
-			Cache                           bool `long:"enable-caching"                    env:"ENABLE_CACHING"                     description:"Enable internal caching"`
+			ConcurrencySubscription         int           `long:"concurrency.subscription"          env:"CONCURRENCY_SUBSCRIPTION"           description:"Concurrent subscription fetches"                                  default:"5"`
+			ConcurrencySubscriptionResource int           `long:"concurrency.subscription.resource" env:"CONCURRENCY_SUBSCRIPTION_RESOURCE"  description:"Concurrent requests per resource (inside subscription requests)"  default:"10"`
+			Cache                           bool          `long:"enable-caching"                    env:"ENABLE_CACHING"                     description:"Enable internal caching"`
+			DeadlineMargin                  time.Duration `long:"probe.deadline-margin"             env:"PROBE_DEADLINE_MARGIN"              description:"Stop collection of probes this duration before the timeout and return partial metrics (max 1/4 of the timeout, 0 disables)" default:"1s"`
+
+			// admission control
+			Admission struct {
+				MaxConcurrent  int           `long:"probe.max-concurrent"              env:"PROBE_MAX_CONCURRENT"               description:"Concurrent probes of all endpoints (0 = unlimited)" default:"0"`
+				EndpointLimits []string      `long:"probe.endpoint-limit"              env:"PROBE_ENDPOINT_LIMIT"    env-delim:" " description:"Concurrent probes of one endpoint (format: <url>=<limit>, eg. /probe/metrics/list=5)"`
+				QueueSize      int           `long:"probe.queue.size"                  env:"PROBE_QUEUE_SIZE"                   description:"Probes waiting for admission before new probes are rejected with 429 (0 = unlimited)" default:"0"`
+				QueueTimeout   time.Duration `long:"probe.queue.timeout"               env:"PROBE_QUEUE_TIMEOUT"                description:"Maximum wait for admission before probe is rejected with 503" default:"10s"`
+				RetryAfter     time.Duration `long:"probe.retry-after"                 env:"PROBE_RETRY_AFTER"                  description:"Retry-After of rejected probes" default:"10s"`
+			}
+		}
+
+		// cache backend
+		Cache struct {
+			Backend  string        `long:"cache.backend"                    env:"CACHE_BACKEND"                      description:"Cache backend for metrics and servicediscovery" default:"memory" choice:"memory" choice:"file" choice:"redis"`
+			Path     string        `long:"cache.path"                       env:"CACHE_PATH"                         description:"Path to cache database (backend file)" default:"/tmp/azure-metrics-exporter.db"`
+			Mode     string        `long:"cache.mode"                       env:"CACHE_MODE"                         description:"Default cache mode of probes" default:"fresh" choice:"fresh" choice:"stale-if-error" choice:"stale-while-revalidate"`
+			MaxStale time.Duration `long:"cache.max-stale"                  env:"CACHE_MAX_STALE"                    description:"Default maximum duration expired metrics are served (cache modes stale-if-error and stale-while-revalidate)" default:"1h"`
+			Memory   struct {
+				MaxBytes  int64 `long:"cache.memory.max-bytes"  env:"CACHE_MEMORY_MAX_BYTES"               description:"Maximum estimated memory of cached entries in bytes, least recently used entries are evicted (backend memory, 0 = unlimited)" default:"268435456"`
+				MaxSeries int64 `long:"cache.memory.max-series" env:"CACHE_MEMORY_MAX_SERIES"              description:"Maximum series of cached metrics, least recently used entries are evicted (backend memory, 0 = unlimited)" default:"0"`
+			}
+			Redis struct {
+				Addr     string `long:"cache.redis.addr"         env:"CACHE_REDIS_ADDR"                   description:"Redis address (backend redis)" default:"localhost:6379"`
+				Password string `long:"cache.redis.password"     env:"CACHE_REDIS_PASSWORD"               description:"Redis password (backend redis)" json:"-"`
+				DB       int    `long:"cache.redis.db"           env:"CACHE_REDIS_DB"                     description:"Redis database (backend redis)" default:"0"`
+				Prefix   string `long:"cache.redis.prefix"       env:"CACHE_REDIS_PREFIX"                 description:"Redis key prefix (backend redis)" default:"azure-metrics-exporter:"`
+			}
+		}
+
+		// background collection jobs
+		Jobs struct {
+			Config string `long:"jobs.config"                      env:"JOBS_CONFIG"                        description:"Path to config file with background collection jobs (yaml)"`
 		}
 
 		// general options
@@ -42,6 +95,7 @@ type (
 			Bind         string        `long:"server.bind"              env:"SERVER_BIND"           description:"Server address"        default:":8080"`
 			ReadTimeout  time.Duration `long:"server.timeout.read"      env:"SERVER_TIMEOUT_READ"   description:"Server read timeout"   default:"5s"`
 			WriteTimeout time.Duration `long:"server.timeout.write"     env:"SERVER_TIMEOUT_WRITE"  description:"Server write timeout"  default:"10s"`
+			AdminToken   string        `long:"server.admin.token"       env:"SERVER_ADMIN_TOKEN"    description:"Bearer token for admin api (cache inspection and purge), admin api is disabled if empty" json:"-"`
 		}
 	}
 )
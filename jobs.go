@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+type (
+	// collectorJobGatherers merges the metrics of multiple gatherers without duplicate checks
+	// (datapoint policy "all" exposes multiple samples of one series with different timestamps)
+	collectorJobGatherers []prometheus.Gatherer
+
+	collectorJob struct {
+		conf   *metrics.MetricJob
+		logger *zap.SugaredLogger
+
+		// gatherer of the last finished run, replaced atomically after each run
+		gatherer atomic.Value
+	}
+)
+
+const (
+	CollectorJobResultSuccess = "success"
+	CollectorJobResultFailed  = "failed"
+)
+
+var (
+	collectorJobs []*collectorJob
+)
+
+func initCollectorJobs() {
+	if opts.Jobs.Config == "" {
+		return
+	}
+
+	logger.Infof("loading collection jobs from %s", opts.Jobs.Config)
+	jobConfig, err := metrics.NewMetricJobConfigFromFile(opts.Jobs.Config, opts)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	for _, jobConf := range jobConfig.Jobs {
+		job := &collectorJob{
+			conf:   jobConf,
+			logger: logger.With(zap.String("job", jobConf.Job)),
+		}
+		collectorJobs = append(collectorJobs, job)
+	}
+}
+
+func startCollectorJobs() {
+	for _, job := range collectorJobs {
+		go job.start()
+	}
+}
+
+// collectorJobGatherersByPath returns the gatherers of all jobs grouped by their http path
+func collectorJobGatherersByPath() map[string]collectorJobGatherers {
+	ret := map[string]collectorJobGatherers{}
+	for _, job := range collectorJobs {
+		path := job.conf.Path
+		if path == "" {
+			path = config.MetricsUrl
+		}
+		ret[path] = append(ret[path], job)
+	}
+	return ret
+}
+
+func (j *collectorJob) start() {
+	j.logger.Infof("starting collection job with interval %s", j.conf.CollectInterval.String())
+
+	ticker := time.NewTicker(j.conf.CollectInterval)
+	defer ticker.Stop()
+
+	for {
+		j.run()
+		<-ticker.C
+	}
+}
+
+// run collects the metrics of the job and replaces the gatherer, a failed (or panicking) run keeps
+// the metrics of the previous run and the schedule of the job continues
+func (j *collectorJob) run() {
+	startTime := time.Now()
+	result := CollectorJobResultFailed
+	defer func() {
+		// eg. invalid metric names of templates or relabel rules must not kill the exporter
+		if r := recover(); r != nil {
+			j.logger.Errorf("collection job run panicked: %v\n%s", r, debug.Stack())
+		}
+		prometheusCollectorJobRuns.With(prometheus.Labels{
+			"job":    j.conf.Job,
+			"result": result,
+		}).Inc()
+	}()
+
+	gatherer, err := j.collect(startTime)
+	if err != nil {
+		j.logger.Error(err)
+		return
+	}
+
+	j.gatherer.Store(gatherer)
+	result = CollectorJobResultSuccess
+	j.logger.Debugf("finished collection job run in %s", time.Since(startTime).String())
+}
+
+// collect runs the probe of the job and returns the gatherer of the collected metrics
+func (j *collectorJob) collect(startTime time.Time) (prometheus.Gatherer, error) {
+	handlerName := "job:" + j.conf.Job
+	registry := prometheus.NewRegistry()
+
+	ctx, cancel := context.WithTimeout(context.Background(), j.conf.CollectInterval)
+	defer cancel()
+
+	settings := j.conf.Settings()
+
+	prober := metrics.NewMetricProber(ctx, j.logger, nil, &settings, opts)
+	prober.SetUserAgent(UserAgent + gitTag)
+	prober.SetAzureClient(AzureClient)
+	prober.SetAzureResourceTagManager(AzureResourceTagManager)
+	prober.SetRateLimitGovernor(AzureRateLimitGovernor)
+	prober.SetRetryPolicy(AzureRetryPolicy)
+	prober.SetRequestLimiter(AzureRequestLimiter)
+	prober.SetDeadlineMargin(opts.Prober.DeadlineMargin)
+	prober.SetPrometheusRegistry(registry)
+	prober.SetProbeStatusLabels(prometheus.Labels{"collectionJob": j.conf.Job})
+
+	if opts.Azure.ServiceDiscovery.CacheDuration.Seconds() > 0 {
+		prober.EnableServiceDiscoveryCache(azureCache, opts.Azure.ServiceDiscovery.CacheDuration)
+	}
+
+	prober.RegisterSubscriptionCollectFinishCallback(func(subscriptionId string) {
+		// global stats counter
+		prometheusCollectTime.With(prometheus.Labels{
+			"subscriptionID": subscriptionId,
+			"handler":        handlerName,
+			"filter":         settings.Filter,
+		}).Observe(time.Since(startTime).Seconds())
+	})
+
+	if discoverer := j.conf.TargetDiscoverer(); discoverer != nil {
+		if err := discoverer.DiscoverTargets(ctx, prober); err != nil {
+			return nil, err
+		}
+		if err := prober.Run(); err != nil {
+			return nil, err
+		}
+	} else if err := prober.RunOnSubscriptionScope(); err != nil {
+		return nil, err
+	}
+
+	return prober.Gatherer(), nil
+}
+
+// Gather implements prometheus.Gatherer and returns the metrics of the last finished run
+func (j *collectorJob) Gather() ([]*dto.MetricFamily, error) {
+	if gatherer, ok := j.gatherer.Load().(prometheus.Gatherer); ok {
+		return gatherer.Gather()
+	}
+	return nil, nil
+}
+
+func (gs collectorJobGatherers) Gather() ([]*dto.MetricFamily, error) {
+	var errs prometheus.MultiError
+	ret := []*dto.MetricFamily{}
+	familyIndex := map[string]*dto.MetricFamily{}
+
+	for _, gatherer := range gs {
+		families, err := gatherer.Gather()
+		if err != nil {
+			errs.Append(err)
+		}
+
+		for _, family := range families {
+			if existingFamily, exists := familyIndex[family.GetName()]; exists {
+				existingFamily.Metric = append(existingFamily.Metric, family.Metric...)
+				continue
+			}
+			familyIndex[family.GetName()] = family
+			ret = append(ret, family)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetName() < ret[j].GetName()
+	})
+
+	return ret, errs.MaybeUnwrap()
+}
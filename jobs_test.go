@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+// newTestCollectorJob returns a job which serves one gauge per label value (as after a finished run)
+func newTestCollectorJob(name, path string, labelValues ...string) *collectorJob {
+	job := &collectorJob{
+		conf:   &metrics.MetricJob{Job: name, Path: path},
+		logger: zap.NewNop().Sugar(),
+	}
+
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "azurerm_test", Help: "test"}, []string{"job"})
+	registry.MustRegister(gauge)
+	for _, labelValue := range labelValues {
+		gauge.WithLabelValues(labelValue).Set(1)
+	}
+	job.gatherer.Store(prometheus.Gatherer(registry))
+
+	return job
+}
+
+func TestCollectorJobGatherersByPath(t *testing.T) {
+	previousJobs := collectorJobs
+	defer func() { collectorJobs = previousJobs }()
+
+	collectorJobs = []*collectorJob{
+		newTestCollectorJob("default", "", "default"),
+		newTestCollectorJob("metrics", config.MetricsUrl, "metrics"),
+		newTestCollectorJob("first", "/jobs", "first"),
+		newTestCollectorJob("second", "/jobs", "second"),
+		// not run yet
+		{conf: &metrics.MetricJob{Job: "pending", Path: "/jobs"}, logger: zap.NewNop().Sugar()},
+	}
+
+	gatherersByPath := collectorJobGatherersByPath()
+	if len(gatherersByPath) != 2 {
+		t.Fatalf("expected gatherers of 2 paths, got %d", len(gatherersByPath))
+	}
+	if len(gatherersByPath[config.MetricsUrl]) != 2 {
+		t.Errorf("expected jobs without path to be served on %s, got %d gatherers", config.MetricsUrl, len(gatherersByPath[config.MetricsUrl]))
+	}
+
+	// metrics of jobs with the same path are merged into one family
+	families, err := gatherersByPath["/jobs"].Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "azurerm_test" {
+		t.Fatalf("expected one merged family, got %v", families)
+	}
+	if len(families[0].Metric) != 2 {
+		t.Errorf("expected metrics of both jobs, got %d", len(families[0].Metric))
+	}
+}
+
+func TestCollectorJobGatherersSortsFamilies(t *testing.T) {
+	first := prometheus.NewRegistry()
+	first.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "azurerm_b", Help: "b"}))
+	second := prometheus.NewRegistry()
+	second.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "azurerm_a", Help: "a"}))
+
+	families, err := collectorJobGatherers{first, second}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 2 || families[0].GetName() != "azurerm_a" || families[1].GetName() != "azurerm_b" {
+		t.Errorf("expected families sorted by name, got %v", families)
+	}
+}
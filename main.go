@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/base64"
 	"errors"
@@ -8,12 +9,12 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
-	"time"
+	"syscall"
 
 	"github.com/google/uuid"
 	"github.com/jessevdk/go-flags"
-	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/webdevops/go-common/azuresdk/armclient"
@@ -21,6 +22,7 @@ import (
 	"github.com/webdevops/go-common/azuresdk/prometheus/tracing"
 
 	"github.com/webdevops/azure-metrics-exporter/config"
+	"github.com/webdevops/azure-metrics-exporter/metrics"
 )
 
 const (
@@ -35,12 +37,25 @@ var (
 
 	AzureClient             *armclient.ArmClient
 	AzureResourceTagManager *armclient.ResourceTagManager
+	AzureRateLimitGovernor  *metrics.RateLimitGovernor
+	AzureRetryPolicy        *metrics.RetryPolicy
+	AzureRequestLimiter     *metrics.RequestLimiter
 
 	prometheusCollectTime    *prometheus.SummaryVec
 	prometheusMetricRequests *prometheus.CounterVec
+	prometheusProbeAbandoned *prometheus.CounterVec
 
-	metricsCache *cache.Cache
-	azureCache   *cache.Cache
+	prometheusCollectorJobRuns *prometheus.CounterVec
+
+	probeAdmissionControl *probeAdmission
+
+	// shutdownCtx is canceled on SIGINT/SIGTERM, background work (eg. revalidations) is bound to it
+	shutdownCtx       context.Context
+	probeRevalidation *probeRevalidations
+
+	metricsCache metrics.Cache
+	azureCache   metrics.Cache
+	cacheAdmin   *metrics.InstrumentedCache
 
 	//go:embed templates/*.html
 	templates embed.FS
@@ -54,14 +69,20 @@ func main() {
 	initArgparser()
 	initLogger()
 
+	var stop context.CancelFunc
+	shutdownCtx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	probeRevalidation = newProbeRevalidations(shutdownCtx)
+
 	logger.Infof("starting azure-metrics-exporter v%s (%s; %s; by %v)", gitTag, gitCommit, runtime.Version(), Author)
 	logger.Info(string(opts.GetJson()))
-	metricsCache = cache.New(1*time.Minute, 1*time.Minute)
-	azureCache = cache.New(1*time.Minute, 1*time.Minute)
+	initCache()
 
 	logger.Infof("init Azure connection")
 	initAzureConnection()
 	initMetricCollector()
+	initCollectorJobs()
+	startCollectorJobs()
 
 	logger.Infof("starting http server on %s", opts.Server.Bind)
 	startHttpServer()
@@ -84,6 +105,19 @@ func initArgparser() {
 	}
 }
 
+func initCache() {
+	backend, err := metrics.NewCache(logger, opts)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	cache := metrics.NewInstrumentedCache(logger, backend, prometheus.DefaultRegisterer)
+
+	// metrics and servicediscovery share the cache backend (keys are prefixed)
+	metricsCache = cache
+	azureCache = cache
+	cacheAdmin = cache
+}
+
 func initAzureConnection() {
 	var err error
 
@@ -127,17 +161,41 @@ func startHttpServer() {
 		}
 	})
 
-	mux.Handle(config.MetricsUrl, tracing.RegisterAzureMetricAutoClean(promhttp.Handler()))
+	// collection jobs (served on /metrics or on their own path)
+	jobGatherers := collectorJobGatherersByPath()
+	for path, gatherers := range jobGatherers {
+		if path == config.MetricsUrl {
+			continue
+		}
+		mux.Handle(path, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+	}
+
+	metricsGatherers := collectorJobGatherers{prometheus.DefaultGatherer}
+	metricsGatherers = append(metricsGatherers, jobGatherers[config.MetricsUrl]...)
+	mux.Handle(config.MetricsUrl, tracing.RegisterAzureMetricAutoClean(
+		promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(metricsGatherers, promhttp.HandlerOpts{}),
+		),
+	))
+
+	mux.Handle(config.ProbeMetricsResourceUrl, probeAdmissionControl.Handler(config.ProbeMetricsResourceUrl, probeMetricsResourceHandler))
+
+	mux.Handle(config.ProbeMetricsListUrl, probeAdmissionControl.Handler(config.ProbeMetricsListUrl, probeMetricsListHandler))
 
-	mux.HandleFunc(config.ProbeMetricsResourceUrl, probeMetricsResourceHandler)
+	mux.Handle(config.ProbeMetricsSubscriptionUrl, probeAdmissionControl.Handler(config.ProbeMetricsSubscriptionUrl, probeMetricsSubscriptionHandler))
 
-	mux.HandleFunc(config.ProbeMetricsListUrl, probeMetricsListHandler)
+	mux.Handle(config.ProbeMetricsScrapeUrl, probeAdmissionControl.Handler(config.ProbeMetricsScrapeUrl, probeMetricsScrapeHandler))
 
-	mux.HandleFunc(config.ProbeMetricsSubscriptionUrl, probeMetricsSubscriptionHandler)
+	mux.Handle(config.ProbeMetricsResourceGraphUrl, probeAdmissionControl.Handler(config.ProbeMetricsResourceGraphUrl, probeMetricsResourceGraphHandler))
 
-	mux.HandleFunc(config.ProbeMetricsScrapeUrl, probeMetricsScrapeHandler)
+	mux.Handle(config.ProbeMetricsDefinitionsUrl, probeAdmissionControl.Handler(config.ProbeMetricsDefinitionsUrl, http.HandlerFunc(probeMetricsDefinitionsHandler)))
 
-	mux.HandleFunc(config.ProbeMetricsResourceGraphUrl, probeMetricsResourceGraphHandler)
+	// admin api
+	if opts.Server.AdminToken != "" {
+		mux.Handle(config.AdminCacheUrl, adminAuth(http.HandlerFunc(adminCacheHandler)))
+		mux.Handle(config.AdminCacheEntryUrl, adminAuth(http.HandlerFunc(adminCacheEntryHandler)))
+	}
 
 	// report
 	tmpl := template.Must(template.ParseFS(templates, "templates/*.html"))
@@ -173,7 +231,26 @@ func startHttpServer() {
 		ReadTimeout:  opts.Server.ReadTimeout,
 		WriteTimeout: opts.Server.WriteTimeout,
 	}
-	logger.Fatal(srv.ListenAndServe())
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-shutdownCtx.Done()
+		logger.Info("shutting down http server")
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Server.WriteTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warnf("unable to shutdown http server: %v", err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal(err)
+	}
+
+	// running probes are finished, revalidations are canceled by the shutdown
+	<-shutdownDone
+	probeRevalidation.wait()
 }
 
 func initMetricCollector() {
@@ -203,4 +280,38 @@ func initMetricCollector() {
 		},
 	)
 	prometheus.MustRegister(prometheusMetricRequests)
+
+	prometheusProbeAbandoned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_probe_abandoned_total",
+			Help: "Azure metrics probes abandoned by the client before the probe was finished",
+		},
+		[]string{
+			"handler",
+		},
+	)
+	prometheus.MustRegister(prometheusProbeAbandoned)
+
+	prometheusCollectorJobRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_collection_job_runs_total",
+			Help: "Azure metrics collection job runs by job and result",
+		},
+		[]string{
+			"job",
+			"result",
+		},
+	)
+	prometheus.MustRegister(prometheusCollectorJobRuns)
+
+	metrics.RegisterMetricListMetrics(prometheus.DefaultRegisterer)
+
+	AzureRateLimitGovernor = metrics.NewRateLimitGovernor(metrics.NewRateLimitGovernorConfig(opts), prometheus.DefaultRegisterer)
+	AzureRetryPolicy = metrics.NewRetryPolicy(metrics.NewRetryPolicyConfig(opts), prometheus.DefaultRegisterer)
+	AzureRequestLimiter = metrics.NewRequestLimiter(metrics.NewRequestLimiterConfig(opts), prometheus.DefaultRegisterer)
+
+	var err error
+	if probeAdmissionControl, err = newProbeAdmission(opts, prometheus.DefaultRegisterer); err != nil {
+		logger.Fatal(err)
+	}
 }
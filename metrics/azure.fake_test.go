@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/azuresdk/cloudconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	testSubscriptionId = "00000000-0000-0000-0000-000000000001"
+)
+
+type (
+	// fakeAzureTransport serves the Azure API of the tests and records all requests
+	fakeAzureTransport struct {
+		lock     sync.Mutex
+		requests []fakeAzureRequest
+
+		// handler returns the response body of a request, the default returns one datapoint per metric
+		handler func(req *http.Request, body []byte) (int, any)
+	}
+
+	fakeAzureRequest struct {
+		Method string
+		URL    string
+		Body   []byte
+	}
+
+	fakeAzureCredential struct{}
+)
+
+func (fakeAzureCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "test", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func (t *fakeAzureTransport) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	t.lock.Lock()
+	t.requests = append(t.requests, fakeAzureRequest{Method: req.Method, URL: req.URL.String(), Body: body})
+	handler := t.handler
+	t.lock.Unlock()
+
+	if handler == nil {
+		handler = fakeAzureMetricsResponse
+	}
+
+	statusCode, payload := handler(req, body)
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(data))),
+		Request:    req,
+	}, nil
+}
+
+// Requests returns the recorded requests with the path (case insensitive) containing pathPart
+func (t *fakeAzureTransport) Requests(pathPart string) []fakeAzureRequest {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := []fakeAzureRequest{}
+	for _, req := range t.requests {
+		if strings.Contains(strings.ToLower(req.URL), strings.ToLower(pathPart)) {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+// fakeAzureMetricsResponse returns one datapoint (average 1) per requested metric
+// for the metrics api (arm) and the metrics batch api
+func fakeAzureMetricsResponse(req *http.Request, body []byte) (int, any) {
+	metrics := []any{}
+	for _, metricName := range strings.Split(req.URL.Query().Get("metricnames"), ",") {
+		metrics = append(metrics, map[string]any{
+			"name": map[string]any{"value": metricName},
+			"unit": "Count",
+			"timeseries": []any{
+				map[string]any{"data": []any{map[string]any{"timeStamp": "2024-01-01T00:00:00Z", "average": 1}}},
+			},
+		})
+	}
+
+	if strings.Contains(req.URL.Path, "metrics:getBatch") {
+		batchRequest := metricsBatchRequest{}
+		if err := json.Unmarshal(body, &batchRequest); err != nil {
+			return http.StatusBadRequest, map[string]any{"error": err.Error()}
+		}
+
+		values := []any{}
+		for _, resourceId := range batchRequest.ResourceIds {
+			values = append(values, map[string]any{"resourceid": resourceId, "value": metrics})
+		}
+		return http.StatusOK, map[string]any{"values": values}
+	}
+
+	return http.StatusOK, map[string]any{"timespan": "PT1M", "value": metrics}
+}
+
+// newTestAzureProber returns a prober using the fake Azure API (no requests leave the test)
+func newTestAzureProber(ctx context.Context, transport *fakeAzureTransport) *MetricProber {
+	cloudConfig, err := cloudconfig.NewCloudConfig(string(cloudconfig.AzurePublicCloud))
+	if err != nil {
+		panic(err)
+	}
+
+	prober := newTestProber(ctx)
+	prober.SetAzureClient(armclient.NewArmClient(cloudConfig, zap.NewNop().Sugar()))
+	prober.azureTransport = transport
+	prober.azureCredential = fakeAzureCredential{}
+	prober.subscriptionNames.Store(testSubscriptionId, "test")
+	prober.settings.Subscriptions = []string{testSubscriptionId}
+	prober.settings.Timespan = "PT1M"
+	return prober
+}
+
+// testResourceId returns the id of the n-th test resource of the resource type
+func testResourceId(resourceType string, n int) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/example/providers/%s/resource%d", testSubscriptionId, resourceType, n)
+}
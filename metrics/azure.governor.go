@@ -0,0 +1,336 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	RateLimitScopeSubscription = "subscription"
+	RateLimitScopeTenant       = "tenant"
+
+	RateLimitStateNormal   = 0
+	RateLimitStateSlowdown = 1
+	RateLimitStatePaused   = 2
+)
+
+var (
+	rateLimitSubscriptionRegexp = regexp.MustCompile(`^(?i)/subscriptions/([^/]+)/?.*$`)
+
+	// remaining read quota headers, the lowest value is used
+	rateLimitHeaders = map[string][]string{
+		RateLimitScopeSubscription: {
+			"x-ms-ratelimit-remaining-subscription-reads",
+			"x-ms-ratelimit-remaining-subscription-global-reads",
+			"x-ms-ratelimit-remaining-subscription-resource-requests",
+		},
+		RateLimitScopeTenant: {
+			"x-ms-ratelimit-remaining-tenant-reads",
+			"x-ms-ratelimit-remaining-tenant-resource-requests",
+		},
+	}
+)
+
+type (
+	// RateLimitGovernor slows down or pauses Azure requests when the remaining ARM rate limit
+	// of a subscription or tenant drops (process wide, shared by all probes)
+	RateLimitGovernor struct {
+		lock sync.Mutex
+		conf RateLimitGovernorConfig
+
+		scopes map[rateLimitScopeKey]*rateLimitScope
+
+		// tenant of each subscription (learned from the access token of responses)
+		subscriptionTenant map[string]string
+
+		prometheus struct {
+			remaining *prometheus.GaugeVec
+			state     *prometheus.GaugeVec
+			delay     *prometheus.CounterVec
+		}
+	}
+
+	RateLimitGovernorConfig struct {
+		// remaining requests below which requests are delayed (0 disables the governor)
+		SlowdownThreshold int64
+
+		// remaining requests below which requests are paused
+		PauseThreshold int64
+
+		// delay at remaining of 0 (scaled linearly between SlowdownThreshold and 0)
+		MaxDelay time.Duration
+
+		// pause duration (also used for throttled requests without Retry-After)
+		PauseDuration time.Duration
+
+		// remaining values are ignored after this duration (the rate limit refills over time)
+		StaleAfter time.Duration
+	}
+
+	rateLimitScopeKey struct {
+		scope string
+		id    string
+	}
+
+	rateLimitScope struct {
+		remaining   int64
+		updated     time.Time
+		pausedUntil time.Time
+	}
+
+	rateLimitGovernorPolicy struct {
+		governor *RateLimitGovernor
+	}
+)
+
+func NewRateLimitGovernorConfig(conf config.Opts) RateLimitGovernorConfig {
+	return RateLimitGovernorConfig{
+		SlowdownThreshold: conf.Azure.RateLimit.SlowdownThreshold,
+		PauseThreshold:    conf.Azure.RateLimit.PauseThreshold,
+		MaxDelay:          conf.Azure.RateLimit.MaxDelay,
+		PauseDuration:     conf.Azure.RateLimit.PauseDuration,
+		StaleAfter:        1 * time.Minute,
+	}
+}
+
+// NewRateLimitGovernor creates the governor and registers its metrics, returns nil if disabled
+func NewRateLimitGovernor(conf RateLimitGovernorConfig, registerer prometheus.Registerer) *RateLimitGovernor {
+	if conf.SlowdownThreshold <= 0 {
+		return nil
+	}
+
+	g := &RateLimitGovernor{
+		conf:               conf,
+		scopes:             map[rateLimitScopeKey]*rateLimitScope{},
+		subscriptionTenant: map[string]string{},
+	}
+
+	g.prometheus.remaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurerm_ratelimit_governor_remaining",
+			Help: "Azure ratelimit governor last seen remaining read requests",
+		},
+		[]string{"scope", "scopeID"},
+	)
+	registerer.MustRegister(g.prometheus.remaining)
+
+	g.prometheus.state = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurerm_ratelimit_governor_state",
+			Help: "Azure ratelimit governor state (0=normal, 1=slowdown, 2=paused)",
+		},
+		[]string{"scope", "scopeID"},
+	)
+	registerer.MustRegister(g.prometheus.state)
+
+	g.prometheus.delay = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_ratelimit_governor_delay_seconds_total",
+			Help: "Azure ratelimit governor total delay of requests",
+		},
+		[]string{"scope"},
+	)
+	registerer.MustRegister(g.prometheus.delay)
+
+	return g
+}
+
+// Policy returns the azure sdk policy for the governor (per call, next to noCachePolicy)
+func (g *RateLimitGovernor) Policy() policy.Policy {
+	return rateLimitGovernorPolicy{governor: g}
+}
+
+func (p rateLimitGovernorPolicy) Do(req *policy.Request) (*http.Response, error) {
+	subscriptionId := ""
+	if matches := rateLimitSubscriptionRegexp.FindStringSubmatch(req.Raw().URL.Path); len(matches) >= 2 {
+		subscriptionId = strings.ToLower(matches[1])
+	}
+
+	if delay, scope := p.governor.delay(subscriptionId, time.Now()); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			p.governor.prometheus.delay.WithLabelValues(scope).Add(delay.Seconds())
+		case <-req.Raw().Context().Done():
+			timer.Stop()
+			return nil, req.Raw().Context().Err()
+		}
+	}
+
+	res, err := req.Next()
+	if res != nil {
+		p.governor.update(subscriptionId, res, time.Now())
+	}
+	return res, err
+}
+
+// delay returns the delay for a request of the subscription (and its tenant) and the limiting scope
+func (g *RateLimitGovernor) delay(subscriptionId string, now time.Time) (time.Duration, string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	keys := []rateLimitScopeKey{}
+	if subscriptionId != "" {
+		keys = append(keys, rateLimitScopeKey{scope: RateLimitScopeSubscription, id: subscriptionId})
+		if tenantId, exists := g.subscriptionTenant[subscriptionId]; exists {
+			keys = append(keys, rateLimitScopeKey{scope: RateLimitScopeTenant, id: tenantId})
+		}
+	}
+
+	var ret time.Duration
+	retScope := ""
+	for _, key := range keys {
+		scope, exists := g.scopes[key]
+		if !exists {
+			continue
+		}
+
+		delay := g.scopeDelay(scope, now)
+		g.prometheus.state.WithLabelValues(key.scope, key.id).Set(float64(g.scopeState(scope, now)))
+		if delay > ret {
+			ret = delay
+			retScope = key.scope
+		}
+	}
+
+	return ret, retScope
+}
+
+func (g *RateLimitGovernor) scopeDelay(scope *rateLimitScope, now time.Time) time.Duration {
+	if now.Before(scope.pausedUntil) {
+		return scope.pausedUntil.Sub(now)
+	}
+
+	if now.Sub(scope.updated) > g.conf.StaleAfter || scope.remaining >= g.conf.SlowdownThreshold {
+		return 0
+	}
+
+	// scale delay linearly with the used quota below the threshold
+	factor := 1 - math.Max(float64(scope.remaining), 0)/float64(g.conf.SlowdownThreshold)
+	return time.Duration(factor * float64(g.conf.MaxDelay))
+}
+
+func (g *RateLimitGovernor) scopeState(scope *rateLimitScope, now time.Time) int {
+	switch {
+	case now.Before(scope.pausedUntil):
+		return RateLimitStatePaused
+	case now.Sub(scope.updated) <= g.conf.StaleAfter && scope.remaining < g.conf.SlowdownThreshold:
+		return RateLimitStateSlowdown
+	default:
+		return RateLimitStateNormal
+	}
+}
+
+// update reads the remaining rate limit of the response
+func (g *RateLimitGovernor) update(subscriptionId string, res *http.Response, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	tenantId := rateLimitTenantFromResponse(res)
+	if subscriptionId != "" && tenantId != "" {
+		g.subscriptionTenant[subscriptionId] = tenantId
+	}
+
+	ids := map[string]string{
+		RateLimitScopeSubscription: subscriptionId,
+		RateLimitScopeTenant:       tenantId,
+	}
+
+	for scopeName, id := range ids {
+		if id == "" {
+			continue
+		}
+
+		key := rateLimitScopeKey{scope: scopeName, id: id}
+		scope, exists := g.scopes[key]
+		if !exists {
+			scope = &rateLimitScope{}
+		}
+
+		found := false
+		remaining := int64(math.MaxInt64)
+		for _, headerName := range rateLimitHeaders[scopeName] {
+			if v, err := strconv.ParseInt(res.Header.Get(headerName), 10, 64); err == nil {
+				found = true
+				if v < remaining {
+					remaining = v
+				}
+			}
+		}
+
+		if found {
+			scope.remaining = remaining
+			scope.updated = now
+			g.prometheus.remaining.WithLabelValues(key.scope, key.id).Set(float64(remaining))
+
+			if g.conf.PauseThreshold > 0 && remaining <= g.conf.PauseThreshold {
+				scope.pause(now.Add(g.conf.PauseDuration))
+			}
+		}
+
+		// throttled by Azure, pause scope (subscription only, the response doesn't tell which limit was hit)
+		if res.StatusCode == http.StatusTooManyRequests && scopeName == RateLimitScopeSubscription {
+			pause := g.conf.PauseDuration
+			if retryAfter, err := strconv.ParseInt(res.Header.Get("Retry-After"), 10, 64); err == nil && retryAfter > 0 {
+				pause = time.Duration(retryAfter) * time.Second
+			}
+			scope.pause(now.Add(pause))
+			found = true
+		}
+
+		if found {
+			g.scopes[key] = scope
+			g.prometheus.state.WithLabelValues(key.scope, key.id).Set(float64(g.scopeState(scope, now)))
+		}
+	}
+}
+
+// pause extends the pause of the scope (an active longer pause is kept)
+func (s *rateLimitScope) pause(until time.Time) {
+	if until.After(s.pausedUntil) {
+		s.pausedUntil = until
+	}
+}
+
+// rateLimitTenantFromResponse extracts the tenant id from the access token of the request
+func rateLimitTenantFromResponse(res *http.Response) string {
+	if res.Request == nil {
+		return ""
+	}
+
+	authToken := res.Request.Header.Get("authorization")
+	if !strings.HasPrefix(authToken, "Bearer") {
+		return ""
+	}
+
+	authTokenParts := strings.Split(strings.TrimSpace(strings.TrimPrefix(authToken, "Bearer")), ".")
+	if len(authTokenParts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(authTokenParts[1])
+	if err != nil {
+		return ""
+	}
+
+	token := struct {
+		Tid string `json:"tid"`
+	}{}
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return ""
+	}
+
+	return strings.ToLower(token.Tid)
+}
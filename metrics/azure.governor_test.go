@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestRateLimitGovernor() *RateLimitGovernor {
+	return NewRateLimitGovernor(RateLimitGovernorConfig{
+		SlowdownThreshold: 1000,
+		PauseThreshold:    100,
+		MaxDelay:          2 * time.Second,
+		PauseDuration:     30 * time.Second,
+		StaleAfter:        time.Minute,
+	}, prometheus.NewRegistry())
+}
+
+// testRateLimitResponse returns a response of a request authorized with a token of the tenant
+func testRateLimitResponse(statusCode int, tenantId string, header http.Header) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, "https://management.azure.com/subscriptions/sub1/resources", nil)
+	if tenantId != "" {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tid":"` + tenantId + `"}`))
+		req.Header.Set("Authorization", "Bearer header."+payload+".signature")
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: statusCode, Header: header, Request: req}
+}
+
+func TestRateLimitGovernorDisabled(t *testing.T) {
+	if governor := NewRateLimitGovernor(RateLimitGovernorConfig{}, prometheus.NewRegistry()); governor != nil {
+		t.Error("expected disabled governor without slowdown threshold")
+	}
+}
+
+func TestRateLimitGovernorScopeDelay(t *testing.T) {
+	governor := newTestRateLimitGovernor()
+	now := time.Now()
+
+	testCases := []struct {
+		name     string
+		scope    rateLimitScope
+		expected time.Duration
+	}{
+		{"above threshold", rateLimitScope{remaining: 5000, updated: now}, 0},
+		{"at threshold", rateLimitScope{remaining: 1000, updated: now}, 0},
+		{"half used", rateLimitScope{remaining: 500, updated: now}, time.Second},
+		{"exhausted", rateLimitScope{remaining: 0, updated: now}, 2 * time.Second},
+		{"negative remaining", rateLimitScope{remaining: -10, updated: now}, 2 * time.Second},
+		{"stale remaining", rateLimitScope{remaining: 0, updated: now.Add(-2 * time.Minute)}, 0},
+		{"paused", rateLimitScope{remaining: 5000, updated: now, pausedUntil: now.Add(10 * time.Second)}, 10 * time.Second},
+		{"pause expired", rateLimitScope{remaining: 5000, updated: now, pausedUntil: now.Add(-time.Second)}, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if delay := governor.scopeDelay(&testCase.scope, now); delay != testCase.expected {
+				t.Errorf("expected delay %s, got %s", testCase.expected, delay)
+			}
+		})
+	}
+}
+
+func TestRateLimitGovernorUpdate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		statusCode int
+		header     http.Header
+		// expected remaining by scope (missing scopes are not tracked)
+		remaining   map[string]int64
+		pausedUntil map[string]time.Duration
+	}{
+		{
+			name:       "lowest remaining value",
+			statusCode: http.StatusOK,
+			header: http.Header{
+				"X-Ms-Ratelimit-Remaining-Subscription-Reads":        []string{"11000"},
+				"X-Ms-Ratelimit-Remaining-Subscription-Global-Reads": []string{"900"},
+				"X-Ms-Ratelimit-Remaining-Tenant-Reads":              []string{"5000"},
+			},
+			remaining: map[string]int64{RateLimitScopeSubscription: 900, RateLimitScopeTenant: 5000},
+		},
+		{
+			name:        "below pause threshold",
+			statusCode:  http.StatusOK,
+			header:      http.Header{"X-Ms-Ratelimit-Remaining-Tenant-Reads": []string{"50"}},
+			remaining:   map[string]int64{RateLimitScopeTenant: 50},
+			pausedUntil: map[string]time.Duration{RateLimitScopeTenant: 30 * time.Second},
+		},
+		{
+			name:        "throttled with retry-after",
+			statusCode:  http.StatusTooManyRequests,
+			header:      http.Header{"Retry-After": []string{"5"}},
+			remaining:   map[string]int64{RateLimitScopeSubscription: 0},
+			pausedUntil: map[string]time.Duration{RateLimitScopeSubscription: 5 * time.Second},
+		},
+		{
+			name:        "throttled without retry-after",
+			statusCode:  http.StatusTooManyRequests,
+			remaining:   map[string]int64{RateLimitScopeSubscription: 0},
+			pausedUntil: map[string]time.Duration{RateLimitScopeSubscription: 30 * time.Second},
+		},
+		{
+			name:       "without rate limit headers",
+			statusCode: http.StatusOK,
+			header:     http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Reads": []string{"invalid"}},
+			remaining:  map[string]int64{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			governor := newTestRateLimitGovernor()
+			now := time.Now()
+			governor.update("sub1", testRateLimitResponse(testCase.statusCode, "tenant1", testCase.header), now)
+
+			if governor.subscriptionTenant["sub1"] != "tenant1" {
+				t.Errorf("expected tenant of the subscription from the access token, got %q", governor.subscriptionTenant["sub1"])
+			}
+
+			if len(governor.scopes) != len(testCase.remaining) {
+				t.Errorf("expected %d tracked scopes, got %d", len(testCase.remaining), len(governor.scopes))
+			}
+
+			ids := map[string]string{RateLimitScopeSubscription: "sub1", RateLimitScopeTenant: "tenant1"}
+			for scopeName, remaining := range testCase.remaining {
+				scope := governor.scopes[rateLimitScopeKey{scope: scopeName, id: ids[scopeName]}]
+				if scope == nil {
+					t.Fatalf("expected scope %s to be tracked", scopeName)
+				}
+				if scope.remaining != remaining {
+					t.Errorf("%s: expected remaining %d, got %d", scopeName, remaining, scope.remaining)
+				}
+
+				expectedPausedUntil := time.Time{}
+				if pause, exists := testCase.pausedUntil[scopeName]; exists {
+					expectedPausedUntil = now.Add(pause)
+				}
+				if !scope.pausedUntil.Equal(expectedPausedUntil) {
+					t.Errorf("%s: expected paused until %s, got %s", scopeName, expectedPausedUntil, scope.pausedUntil)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitGovernorDelay(t *testing.T) {
+	governor := newTestRateLimitGovernor()
+	now := time.Now()
+
+	// unknown subscriptions and requests without subscription are not delayed
+	if delay, _ := governor.delay("sub1", now); delay != 0 {
+		t.Errorf("expected no delay of unknown subscription, got %s", delay)
+	}
+
+	governor.update("sub1", testRateLimitResponse(http.StatusOK, "tenant1", http.Header{
+		"X-Ms-Ratelimit-Remaining-Subscription-Reads": []string{"750"},
+		"X-Ms-Ratelimit-Remaining-Tenant-Reads":       []string{"250"},
+	}), now)
+
+	testCases := []struct {
+		name           string
+		subscriptionId string
+		now            time.Time
+		delay          time.Duration
+		scope          string
+	}{
+		{"limited by tenant", "sub1", now, 1500 * time.Millisecond, RateLimitScopeTenant},
+		{"other subscription", "sub2", now, 0, ""},
+		{"without subscription", "", now, 0, ""},
+		{"stale", "sub1", now.Add(2 * time.Minute), 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			delay, scope := governor.delay(testCase.subscriptionId, testCase.now)
+			if delay != testCase.delay || scope != testCase.scope {
+				t.Errorf("expected delay %s (%q), got %s (%q)", testCase.delay, testCase.scope, delay, scope)
+			}
+		})
+	}
+
+	// a pause of the subscription outweighs the slowdown of the tenant
+	governor.update("sub1", testRateLimitResponse(http.StatusTooManyRequests, "tenant1", http.Header{"Retry-After": []string{"10"}}), now)
+	if delay, scope := governor.delay("sub1", now); delay != 10*time.Second || scope != RateLimitScopeSubscription {
+		t.Errorf("expected paused subscription, got %s (%q)", delay, scope)
+	}
+}
@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	RequestLimiterScopeGlobal = "global"
+)
+
+var (
+	ErrRequestLimiterMaxWait = errors.New("azure request limiter max wait exceeded")
+)
+
+type (
+	// RequestLimiter limits the concurrent Azure requests of the process (shared by all probes and jobs),
+	// optionally also per subscription and per tenant
+	RequestLimiter struct {
+		lock sync.Mutex
+		conf RequestLimiterConfig
+
+		global       chan struct{}
+		subscription map[string]chan struct{}
+		tenant       map[string]chan struct{}
+
+		// tenant of each subscription (learned from the access token of responses)
+		subscriptionTenant map[string]string
+
+		prometheus struct {
+			wait     *prometheus.HistogramVec
+			inflight *prometheus.GaugeVec
+			rejected *prometheus.CounterVec
+		}
+	}
+
+	RequestLimiterConfig struct {
+		// concurrent requests of the process (0 = unlimited)
+		Global int
+
+		// concurrent requests per subscription (0 = unlimited)
+		Subscription int
+
+		// concurrent requests per tenant (0 = unlimited)
+		Tenant int
+
+		// maximum wait for a free slot (0 = wait until the request context is done)
+		MaxWait time.Duration
+	}
+
+	requestLimiterPolicy struct {
+		limiter *RequestLimiter
+	}
+
+	requestLimiterSlot struct {
+		scope string
+		sem   chan struct{}
+	}
+
+	// requestLimiterError is returned if no slot was free within max wait, it must not be retried
+	// (neither by the azure sdk nor by the RetryPolicy) as the waiting request would only queue again
+	requestLimiterError struct {
+		scope   string
+		maxWait time.Duration
+	}
+)
+
+func NewRequestLimiterConfig(conf config.Opts) RequestLimiterConfig {
+	return RequestLimiterConfig{
+		Global:       conf.Azure.Limit.Global,
+		Subscription: conf.Azure.Limit.Subscription,
+		Tenant:       conf.Azure.Limit.Tenant,
+		MaxWait:      conf.Azure.Limit.MaxWait,
+	}
+}
+
+// NewRequestLimiter creates the limiter and registers its metrics, returns nil if no limit is set
+func NewRequestLimiter(conf RequestLimiterConfig, registerer prometheus.Registerer) *RequestLimiter {
+	if conf.Global <= 0 && conf.Subscription <= 0 && conf.Tenant <= 0 {
+		return nil
+	}
+
+	l := &RequestLimiter{
+		conf:               conf,
+		subscription:       map[string]chan struct{}{},
+		tenant:             map[string]chan struct{}{},
+		subscriptionTenant: map[string]string{},
+	}
+
+	if conf.Global > 0 {
+		l.global = make(chan struct{}, conf.Global)
+	}
+
+	l.prometheus.wait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "azurerm_api_limiter_wait_seconds",
+			Help:    "Azure request limiter queue time by scope",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"scope"},
+	)
+	registerer.MustRegister(l.prometheus.wait)
+
+	l.prometheus.inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurerm_api_limiter_inflight",
+			Help: "Azure request limiter requests in flight by scope",
+		},
+		[]string{"scope"},
+	)
+	registerer.MustRegister(l.prometheus.inflight)
+
+	l.prometheus.rejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_api_limiter_rejected_total",
+			Help: "Azure requests rejected by the request limiter (max wait exceeded) by scope",
+		},
+		[]string{"scope"},
+	)
+	registerer.MustRegister(l.prometheus.rejected)
+
+	return l
+}
+
+// Policy returns the azure sdk policy for the limiter (per retry, slots are only held while a request is sent)
+func (l *RequestLimiter) Policy() policy.Policy {
+	return requestLimiterPolicy{limiter: l}
+}
+
+func (p requestLimiterPolicy) Do(req *policy.Request) (*http.Response, error) {
+	subscriptionId := ""
+	if matches := rateLimitSubscriptionRegexp.FindStringSubmatch(req.Raw().URL.Path); len(matches) >= 2 {
+		subscriptionId = strings.ToLower(matches[1])
+	}
+
+	slots, err := p.limiter.acquire(req, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := req.Next()
+	p.limiter.release(slots)
+
+	if res != nil && subscriptionId != "" {
+		if tenantId := rateLimitTenantFromResponse(res); tenantId != "" {
+			p.limiter.lock.Lock()
+			p.limiter.subscriptionTenant[subscriptionId] = tenantId
+			p.limiter.lock.Unlock()
+		}
+	}
+
+	return res, err
+}
+
+// slots returns the semaphores for a request of the subscription, always in the same order
+// (subscription, tenant, global) to avoid deadlocks between requests
+func (l *RequestLimiter) slots(subscriptionId string) []requestLimiterSlot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ret := []requestLimiterSlot{}
+	if subscriptionId != "" {
+		if l.conf.Subscription > 0 {
+			if _, exists := l.subscription[subscriptionId]; !exists {
+				l.subscription[subscriptionId] = make(chan struct{}, l.conf.Subscription)
+			}
+			ret = append(ret, requestLimiterSlot{scope: RateLimitScopeSubscription, sem: l.subscription[subscriptionId]})
+		}
+
+		if tenantId, exists := l.subscriptionTenant[subscriptionId]; exists && l.conf.Tenant > 0 {
+			if _, exists := l.tenant[tenantId]; !exists {
+				l.tenant[tenantId] = make(chan struct{}, l.conf.Tenant)
+			}
+			ret = append(ret, requestLimiterSlot{scope: RateLimitScopeTenant, sem: l.tenant[tenantId]})
+		}
+	}
+
+	if l.global != nil {
+		ret = append(ret, requestLimiterSlot{scope: RequestLimiterScopeGlobal, sem: l.global})
+	}
+
+	return ret
+}
+
+// acquire waits for a free slot in all scopes of the request
+func (l *RequestLimiter) acquire(req *policy.Request, subscriptionId string) ([]requestLimiterSlot, error) {
+	ctx := req.Raw().Context()
+
+	var maxWait <-chan time.Time
+	if l.conf.MaxWait > 0 {
+		timer := time.NewTimer(l.conf.MaxWait)
+		defer timer.Stop()
+		maxWait = timer.C
+	}
+
+	slots := l.slots(subscriptionId)
+	for i, slot := range slots {
+		startTime := time.Now()
+		select {
+		case slot.sem <- struct{}{}:
+			l.prometheus.wait.WithLabelValues(slot.scope).Observe(time.Since(startTime).Seconds())
+			l.prometheus.inflight.WithLabelValues(slot.scope).Inc()
+		case <-maxWait:
+			l.release(slots[:i])
+			l.prometheus.rejected.WithLabelValues(slot.scope).Inc()
+			return nil, &requestLimiterError{scope: slot.scope, maxWait: l.conf.MaxWait}
+		case <-ctx.Done():
+			l.release(slots[:i])
+			return nil, ctx.Err()
+		}
+	}
+
+	return slots, nil
+}
+
+func (l *RequestLimiter) release(slots []requestLimiterSlot) {
+	for _, slot := range slots {
+		<-slot.sem
+		l.prometheus.inflight.WithLabelValues(slot.scope).Dec()
+	}
+}
+
+func (e *requestLimiterError) Error() string {
+	return fmt.Sprintf("%s (scope %s, %s)", ErrRequestLimiterMaxWait.Error(), e.scope, e.maxWait.String())
+}
+
+func (e *requestLimiterError) Unwrap() error {
+	return ErrRequestLimiterMaxWait
+}
+
+// NonRetriable marks the error as non retriable for the azure sdk
+func (e *requestLimiterError) NonRetriable() {}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestLimiterRequest(t *testing.T, ctx context.Context) *policy.Request {
+	t.Helper()
+	req, err := runtime.NewRequest(ctx, http.MethodGet, "https://management.azure.com/subscriptions/sub1/resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestNewRequestLimiterDisabled(t *testing.T) {
+	if limiter := NewRequestLimiter(RequestLimiterConfig{MaxWait: time.Second}, prometheus.NewRegistry()); limiter != nil {
+		t.Error("expected disabled limiter without limits")
+	}
+}
+
+func TestRequestLimiterSlotOrder(t *testing.T) {
+	limiter := NewRequestLimiter(RequestLimiterConfig{Global: 2, Subscription: 2, Tenant: 2}, prometheus.NewRegistry())
+	limiter.subscriptionTenant["sub1"] = "tenant1"
+
+	testCases := []struct {
+		subscriptionId string
+		expected       []string
+	}{
+		{"sub1", []string{RateLimitScopeSubscription, RateLimitScopeTenant, RequestLimiterScopeGlobal}},
+		// tenant of the subscription is not known yet
+		{"sub2", []string{RateLimitScopeSubscription, RequestLimiterScopeGlobal}},
+		{"", []string{RequestLimiterScopeGlobal}},
+	}
+
+	for _, testCase := range testCases {
+		scopes := []string{}
+		for _, slot := range limiter.slots(testCase.subscriptionId) {
+			scopes = append(scopes, slot.scope)
+		}
+		if !slices.Equal(scopes, testCase.expected) {
+			t.Errorf("%q: expected slots %v, got %v", testCase.subscriptionId, testCase.expected, scopes)
+		}
+	}
+
+	// subscriptions of the same tenant share the tenant slot
+	limiter.subscriptionTenant["sub2"] = "tenant1"
+	if limiter.slots("sub1")[1].sem != limiter.slots("sub2")[1].sem {
+		t.Error("expected shared tenant slot")
+	}
+}
+
+func TestRequestLimiterMaxWait(t *testing.T) {
+	limiter := NewRequestLimiter(RequestLimiterConfig{Global: 1, MaxWait: 20 * time.Millisecond}, prometheus.NewRegistry())
+	req := newTestLimiterRequest(t, context.Background())
+
+	slots, err := limiter.acquire(req, "sub1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = limiter.acquire(req, "sub1")
+	var limiterErr *requestLimiterError
+	if !errors.Is(err, ErrRequestLimiterMaxWait) || !errors.As(err, &limiterErr) || limiterErr.scope != RequestLimiterScopeGlobal {
+		t.Fatalf("expected max wait error of the global scope, got %v", err)
+	}
+	if rejected := testutil.ToFloat64(limiter.prometheus.rejected.WithLabelValues(RequestLimiterScopeGlobal)); rejected != 1 {
+		t.Errorf("expected one rejected request, got %v", rejected)
+	}
+
+	limiter.release(slots)
+	slots, err = limiter.acquire(req, "sub1")
+	if err != nil {
+		t.Fatalf("expected free slot after release, got %v", err)
+	}
+	limiter.release(slots)
+}
+
+func TestRequestLimiterCancelReleasesAcquiredSlots(t *testing.T) {
+	limiter := NewRequestLimiter(RequestLimiterConfig{Global: 1, Subscription: 1}, prometheus.NewRegistry())
+
+	// request of another subscription holds the global slot
+	heldSlots, err := limiter.acquire(newTestLimiterRequest(t, context.Background()), "sub2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// the subscription slot is acquired, the request waits for the global slot until the context is done
+	if _, err := limiter.acquire(newTestLimiterRequest(t, ctx), "sub1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	if used := len(limiter.subscription["sub1"]); used != 0 {
+		t.Errorf("expected released subscription slot, got %d used", used)
+	}
+	if used := len(limiter.global); used != 1 {
+		t.Errorf("expected global slot of the other request to be kept, got %d used", used)
+	}
+	if inflight := testutil.ToFloat64(limiter.prometheus.inflight.WithLabelValues(RateLimitScopeSubscription)); inflight != 1 {
+		t.Errorf("expected one subscription request in flight, got %v", inflight)
+	}
+
+	limiter.release(heldSlots)
+	if len(limiter.global) != 0 || len(limiter.subscription["sub2"]) != 0 {
+		t.Error("expected all slots to be free")
+	}
+}
@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	RetryReasonThrottled   = "throttled"
+	RetryReasonServerError = "servererror"
+	RetryReasonTimeout     = "timeout"
+	RetryReasonNetwork     = "network"
+
+	RetryGiveUpAttempts = "attempts"
+	RetryGiveUpDeadline = "deadline"
+)
+
+type (
+	// RetryPolicy retries failed metric queries with exponential backoff and jitter (honoring Retry-After),
+	// replaces the retry policy of the azure sdk (process wide, shared by all probes)
+	RetryPolicy struct {
+		conf RetryPolicyConfig
+
+		prometheus struct {
+			retries *prometheus.CounterVec
+			giveUp  *prometheus.CounterVec
+		}
+	}
+
+	RetryPolicyConfig struct {
+		// attempts per request including the first one (1 disables retries)
+		MaxAttempts int
+
+		// backoff of the first retry (doubled for each further retry)
+		Delay time.Duration
+
+		// maximum backoff (not applied to Retry-After)
+		MaxDelay time.Duration
+	}
+
+	retryPolicy struct {
+		retry *RetryPolicy
+	}
+
+	// errors of the azure sdk which must not be retried (eg. authentication failures)
+	nonRetriableError interface {
+		NonRetriable()
+	}
+)
+
+func NewRetryPolicyConfig(conf config.Opts) RetryPolicyConfig {
+	return RetryPolicyConfig{
+		MaxAttempts: conf.Azure.Retry.MaxAttempts,
+		Delay:       conf.Azure.Retry.Delay,
+		MaxDelay:    conf.Azure.Retry.MaxDelay,
+	}
+}
+
+// NewRetryPolicy creates the retry policy and registers its metrics
+func NewRetryPolicy(conf RetryPolicyConfig, registerer prometheus.Registerer) *RetryPolicy {
+	r := &RetryPolicy{
+		conf: conf,
+	}
+
+	r.prometheus.retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_api_retries_total",
+			Help: "Azure metric query retries by reason",
+		},
+		[]string{"reason"},
+	)
+	registerer.MustRegister(r.prometheus.retries)
+
+	r.prometheus.giveUp = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_api_retries_exhausted_total",
+			Help: "Azure metric queries failed without further retry by reason and cause (attempts, deadline)",
+		},
+		[]string{"reason", "cause"},
+	)
+	registerer.MustRegister(r.prometheus.giveUp)
+
+	return r
+}
+
+// Apply replaces the retry policy of the azure sdk, the policy is added in front of all other per call
+// policies so every attempt passes the rate limit governor
+func (r *RetryPolicy) Apply(clientOpts *policy.ClientOptions) {
+	clientOpts.PerCallPolicies = append([]policy.Policy{retryPolicy{retry: r}}, clientOpts.PerCallPolicies...)
+	clientOpts.Retry.MaxRetries = -1
+}
+
+func (p retryPolicy) Do(req *policy.Request) (*http.Response, error) {
+	ctx := req.Raw().Context()
+
+	for attempt := 1; ; attempt++ {
+		if err := req.RewindBody(); err != nil {
+			return nil, err
+		}
+
+		res, err := req.Clone(ctx).Next()
+
+		reason := retryReason(ctx, res, err)
+		if reason == "" {
+			return res, err
+		}
+
+		if attempt >= p.retry.conf.MaxAttempts {
+			p.retry.prometheus.giveUp.WithLabelValues(reason, RetryGiveUpAttempts).Inc()
+			return res, err
+		}
+
+		delay := p.retry.backoff(attempt)
+		if retryAfter := retryAfterDuration(res, time.Now()); retryAfter > 0 {
+			delay = retryAfter
+		}
+
+		// never wait beyond the deadline of the probe, the last result is returned instead
+		if deadline, exists := ctx.Deadline(); exists && time.Now().Add(delay).After(deadline) {
+			p.retry.prometheus.giveUp.WithLabelValues(reason, RetryGiveUpDeadline).Inc()
+			return res, err
+		}
+
+		if res != nil {
+			runtime.Drain(res)
+		}
+
+		p.retry.prometheus.retries.WithLabelValues(reason).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns the exponential backoff of the attempt with jitter (between half and full backoff)
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := r.conf.Delay
+	for i := 1; i < attempt && delay < r.conf.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if r.conf.MaxDelay > 0 && delay > r.conf.MaxDelay {
+		delay = r.conf.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) // #nosec G404
+}
+
+// retryReason returns the reason for a retry of the result, empty if the result must not be retried
+func retryReason(ctx context.Context, res *http.Response, err error) string {
+	if err != nil {
+		var nonRetriable nonRetriableError
+		switch {
+		case ctx.Err() != nil:
+			// probe is gone or timed out
+			return ""
+		case errors.As(err, &nonRetriable):
+			return ""
+		case errors.Is(err, context.DeadlineExceeded):
+			return RetryReasonTimeout
+		default:
+			return RetryReasonNetwork
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return RetryReasonThrottled
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return RetryReasonTimeout
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return RetryReasonServerError
+	}
+
+	return ""
+}
+
+// retryAfterDuration returns the delay requested by the response (retry-after-ms, x-ms-retry-after-ms or Retry-After)
+func retryAfterDuration(res *http.Response, now time.Time) time.Duration {
+	if res == nil {
+		return 0
+	}
+
+	for _, headerName := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if v, err := strconv.ParseInt(res.Header.Get(headerName), 10, 64); err == nil && v > 0 {
+			return time.Duration(v) * time.Millisecond
+		}
+	}
+
+	if v := res.Header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+
+		if date, err := http.ParseTime(v); err == nil && date.After(now) {
+			return date.Sub(now)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retryTestTransport returns the responses in order (the last one is repeated) and counts the requests
+type retryTestTransport struct {
+	requests  atomic.Int32
+	responses []func(req *http.Request) (*http.Response, error)
+}
+
+func (t *retryTestTransport) Do(req *http.Request) (*http.Response, error) {
+	i := int(t.requests.Add(1)) - 1
+	if i >= len(t.responses) {
+		i = len(t.responses) - 1
+	}
+	return t.responses[i](req)
+}
+
+func retryTestResponse(statusCode int, header http.Header) func(req *http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{StatusCode: statusCode, Header: header, Body: http.NoBody, Request: req}, nil
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retry := NewRetryPolicy(RetryPolicyConfig{MaxAttempts: 5, Delay: time.Second, MaxDelay: 5 * time.Second}, prometheus.NewRegistry())
+
+	testCases := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 2500 * time.Millisecond, 5 * time.Second},
+		{20, 2500 * time.Millisecond, 5 * time.Second},
+	}
+
+	for _, testCase := range testCases {
+		// jitter is random, all delays must be between half and full backoff
+		for i := 0; i < 100; i++ {
+			if delay := retry.backoff(testCase.attempt); delay < testCase.min || delay > testCase.max {
+				t.Fatalf("attempt %d: expected delay between %s and %s, got %s", testCase.attempt, testCase.min, testCase.max, delay)
+			}
+		}
+	}
+
+	retry = NewRetryPolicy(RetryPolicyConfig{MaxAttempts: 5}, prometheus.NewRegistry())
+	if delay := retry.backoff(3); delay != 0 {
+		t.Errorf("expected no backoff without delay, got %s", delay)
+	}
+}
+
+func TestRetryAfterDuration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{"without header", http.Header{}, 0},
+		{"retry-after-ms", http.Header{"Retry-After-Ms": []string{"1500"}}, 1500 * time.Millisecond},
+		{"x-ms-retry-after-ms", http.Header{"X-Ms-Retry-After-Ms": []string{"250"}}, 250 * time.Millisecond},
+		{"milliseconds before seconds", http.Header{"Retry-After-Ms": []string{"100"}, "Retry-After": []string{"10"}}, 100 * time.Millisecond},
+		{"seconds", http.Header{"Retry-After": []string{"5"}}, 5 * time.Second},
+		{"zero seconds", http.Header{"Retry-After": []string{"0"}}, 0},
+		{"http date", http.Header{"Retry-After": []string{now.Add(30 * time.Second).Format(http.TimeFormat)}}, 30 * time.Second},
+		{"http date in the past", http.Header{"Retry-After": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}}, 0},
+		{"invalid", http.Header{"Retry-After": []string{"soon"}}, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: http.StatusTooManyRequests, Header: testCase.header}
+			if delay := retryAfterDuration(res, now); delay != testCase.expected {
+				t.Errorf("expected %s, got %s", testCase.expected, delay)
+			}
+		})
+	}
+
+	if delay := retryAfterDuration(nil, now); delay != 0 {
+		t.Errorf("expected no delay without response, got %s", delay)
+	}
+}
+
+func TestRetryReason(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		name       string
+		ctx        context.Context
+		statusCode int
+		err        error
+		expected   string
+	}{
+		{"success", context.Background(), http.StatusOK, nil, ""},
+		{"not found", context.Background(), http.StatusNotFound, nil, ""},
+		{"throttled", context.Background(), http.StatusTooManyRequests, nil, RetryReasonThrottled},
+		{"request timeout", context.Background(), http.StatusRequestTimeout, nil, RetryReasonTimeout},
+		{"gateway timeout", context.Background(), http.StatusGatewayTimeout, nil, RetryReasonTimeout},
+		{"internal server error", context.Background(), http.StatusInternalServerError, nil, RetryReasonServerError},
+		{"bad gateway", context.Background(), http.StatusBadGateway, nil, RetryReasonServerError},
+		{"service unavailable", context.Background(), http.StatusServiceUnavailable, nil, RetryReasonServerError},
+		{"network error", context.Background(), 0, errors.New("connection reset"), RetryReasonNetwork},
+		{"request deadline", context.Background(), 0, fmt.Errorf("dial: %w", context.DeadlineExceeded), RetryReasonTimeout},
+		{"probe canceled", canceledCtx, 0, context.Canceled, ""},
+		{"request limiter", context.Background(), 0, &requestLimiterError{scope: RequestLimiterScopeGlobal, maxWait: time.Second}, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var res *http.Response
+			if testCase.err == nil {
+				res = &http.Response{StatusCode: testCase.statusCode, Header: http.Header{}}
+			}
+
+			if reason := retryReason(testCase.ctx, res, testCase.err); reason != testCase.expected {
+				t.Errorf("expected reason %q, got %q", testCase.expected, reason)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	limiterErr := func(req *http.Request) (*http.Response, error) {
+		return nil, &requestLimiterError{scope: RequestLimiterScopeGlobal, maxWait: time.Second}
+	}
+
+	testCases := []struct {
+		name       string
+		timeout    time.Duration
+		responses  []func(req *http.Request) (*http.Response, error)
+		requests   int32
+		statusCode int
+		err        error
+	}{
+		{
+			name:       "retried until success",
+			responses:  []func(req *http.Request) (*http.Response, error){retryTestResponse(http.StatusServiceUnavailable, nil), retryTestResponse(http.StatusOK, nil)},
+			requests:   2,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "max attempts",
+			responses:  []func(req *http.Request) (*http.Response, error){retryTestResponse(http.StatusInternalServerError, nil)},
+			requests:   3,
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "retry-after beyond deadline",
+			timeout:    time.Second,
+			responses:  []func(req *http.Request) (*http.Response, error){retryTestResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"10"}})},
+			requests:   1,
+			statusCode: http.StatusTooManyRequests,
+		},
+		{
+			name:      "request limiter",
+			responses: []func(req *http.Request) (*http.Response, error){limiterErr},
+			requests:  1,
+			err:       ErrRequestLimiterMaxWait,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			transport := &retryTestTransport{responses: testCase.responses}
+			clientOpts := policy.ClientOptions{Transport: transport}
+			NewRetryPolicy(RetryPolicyConfig{MaxAttempts: 3, Delay: time.Millisecond, MaxDelay: 10 * time.Millisecond}, prometheus.NewRegistry()).Apply(&clientOpts)
+			pipeline := runtime.NewPipeline("test", "v0.0.0", runtime.PipelineOptions{}, &clientOpts)
+
+			ctx := context.Background()
+			if testCase.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, testCase.timeout)
+				defer cancel()
+			}
+
+			req, err := runtime.NewRequest(ctx, http.MethodGet, "https://management.azure.com/subscriptions/sub1/resources")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			startTime := time.Now()
+			res, err := pipeline.Do(req)
+			if testCase.timeout > 0 && time.Since(startTime) >= testCase.timeout {
+				t.Error("expected no wait beyond the deadline")
+			}
+
+			if requests := transport.requests.Load(); requests != testCase.requests {
+				t.Errorf("expected %d requests, got %d", testCase.requests, requests)
+			}
+
+			if testCase.err != nil {
+				if !errors.Is(err, testCase.err) {
+					t.Errorf("expected error %v, got %v", testCase.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != testCase.statusCode {
+				t.Errorf("expected status code %d, got %d", testCase.statusCode, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	fileCacheBucket = []byte("cache")
+)
+
+type (
+	// FileCache stores the cache in a bbolt database file (survives restarts, not shared between replicas),
+	// entries are stored with the expiry (unix nano, 8 bytes) in front of the value
+	FileCache struct {
+		db *bolt.DB
+
+		evictionLock    sync.Mutex
+		evictionHandler func(key, reason string)
+	}
+)
+
+func NewFileCache(path string) (*FileCache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(fileCacheBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	c := &FileCache{db: db}
+	go c.cleanup(1 * time.Minute)
+	return c, nil
+}
+
+func (c *FileCache) Get(key string) ([]byte, bool, error) {
+	var ret []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if entry := tx.Bucket(fileCacheBucket).Get([]byte(key)); entry != nil {
+			if value, valid := fileCacheDecodeEntry(entry, time.Now()); valid {
+				// bbolt values are only valid inside the transaction
+				ret = append([]byte{}, value...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return ret, ret != nil, nil
+}
+
+func (c *FileCache) Set(key string, value []byte, ttl time.Duration) error {
+	entry := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(time.Now().Add(ttl).UnixNano()))
+	copy(entry[8:], value)
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileCacheBucket).Put([]byte(key), entry)
+	})
+}
+
+func (c *FileCache) Delete(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileCacheBucket).Delete([]byte(key))
+	})
+}
+
+func (c *FileCache) Entries(prefix string) ([]CacheEntry, error) {
+	ret := []CacheEntry{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		cursor := tx.Bucket(fileCacheBucket).Cursor()
+		for key, entry := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, entry = cursor.Next() {
+			value, valid := fileCacheDecodeEntry(entry, now)
+			if !valid {
+				continue
+			}
+
+			ret = append(ret, CacheEntry{
+				Key:       string(key),
+				Prefix:    CacheKeyPrefix(string(key)),
+				ExpiresAt: time.Unix(0, int64(binary.BigEndian.Uint64(entry[:8]))),
+				Size:      len(value),
+			})
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (c *FileCache) Close() error {
+	return c.db.Close()
+}
+
+// cleanup removes expired entries periodically
+func (c *FileCache) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		evicted := []string{}
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			now := time.Now()
+			cursor := tx.Bucket(fileCacheBucket).Cursor()
+			for key, entry := cursor.First(); key != nil; key, entry = cursor.Next() {
+				if _, valid := fileCacheDecodeEntry(entry, now); !valid {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+					evicted = append(evicted, string(key))
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+			return
+		}
+
+		c.evictionLock.Lock()
+		handler := c.evictionHandler
+		c.evictionLock.Unlock()
+
+		if handler != nil && err == nil {
+			for _, key := range evicted {
+				handler(key, CacheEvictionExpired)
+			}
+		}
+	}
+}
+
+func (c *FileCache) onEvicted(handler func(key, reason string)) {
+	c.evictionLock.Lock()
+	defer c.evictionLock.Unlock()
+	c.evictionHandler = handler
+}
+
+func fileCacheDecodeEntry(entry []byte, now time.Time) ([]byte, bool) {
+	if len(entry) < 8 {
+		return nil, false
+	}
+
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(entry[:8])))
+	if now.After(expiry) {
+		return nil, false
+	}
+
+	return entry[8:], true
+}
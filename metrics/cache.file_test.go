@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestFileCache(t *testing.T, path string) *FileCache {
+	t.Helper()
+	cache, err := NewFileCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache := newTestFileCache(t, path)
+
+	if _, found, err := cache.Get("list:a"); err != nil || found {
+		t.Fatalf("expected missing key, got found %v (%v)", found, err)
+	}
+
+	values := map[string]string{
+		"list:a":             `{"list":{}}`,
+		"list:b":             `{"list":{"metric":[]}}`,
+		"servicediscovery:a": `[]`,
+	}
+	for key, value := range values {
+		if err := cache.Set(key, []byte(value), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, expected := range values {
+		if value, found, err := cache.Get(key); err != nil || !found || string(value) != expected {
+			t.Errorf("%s: expected %q, got %q (found %v, %v)", key, expected, value, found, err)
+		}
+	}
+
+	entries, err := cache.Entries("list:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+		if entry.Prefix != "list" || entry.Size != len(values[entry.Key]) || time.Until(entry.ExpiresAt) <= 0 {
+			t.Errorf("%s: unexpected entry %+v", entry.Key, entry)
+		}
+	}
+	if !slices.Equal(keys, []string{"list:a", "list:b"}) {
+		t.Errorf("expected entries of prefix list, got %v", keys)
+	}
+
+	if err := cache.Delete("list:a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Delete("list:missing"); err != nil {
+		t.Errorf("expected missing keys to be ignored, got %v", err)
+	}
+
+	// entries survive restarts
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cache = newTestFileCache(t, path)
+	defer cache.Close() // nolint:errcheck
+
+	if _, found, _ := cache.Get("list:a"); found {
+		t.Error("expected deleted entry not to be found after reopening")
+	}
+	if value, found, _ := cache.Get("list:b"); !found || string(value) != values["list:b"] {
+		t.Errorf("expected entry to be kept after reopening, got %q (found %v)", value, found)
+	}
+}
+
+func TestFileCacheExpiresEntries(t *testing.T) {
+	cache := newTestFileCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	evictions := newCacheEvictionRecorder(cache)
+
+	if err := cache.Set("list:expired", []byte("a"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:fresh", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, found, _ := cache.Get("list:expired"); found {
+		t.Error("expected expired entry not to be found")
+	}
+	if entries, _ := cache.Entries(""); len(entries) != 1 || entries[0].Key != "list:fresh" {
+		t.Errorf("expected only list:fresh, got %v", entries)
+	}
+
+	// stops after the database is closed
+	go cache.cleanup(5 * time.Millisecond)
+	defer cache.Close() // nolint:errcheck
+
+	deadline := time.Now().Add(time.Second)
+	for len(evictions.keys(CacheEvictionExpired)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if evicted := evictions.keys(CacheEvictionExpired); !slices.Equal(evicted, []string{"list:expired"}) {
+		t.Errorf("expected expiry of list:expired, got %v", evicted)
+	}
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	CacheBackendMemory = "memory"
+	CacheBackendFile   = "file"
+	CacheBackendRedis  = "redis"
+
+	// CacheModeFresh serves only fresh cache entries
+	CacheModeFresh = "fresh"
+	// CacheModeStaleIfError serves the last good cache entry if the probe failed (up to max stale)
+	CacheModeStaleIfError = "stale-if-error"
+	// CacheModeStaleWhileRevalidate serves expired cache entries (up to max stale) while refreshing in background,
+	// the last good cache entry is also served if the probe failed
+	CacheModeStaleWhileRevalidate = "stale-while-revalidate"
+)
+
+var (
+	// ErrCacheEntryTooLarge is returned by Set if the entry exceeds the limits of the cache on its own
+	ErrCacheEntryTooLarge = errors.New("cache entry exceeds the cache limits")
+)
+
+type (
+	// Cache is the storage of the metrics and servicediscovery cache, values are serialized
+	// so the cache can be persisted or shared between multiple replicas
+	Cache interface {
+		// Get returns the value of the key, found is false for missing or expired keys
+		Get(key string) (value []byte, found bool, err error)
+
+		// Set stores the value of the key for the duration of ttl
+		Set(key string, value []byte, ttl time.Duration) error
+
+		// Delete removes the key (missing keys are ignored)
+		Delete(key string) error
+
+		// Entries returns all entries (not expired) with keys starting with prefix
+		Entries(prefix string) ([]CacheEntry, error)
+
+		Close() error
+	}
+
+	// CacheEntry describes a stored cache entry (without value)
+	CacheEntry struct {
+		Key       string    `json:"key"`
+		Prefix    string    `json:"prefix"`
+		ExpiresAt time.Time `json:"expiresAt,omitempty"`
+		Size      int       `json:"size"`
+	}
+
+	// cacheSeriesSetter is implemented by backends limited by series (memory), the series of the value
+	// are passed by the caller which knows them (eg. the rows of a metric list)
+	cacheSeriesSetter interface {
+		setWithSeries(key string, value []byte, ttl time.Duration, series int64) error
+	}
+
+	// cacheEvictionNotifier is implemented by backends which remove expired entries themselves
+	// (redis expires entries on the server without notification)
+	cacheEvictionNotifier interface {
+		onEvicted(handler func(key, reason string))
+	}
+)
+
+// NewCache creates the cache backend configured by --cache.backend
+func NewCache(logger *zap.SugaredLogger, conf config.Opts) (Cache, error) {
+	switch conf.Cache.Backend {
+	case CacheBackendMemory, "":
+		return NewMemoryCache(MemoryCacheConfig{
+			MaxBytes:  conf.Cache.Memory.MaxBytes,
+			MaxSeries: conf.Cache.Memory.MaxSeries,
+		}), nil
+	case CacheBackendFile:
+		logger.Infof("using file cache %s", conf.Cache.Path)
+		return NewFileCache(conf.Cache.Path)
+	case CacheBackendRedis:
+		logger.Infof("using redis cache %s (db %d)", conf.Cache.Redis.Addr, conf.Cache.Redis.DB)
+		return NewRedisCache(conf.Cache.Redis.Addr, conf.Cache.Redis.Password, conf.Cache.Redis.DB, conf.Cache.Redis.Prefix)
+	default:
+		return nil, fmt.Errorf("unknown cache backend \"%s\"", conf.Cache.Backend)
+	}
+}
+
+// setCacheWithSeries stores the value with its number of series, backends without series limit ignore them
+func setCacheWithSeries(cache Cache, key string, value []byte, ttl time.Duration, series int64) error {
+	if setter, ok := cache.(cacheSeriesSetter); ok {
+		return setter.setWithSeries(key, value, ttl, series)
+	}
+	return cache.Set(key, value, ttl)
+}
+
+// CacheKeyPrefix returns the prefix of the cache key (eg. list, resource, scrape or servicediscovery)
+func CacheKeyPrefix(key string) string {
+	if prefix, _, found := strings.Cut(key, ":"); found {
+		return prefix
+	}
+	return "none"
+}
+
+func validateCacheMode(mode string) error {
+	switch mode {
+	case CacheModeFresh, CacheModeStaleIfError, CacheModeStaleWhileRevalidate:
+		return nil
+	default:
+		return fmt.Errorf("invalid cache mode \"%s\"", mode)
+	}
+}
@@ -0,0 +1,267 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	CacheEvictionExpired = "expired"
+	CacheEvictionPurged  = "purged"
+	CacheEvictionMemory  = "memory"
+)
+
+type (
+	// InstrumentedCache publishes hit, miss, eviction and size metrics of the cache by key prefix
+	// (list, resource, scrape, servicediscovery, ...) and provides the purge functions of the admin api
+	InstrumentedCache struct {
+		Cache
+
+		// size and expiry of the entries by key, tracked on writes so scrapes don't enumerate the backend
+		tracked struct {
+			lock    sync.Mutex
+			entries map[string]instrumentedCacheEntry
+		}
+
+		prometheus struct {
+			hits      *prometheus.CounterVec
+			misses    *prometheus.CounterVec
+			evictions *prometheus.CounterVec
+			entries   *prometheus.Desc
+			size      *prometheus.Desc
+		}
+	}
+
+	// CachePurgeFilter selects the cache entries to purge, all set fields must match
+	CachePurgeFilter struct {
+		Key            string
+		Prefix         string
+		SubscriptionId string
+	}
+
+	instrumentedCacheSizeCollector struct {
+		cache *InstrumentedCache
+	}
+
+	instrumentedCacheEntry struct {
+		size      int
+		expiresAt time.Time
+	}
+)
+
+// NewInstrumentedCache wraps the cache backend and registers its metrics, existing entries
+// (eg. of a file or redis cache) are enumerated once, afterwards entries are tracked on writes
+func NewInstrumentedCache(logger *zap.SugaredLogger, cache Cache, registerer prometheus.Registerer) *InstrumentedCache {
+	c := &InstrumentedCache{Cache: cache}
+	c.tracked.entries = map[string]instrumentedCacheEntry{}
+
+	if entries, err := cache.Entries(""); err == nil {
+		for _, entry := range entries {
+			c.track(entry.Key, entry.Size, entry.ExpiresAt)
+		}
+	} else {
+		logger.Warnf("unable to fetch existing cache entries, cache size metrics only contain new entries: %v", err)
+	}
+
+	c.prometheus.hits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_cache_hits_total",
+			Help: "Azure metrics exporter cache hits by key prefix",
+		},
+		[]string{"prefix"},
+	)
+	registerer.MustRegister(c.prometheus.hits)
+
+	c.prometheus.misses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_cache_misses_total",
+			Help: "Azure metrics exporter cache misses by key prefix",
+		},
+		[]string{"prefix"},
+	)
+	registerer.MustRegister(c.prometheus.misses)
+
+	c.prometheus.evictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_cache_evictions_total",
+			Help: "Azure metrics exporter cache evictions by key prefix and reason",
+		},
+		[]string{"prefix", "reason"},
+	)
+	registerer.MustRegister(c.prometheus.evictions)
+
+	c.prometheus.entries = prometheus.NewDesc(
+		"azurerm_cache_entries",
+		"Azure metrics exporter cache entries by key prefix",
+		[]string{"prefix"},
+		nil,
+	)
+	c.prometheus.size = prometheus.NewDesc(
+		"azurerm_cache_size_bytes",
+		"Azure metrics exporter cache size of values by key prefix",
+		[]string{"prefix"},
+		nil,
+	)
+	registerer.MustRegister(instrumentedCacheSizeCollector{cache: c})
+
+	if notifier, ok := cache.(cacheEvictionNotifier); ok {
+		notifier.onEvicted(func(key, reason string) {
+			c.untrack(key)
+			c.prometheus.evictions.WithLabelValues(CacheKeyPrefix(key), reason).Inc()
+		})
+	}
+
+	return c
+}
+
+func (c *InstrumentedCache) Get(key string) ([]byte, bool, error) {
+	value, found, err := c.Cache.Get(key)
+	if err == nil {
+		if found {
+			c.prometheus.hits.WithLabelValues(CacheKeyPrefix(key)).Inc()
+		} else {
+			c.prometheus.misses.WithLabelValues(CacheKeyPrefix(key)).Inc()
+		}
+	}
+	return value, found, err
+}
+
+// Set stores the value, entries rejected by the backend (eg. ErrCacheEntryTooLarge) are not tracked
+func (c *InstrumentedCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.setWithSeries(key, value, ttl, 0)
+}
+
+func (c *InstrumentedCache) setWithSeries(key string, value []byte, ttl time.Duration, series int64) error {
+	if err := setCacheWithSeries(c.Cache, key, value, ttl, series); err != nil {
+		return err
+	}
+	c.track(key, len(value), time.Now().Add(ttl))
+	return nil
+}
+
+func (c *InstrumentedCache) Delete(key string) error {
+	if err := c.Cache.Delete(key); err != nil {
+		return err
+	}
+	c.untrack(key)
+	c.prometheus.evictions.WithLabelValues(CacheKeyPrefix(key), CacheEvictionPurged).Inc()
+	return nil
+}
+
+// Entry returns the entry of the key with its value, found is false for missing or expired keys
+func (c *InstrumentedCache) Entry(key string) (*CacheEntry, []byte, bool, error) {
+	entries, err := c.Cache.Entries(key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	for _, entry := range entries {
+		if entry.Key != key {
+			continue
+		}
+
+		// not counted as hit or miss
+		value, found, err := c.Cache.Get(key)
+		if err != nil || !found {
+			return nil, nil, false, err
+		}
+		return &entry, value, true, nil
+	}
+
+	return nil, nil, false, nil
+}
+
+// Purge removes all entries matching the filter and returns the removed entries
+func (c *InstrumentedCache) Purge(filter CachePurgeFilter) ([]CacheEntry, error) {
+	prefix := filter.Prefix
+	if filter.Key != "" {
+		if !strings.HasPrefix(filter.Key, prefix) {
+			return []CacheEntry{}, nil
+		}
+		prefix = filter.Key
+	}
+
+	entries, err := c.Cache.Entries(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptionId := []byte(strings.ToLower(filter.SubscriptionId))
+
+	ret := []CacheEntry{}
+	for _, entry := range entries {
+		if filter.Key != "" && entry.Key != filter.Key {
+			continue
+		}
+
+		if len(subscriptionId) > 0 {
+			// cache keys are hashed, the subscription is only found in the value
+			// (resource ids or subscriptionID labels of metrics, servicediscovery and definitions)
+			value, found, err := c.Cache.Get(entry.Key)
+			if err != nil {
+				return ret, err
+			}
+			if !found || !bytes.Contains(bytes.ToLower(value), subscriptionId) {
+				continue
+			}
+		}
+
+		if err := c.Delete(entry.Key); err != nil {
+			return ret, err
+		}
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+func (c instrumentedCacheSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cache.prometheus.entries
+	ch <- c.cache.prometheus.size
+}
+
+func (c *InstrumentedCache) track(key string, size int, expiresAt time.Time) {
+	c.tracked.lock.Lock()
+	defer c.tracked.lock.Unlock()
+	c.tracked.entries[key] = instrumentedCacheEntry{size: size, expiresAt: expiresAt}
+}
+
+func (c *InstrumentedCache) untrack(key string) {
+	c.tracked.lock.Lock()
+	defer c.tracked.lock.Unlock()
+	delete(c.tracked.entries, key)
+}
+
+// trackedSize returns the number and size of the tracked entries by prefix,
+// expired entries (eg. expired by redis without notification) are removed
+func (c *InstrumentedCache) trackedSize() (count map[string]int, size map[string]int) {
+	c.tracked.lock.Lock()
+	defer c.tracked.lock.Unlock()
+
+	now := time.Now()
+	count = map[string]int{}
+	size = map[string]int{}
+	for key, entry := range c.tracked.entries {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(c.tracked.entries, key)
+			continue
+		}
+		prefix := CacheKeyPrefix(key)
+		count[prefix]++
+		size[prefix] += entry.size
+	}
+	return
+}
+
+func (c instrumentedCacheSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	count, size := c.cache.trackedSize()
+	for prefix, val := range count {
+		ch <- prometheus.MustNewConstMetric(c.cache.prometheus.entries, prometheus.GaugeValue, float64(val), prefix)
+		ch <- prometheus.MustNewConstMetric(c.cache.prometheus.size, prometheus.GaugeValue, float64(size[prefix]), prefix)
+	}
+}
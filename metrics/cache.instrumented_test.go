@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+type (
+	// failingEntriesCache is a backend which can't enumerate its entries (eg. redis is not reachable)
+	failingEntriesCache struct {
+		*MemoryCache
+		entriesCalls int
+	}
+)
+
+func (c *failingEntriesCache) Entries(prefix string) ([]CacheEntry, error) {
+	c.entriesCalls++
+	return nil, errors.New("scan failed")
+}
+
+// gatherCacheSize returns the values of azurerm_cache_entries and azurerm_cache_size_bytes by prefix
+func gatherCacheSize(t *testing.T, registry *prometheus.Registry) (entries map[string]float64, size map[string]float64) {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	entries = map[string]float64{}
+	size = map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			prefix := metric.GetLabel()[0].GetValue()
+			switch family.GetName() {
+			case "azurerm_cache_entries":
+				entries[prefix] = metric.GetGauge().GetValue()
+			case "azurerm_cache_size_bytes":
+				size[prefix] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return
+}
+
+func TestInstrumentedCacheTracksSizeWithoutEnumeration(t *testing.T) {
+	backend := &failingEntriesCache{MemoryCache: NewMemoryCache(MemoryCacheConfig{})}
+	defer backend.Close() // nolint:errcheck
+
+	registry := prometheus.NewRegistry()
+	cache := NewInstrumentedCache(zap.NewNop().Sugar(), backend, registry)
+
+	if err := cache.Set("list:a", []byte("12345"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:b", []byte("123"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("servicediscovery:c", []byte("1"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	entries, size := gatherCacheSize(t, registry)
+	if entries["list"] != 2 || size["list"] != 8 {
+		t.Errorf("expected 2 list entries with 8 bytes, got %v entries with %v bytes", entries["list"], size["list"])
+	}
+	if _, exists := entries["servicediscovery"]; exists {
+		t.Error("expired entries must not be counted")
+	}
+
+	if err := cache.Delete("list:a"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, size = gatherCacheSize(t, registry)
+	if entries["list"] != 1 || size["list"] != 3 {
+		t.Errorf("expected 1 list entry with 3 bytes after delete, got %v entries with %v bytes", entries["list"], size["list"])
+	}
+
+	// only enumerated once on creation
+	if backend.entriesCalls != 1 {
+		t.Errorf("expected 1 enumeration of the backend, got %d", backend.entriesCalls)
+	}
+}
+
+func TestInstrumentedCacheCountsExistingEntries(t *testing.T) {
+	backend := NewMemoryCache(MemoryCacheConfig{})
+	defer backend.Close() // nolint:errcheck
+
+	if err := backend.Set("resource:a", []byte("1234"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	NewInstrumentedCache(zap.NewNop().Sugar(), backend, registry)
+
+	entries, size := gatherCacheSize(t, registry)
+	if entries["resource"] != 1 || size["resource"] != 4 {
+		t.Errorf("expected 1 existing resource entry with 4 bytes, got %v entries with %v bytes", entries["resource"], size["resource"])
+	}
+}
+
+func TestInstrumentedCacheSkipsEntriesTooLarge(t *testing.T) {
+	backend := NewMemoryCache(MemoryCacheConfig{MaxBytes: 300})
+	defer backend.Close() // nolint:errcheck
+
+	registry := prometheus.NewRegistry()
+	cache := NewInstrumentedCache(zap.NewNop().Sugar(), backend, registry)
+
+	if err := cache.Set("list:a", []byte("small"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	largeValue := make([]byte, 500)
+	if err := cache.Set("list:b", largeValue, time.Minute); !errors.Is(err, ErrCacheEntryTooLarge) {
+		t.Fatalf("expected ErrCacheEntryTooLarge, got %v", err)
+	}
+
+	entries, _ := gatherCacheSize(t, registry)
+	if entries["list"] != 1 {
+		t.Errorf("expected only the stored entry to be tracked, got %v entries", entries["list"])
+	}
+	if evictions := testutil.ToFloat64(cache.prometheus.evictions.WithLabelValues("list", CacheEvictionMemory)); evictions != 0 {
+		t.Errorf("expected no eviction of a rejected new entry, got %v", evictions)
+	}
+
+	// the previous value of a key replaced by a rejected entry is evicted
+	if err := cache.Set("list:a", largeValue, time.Minute); !errors.Is(err, ErrCacheEntryTooLarge) {
+		t.Fatalf("expected ErrCacheEntryTooLarge, got %v", err)
+	}
+	if _, found, _ := cache.Get("list:a"); found {
+		t.Error("expected previous value to be removed")
+	}
+
+	entries, _ = gatherCacheSize(t, registry)
+	if _, exists := entries["list"]; exists {
+		t.Errorf("expected no tracked entries, got %v", entries["list"])
+	}
+	if evictions := testutil.ToFloat64(cache.prometheus.evictions.WithLabelValues("list", CacheEvictionMemory)); evictions != 1 {
+		t.Errorf("expected eviction of the previous value, got %v", evictions)
+	}
+}
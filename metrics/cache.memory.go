@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// estimated memory of a cache entry besides key and value (list element, map entry, item)
+	memoryCacheEntryOverhead = 160
+)
+
+type (
+	// MemoryCache stores the cache inside the process (lost on restart, not shared between replicas),
+	// the size is limited by bytes and series, least recently used entries are evicted first
+	MemoryCache struct {
+		lock sync.Mutex
+		conf MemoryCacheConfig
+
+		items map[string]*list.Element
+		// least recently used entries at the back
+		lru *list.List
+
+		bytes  int64
+		series int64
+
+		evictionHandler func(key, reason string)
+		stop            chan struct{}
+	}
+
+	MemoryCacheConfig struct {
+		// maximum estimated memory of all entries (0 = unlimited)
+		MaxBytes int64
+
+		// maximum series of all cached metric lists (0 = unlimited)
+		MaxSeries int64
+	}
+
+	memoryCacheItem struct {
+		key       string
+		value     []byte
+		expiresAt time.Time
+
+		bytes  int64
+		series int64
+	}
+)
+
+func NewMemoryCache(conf MemoryCacheConfig) *MemoryCache {
+	c := &MemoryCache{
+		conf:  conf,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+		stop:  make(chan struct{}),
+	}
+	go c.cleanup(1 * time.Minute)
+	return c
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool, error) {
+	c.lock.Lock()
+	element, exists := c.items[key]
+	if !exists {
+		c.lock.Unlock()
+		return nil, false, nil
+	}
+
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.expiresAt) {
+		c.remove(element)
+		c.lock.Unlock()
+		c.evicted(CacheEvictionExpired, key)
+		return nil, false, nil
+	}
+
+	c.lru.MoveToFront(element)
+	c.lock.Unlock()
+	return item.value, true, nil
+}
+
+// Set stores the value without series (eg. servicediscovery or metric definitions)
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.setWithSeries(key, value, ttl, 0)
+}
+
+func (c *MemoryCache) setWithSeries(key string, value []byte, ttl time.Duration, series int64) error {
+	item := &memoryCacheItem{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+		bytes:     int64(len(key)+len(value)) + memoryCacheEntryOverhead,
+		series:    series,
+	}
+
+	c.lock.Lock()
+	element, exists := c.items[key]
+	if exists {
+		c.remove(element)
+	}
+
+	// entries exceeding the limits on their own are not stored (would evict all other entries),
+	// the previous value of the key is evicted
+	if (c.conf.MaxBytes > 0 && item.bytes > c.conf.MaxBytes) || (c.conf.MaxSeries > 0 && item.series > c.conf.MaxSeries) {
+		c.lock.Unlock()
+		if exists {
+			c.evicted(CacheEvictionMemory, key)
+		}
+		return fmt.Errorf("%w (%d bytes, %d series)", ErrCacheEntryTooLarge, item.bytes, item.series)
+	}
+
+	c.items[key] = c.lru.PushFront(item)
+	c.bytes += item.bytes
+	c.series += item.series
+
+	// evict least recently used entries
+	evicted := []string{}
+	for c.lru.Len() > 0 && c.exceedsLimits() {
+		element := c.lru.Back()
+		evicted = append(evicted, element.Value.(*memoryCacheItem).key)
+		c.remove(element)
+	}
+	c.lock.Unlock()
+
+	c.evicted(CacheEvictionMemory, evicted...)
+	return nil
+}
+
+func (c *MemoryCache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.items[key]; exists {
+		c.remove(element)
+	}
+	return nil
+}
+
+func (c *MemoryCache) Entries(prefix string) ([]CacheEntry, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	ret := []CacheEntry{}
+	for key, element := range c.items {
+		item := element.Value.(*memoryCacheItem)
+		if !strings.HasPrefix(key, prefix) || now.After(item.expiresAt) {
+			continue
+		}
+
+		ret = append(ret, CacheEntry{
+			Key:       key,
+			Prefix:    CacheKeyPrefix(key),
+			ExpiresAt: item.expiresAt,
+			Size:      len(item.value),
+		})
+	}
+	return ret, nil
+}
+
+func (c *MemoryCache) Close() error {
+	close(c.stop)
+	return nil
+}
+
+func (c *MemoryCache) onEvicted(handler func(key, reason string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evictionHandler = handler
+}
+
+func (c *MemoryCache) exceedsLimits() bool {
+	return (c.conf.MaxBytes > 0 && c.bytes > c.conf.MaxBytes) || (c.conf.MaxSeries > 0 && c.series > c.conf.MaxSeries)
+}
+
+// remove removes the entry, must be called with lock
+func (c *MemoryCache) remove(element *list.Element) {
+	item := element.Value.(*memoryCacheItem)
+	c.lru.Remove(element)
+	delete(c.items, item.key)
+	c.bytes -= item.bytes
+	c.series -= item.series
+}
+
+// evicted notifies the eviction handler, must be called without lock
+func (c *MemoryCache) evicted(reason string, keys ...string) {
+	c.lock.Lock()
+	handler := c.evictionHandler
+	c.lock.Unlock()
+
+	if handler != nil {
+		for _, key := range keys {
+			handler(key, reason)
+		}
+	}
+}
+
+// cleanup removes expired entries periodically
+func (c *MemoryCache) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+
+		now := time.Now()
+		evicted := []string{}
+		c.lock.Lock()
+		for _, element := range c.items {
+			if item := element.Value.(*memoryCacheItem); now.After(item.expiresAt) {
+				evicted = append(evicted, item.key)
+				c.remove(element)
+			}
+		}
+		c.lock.Unlock()
+
+		c.evicted(CacheEvictionExpired, evicted...)
+	}
+}
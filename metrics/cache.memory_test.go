@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// cacheEvictionRecorder records the evictions of a cache by reason
+type cacheEvictionRecorder struct {
+	lock    sync.Mutex
+	evicted map[string][]string
+}
+
+func newCacheEvictionRecorder(cache cacheEvictionNotifier) *cacheEvictionRecorder {
+	recorder := &cacheEvictionRecorder{evicted: map[string][]string{}}
+	cache.onEvicted(func(key, reason string) {
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+		recorder.evicted[reason] = append(recorder.evicted[reason], key)
+	})
+	return recorder
+}
+
+func (r *cacheEvictionRecorder) keys(reason string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.evicted[reason])
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsedByBytes(t *testing.T) {
+	value := make([]byte, 100)
+	entryBytes := int64(len("list:a")+len(value)) + memoryCacheEntryOverhead
+
+	cache := NewMemoryCache(MemoryCacheConfig{MaxBytes: 2 * entryBytes})
+	defer cache.Close() // nolint:errcheck
+	evictions := newCacheEvictionRecorder(cache)
+
+	for _, key := range []string{"list:a", "list:b"} {
+		if err := cache.Set(key, value, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// list:a is used, list:b is the least recently used entry
+	if _, found, _ := cache.Get("list:a"); !found {
+		t.Fatal("expected list:a to be cached")
+	}
+	if err := cache.Set("list:c", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]bool{"list:a": true, "list:b": false, "list:c": true} {
+		if _, found, _ := cache.Get(key); found != expected {
+			t.Errorf("%s: expected found %v, got %v", key, expected, found)
+		}
+	}
+	if evicted := evictions.keys(CacheEvictionMemory); !slices.Equal(evicted, []string{"list:b"}) {
+		t.Errorf("expected eviction of list:b, got %v", evicted)
+	}
+	if cache.bytes != 2*entryBytes {
+		t.Errorf("expected %d bytes, got %d", 2*entryBytes, cache.bytes)
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsedBySeries(t *testing.T) {
+	cache := NewMemoryCache(MemoryCacheConfig{MaxSeries: 10})
+	defer cache.Close() // nolint:errcheck
+	evictions := newCacheEvictionRecorder(cache)
+
+	testCases := []struct {
+		key     string
+		series  int64
+		evicted []string
+	}{
+		{"list:a", 4, nil},
+		{"list:b", 4, nil},
+		// servicediscovery and definitions have no series
+		{"servicediscovery:a", 0, nil},
+		{"list:c", 4, []string{"list:a"}},
+		// evicts until the series fit, entries without series are evicted on the way
+		{"list:d", 9, []string{"list:a", "list:b", "servicediscovery:a", "list:c"}},
+	}
+
+	for _, testCase := range testCases {
+		if err := cache.setWithSeries(testCase.key, []byte("{}"), time.Minute, testCase.series); err != nil {
+			t.Fatal(err)
+		}
+		if evicted := evictions.keys(CacheEvictionMemory); !slices.Equal(evicted, testCase.evicted) {
+			t.Errorf("%s: expected evictions %v, got %v", testCase.key, testCase.evicted, evicted)
+		}
+	}
+
+	if cache.series != 9 || cache.lru.Len() != 1 {
+		t.Errorf("expected only list:d with 9 series, got %d entries with %d series", cache.lru.Len(), cache.series)
+	}
+
+	// replaced entries don't count twice
+	if err := cache.setWithSeries("list:d", []byte("{}"), time.Minute, 3); err != nil {
+		t.Fatal(err)
+	}
+	if cache.series != 3 {
+		t.Errorf("expected 3 series after replacing list:d, got %d", cache.series)
+	}
+}
+
+func TestMemoryCacheExpiresEntries(t *testing.T) {
+	cache := NewMemoryCache(MemoryCacheConfig{})
+	defer cache.Close() // nolint:errcheck
+	evictions := newCacheEvictionRecorder(cache)
+
+	if err := cache.Set("list:expired", []byte("a"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:fresh", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	entries, err := cache.Entries("list:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "list:fresh" {
+		t.Errorf("expected only list:fresh, got %v", entries)
+	}
+
+	if _, found, _ := cache.Get("list:expired"); found {
+		t.Error("expected expired entry not to be found")
+	}
+	if value, found, _ := cache.Get("list:fresh"); !found || string(value) != "b" {
+		t.Errorf("expected fresh entry, got %q (found %v)", value, found)
+	}
+	if evicted := evictions.keys(CacheEvictionExpired); !slices.Equal(evicted, []string{"list:expired"}) {
+		t.Errorf("expected expiry of list:expired, got %v", evicted)
+	}
+	if cache.lru.Len() != 1 {
+		t.Errorf("expected expired entry to be removed, got %d entries", cache.lru.Len())
+	}
+}
+
+func TestMemoryCacheCleanupRemovesExpiredEntries(t *testing.T) {
+	cache := NewMemoryCache(MemoryCacheConfig{})
+	evictions := newCacheEvictionRecorder(cache)
+
+	if err := cache.Set("list:expired", []byte("a"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:fresh", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped by Close together with the cleanup of NewMemoryCache
+	go cache.cleanup(5 * time.Millisecond)
+	defer cache.Close() // nolint:errcheck
+
+	deadline := time.Now().Add(time.Second)
+	for len(evictions.keys(CacheEvictionExpired)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if evicted := evictions.keys(CacheEvictionExpired); !slices.Equal(evicted, []string{"list:expired"}) {
+		t.Errorf("expected expiry of list:expired, got %v", evicted)
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if _, exists := cache.items["list:fresh"]; !exists || len(cache.items) != 1 {
+		t.Errorf("expected only list:fresh to be kept, got %d entries", len(cache.items))
+	}
+}
+
+func TestSetCacheWithSeriesPassesSeriesToBackend(t *testing.T) {
+	backend := NewMemoryCache(MemoryCacheConfig{})
+	defer backend.Close() // nolint:errcheck
+	registry := prometheus.NewRegistry()
+	cache := NewInstrumentedCache(zap.NewNop().Sugar(), backend, registry)
+
+	if err := setCacheWithSeries(cache, "list:a", []byte("{}"), time.Minute, 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("servicediscovery:a", []byte("{}"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.series != 42 {
+		t.Errorf("expected 42 series, got %d", backend.series)
+	}
+	if entries, _ := gatherCacheSize(t, registry); entries["list"] != 1 || entries["servicediscovery"] != 1 {
+		t.Errorf("expected tracked entries, got %v", entries)
+	}
+}
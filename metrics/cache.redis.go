@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RedisCacheTimeout = 5 * time.Second
+)
+
+type (
+	// RedisCache stores the cache in redis (survives restarts, shared between replicas)
+	RedisCache struct {
+		client *redis.Client
+		prefix string
+	}
+)
+
+func NewRedisCache(addr, password string, db int, prefix string) (*RedisCache, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisCacheTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &RedisCache{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (c *RedisCache) Get(key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisCacheTimeout)
+	defer cancel()
+
+	value, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisCacheTimeout)
+	defer cancel()
+
+	return c.client.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+func (c *RedisCache) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisCacheTimeout)
+	defer cancel()
+
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// Entries scans the keys of the prefix (SCAN, doesn't block the redis server)
+func (c *RedisCache) Entries(prefix string) ([]CacheEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisCacheTimeout)
+	defer cancel()
+
+	keys := []string{}
+	iter := c.client.Scan(ctx, 0, redisGlobEscape(c.prefix+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := []CacheEntry{}
+	for start := 0; start < len(keys); start += 1000 {
+		batch := keys[start:min(start+1000, len(keys))]
+
+		pipe := c.client.Pipeline()
+		ttls := make([]*redis.DurationCmd, len(batch))
+		sizes := make([]*redis.IntCmd, len(batch))
+		for i, key := range batch {
+			ttls[i] = pipe.PTTL(ctx, key)
+			sizes[i] = pipe.StrLen(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		now := time.Now()
+		for i, key := range batch {
+			ttl := ttls[i].Val()
+			if ttl == -2 {
+				// expired or deleted since scan
+				continue
+			}
+
+			entry := CacheEntry{
+				Key:  strings.TrimPrefix(key, c.prefix),
+				Size: int(sizes[i].Val()),
+			}
+			entry.Prefix = CacheKeyPrefix(entry.Key)
+			if ttl > 0 {
+				entry.ExpiresAt = now.Add(ttl)
+			}
+			ret = append(ret, entry)
+		}
+	}
+
+	return ret, nil
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+// redisGlobEscape escapes the glob characters of a SCAN pattern
+func redisGlobEscape(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(val)
+}
@@ -0,0 +1,352 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// fakeRedisServer implements the RESP2 commands used by RedisCache (GET, SET, DEL, SCAN, PTTL, STRLEN)
+	fakeRedisServer struct {
+		listener net.Listener
+
+		lock sync.Mutex
+		keys map[string]fakeRedisValue
+	}
+
+	fakeRedisValue struct {
+		value     string
+		expiresAt time.Time
+	}
+)
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedisServer{listener: listener, keys: map[string]fakeRedisValue{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return server
+}
+
+func (s *fakeRedisServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// RawKeys returns the stored keys (not expired) including the prefix of the cache
+func (s *fakeRedisServer) RawKeys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := []string{}
+	for key := range s.keys {
+		if _, exists := s.lookup(key); exists {
+			ret = append(ret, key)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close() // nolint:errcheck
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, s.handle(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) handle(args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if value, exists := s.lookup(args[1]); exists {
+			return fakeRedisBulkString(value.value)
+		}
+		return "$-1\r\n"
+	case "SET":
+		value := fakeRedisValue{value: args[2]}
+		for i := 3; i+1 < len(args); i += 2 {
+			amount, _ := strconv.ParseInt(args[i+1], 10, 64)
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				value.expiresAt = time.Now().Add(time.Duration(amount) * time.Millisecond)
+			case "EX":
+				value.expiresAt = time.Now().Add(time.Duration(amount) * time.Second)
+			}
+		}
+		s.keys[args[1]] = value
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, exists := s.lookup(key); exists {
+				deleted++
+			}
+			delete(s.keys, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SCAN":
+		// all keys are returned in one page
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []string{}
+		for key := range s.keys {
+			if _, exists := s.lookup(key); exists && fakeRedisPrefixMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		ret := "*2\r\n" + fakeRedisBulkString("0") + fmt.Sprintf("*%d\r\n", len(keys))
+		for _, key := range keys {
+			ret += fakeRedisBulkString(key)
+		}
+		return ret
+	case "PTTL":
+		value, exists := s.lookup(args[1])
+		switch {
+		case !exists:
+			return ":-2\r\n"
+		case value.expiresAt.IsZero():
+			return ":-1\r\n"
+		default:
+			return fmt.Sprintf(":%d\r\n", time.Until(value.expiresAt).Milliseconds())
+		}
+	case "STRLEN":
+		value, _ := s.lookup(args[1])
+		return fmt.Sprintf(":%d\r\n", len(value.value))
+	default:
+		// eg. HELLO and CLIENT SETINFO of the connection handshake
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// lookup returns the value of the key and removes expired keys, must be called with lock
+func (s *fakeRedisServer) lookup(key string) (fakeRedisValue, bool) {
+	value, exists := s.keys[key]
+	if exists && !value.expiresAt.IsZero() && time.Now().After(value.expiresAt) {
+		delete(s.keys, key)
+		return fakeRedisValue{}, false
+	}
+	return value, exists
+}
+
+// fakeRedisPrefixMatch matches SCAN patterns of an escaped prefix followed by * (as used by RedisCache)
+func fakeRedisPrefixMatch(pattern, key string) bool {
+	prefix, found := strings.CutSuffix(pattern, "*")
+	if !found || strings.HasSuffix(prefix, `\`) {
+		return pattern == key
+	}
+	prefix = strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`).Replace(prefix)
+	return strings.HasPrefix(key, prefix)
+}
+
+func fakeRedisBulkString(val string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+}
+
+// readFakeRedisCommand reads a command sent as array of bulk strings
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisCache(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache, err := NewRedisCache(server.Addr(), "", 0, "exporter:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close() // nolint:errcheck
+
+	if _, found, err := cache.Get("list:a"); err != nil || found {
+		t.Fatalf("expected missing key, got found %v (%v)", found, err)
+	}
+
+	values := map[string]string{
+		"list:a":             `{"list":{}}`,
+		"list:b":             `{"list":{"metric":[]}}`,
+		"servicediscovery:a": `[]`,
+	}
+	for key, value := range values {
+		if err := cache.Set(key, []byte(value), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, expected := range values {
+		if value, found, err := cache.Get(key); err != nil || !found || string(value) != expected {
+			t.Errorf("%s: expected %q, got %q (found %v, %v)", key, expected, value, found, err)
+		}
+	}
+
+	// keys are stored with the prefix of the exporter
+	if keys := server.RawKeys(); !slices.Equal(keys, []string{"exporter:list:a", "exporter:list:b", "exporter:servicediscovery:a"}) {
+		t.Errorf("expected prefixed keys, got %v", keys)
+	}
+
+	entries, err := cache.Entries("list:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+		if entry.Prefix != "list" || entry.Size != len(values[entry.Key]) || time.Until(entry.ExpiresAt) <= 0 {
+			t.Errorf("%s: unexpected entry %+v", entry.Key, entry)
+		}
+	}
+	sort.Strings(keys)
+	if !slices.Equal(keys, []string{"list:a", "list:b"}) {
+		t.Errorf("expected entries of prefix list, got %v", keys)
+	}
+
+	if err := cache.Delete("list:a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Delete("list:missing"); err != nil {
+		t.Errorf("expected missing keys to be ignored, got %v", err)
+	}
+	if _, found, _ := cache.Get("list:a"); found {
+		t.Error("expected deleted entry not to be found")
+	}
+}
+
+func TestRedisCacheExpiresEntries(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache, err := NewRedisCache(server.Addr(), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close() // nolint:errcheck
+
+	if err := cache.Set("list:expired", []byte("a"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:fresh", []byte("b"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, found, _ := cache.Get("list:expired"); found {
+		t.Error("expected expired entry not to be found")
+	}
+	if entries, _ := cache.Entries(""); len(entries) != 1 || entries[0].Key != "list:fresh" {
+		t.Errorf("expected only list:fresh, got %v", entries)
+	}
+}
+
+func TestRedisCacheEntriesEscapesPrefix(t *testing.T) {
+	server := newFakeRedisServer(t)
+	cache, err := NewRedisCache(server.Addr(), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close() // nolint:errcheck
+
+	for _, key := range []string{"list:*", "list:a", "list:?b"} {
+		if err := cache.Set(key, []byte("{}"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"list:*", []string{"list:*"}},
+		{"list:?", []string{"list:?b"}},
+		{"list:", []string{"list:*", "list:?b", "list:a"}},
+	}
+
+	for _, testCase := range testCases {
+		entries, err := cache.Entries(testCase.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		sort.Strings(keys)
+		if !slices.Equal(keys, testCase.expected) {
+			t.Errorf("%q: expected %v, got %v", testCase.prefix, testCase.expected, keys)
+		}
+	}
+}
+
+func TestNewRedisCacheUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	if _, err := NewRedisCache(addr, "", 0, ""); err == nil {
+		t.Error("expected error of unavailable redis server")
+	}
+}
@@ -0,0 +1,185 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// probeRuns are the running coalesced probes (by cache key), concurrent identical probes join the run
+	probeRuns     = map[string]*probeRun{}
+	probeRunsLock sync.Mutex
+)
+
+type (
+	// probeResult is the result of a probe run shared with all coalesced probes
+	probeResult struct {
+		metrics     *MetricListSnapshot
+		status      *probeStatus
+		targets     map[string][]MetricProbeTarget
+		cachedUntil *time.Time
+	}
+
+	// probeRun is the context of a coalesced probe run, it's not canceled if one waiting probe
+	// is gone (eg. the leading probe) but only if all waiting probes are gone or the deadline is reached
+	probeRun struct {
+		ctx     context.Context
+		cancel  context.CancelFunc
+		waiters int
+
+		// closed when the run is finished, result and err are set before
+		done   chan struct{}
+		result *probeResult
+		err    error
+	}
+)
+
+// joinProbeRun registers the probe as waiting for the run of the key, the probe creating the run
+// (with its deadline) is the leader and has to execute the run
+func joinProbeRun(key string, ctx context.Context) (run *probeRun, leader bool) {
+	probeRunsLock.Lock()
+	defer probeRunsLock.Unlock()
+
+	run, exists := probeRuns[key]
+	if !exists {
+		run = &probeRun{done: make(chan struct{})}
+		if deadline, ok := ctx.Deadline(); ok {
+			run.ctx, run.cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		} else {
+			run.ctx, run.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		}
+		probeRuns[key] = run
+		leader = true
+	}
+	run.waiters++
+
+	return run, leader
+}
+
+// leaveProbeRun unregisters the probe, the run is canceled if no probe is waiting anymore
+func leaveProbeRun(key string, run *probeRun) {
+	probeRunsLock.Lock()
+	defer probeRunsLock.Unlock()
+
+	run.waiters--
+	if run.waiters > 0 {
+		return
+	}
+
+	run.cancel()
+	// probes arriving later must not join the canceled run
+	if probeRuns[key] == run {
+		delete(probeRuns, key)
+	}
+}
+
+// finish stores the result and removes the run, probes arriving later start a new run
+func (run *probeRun) finish(key string, result *probeResult, err error) {
+	probeRunsLock.Lock()
+	defer probeRunsLock.Unlock()
+
+	run.result = result
+	run.err = err
+	if probeRuns[key] == run {
+		delete(probeRuns, key)
+	}
+	close(run.done)
+}
+
+// RunCoalesced runs the probe (discovery and collection) once for all concurrent probes with the same key,
+// the other probes wait for the result and publish the shared metrics. Without discoverer the probe is
+// running on subscription scope. Returns true if the result of another probe was used.
+func (p *MetricProber) RunCoalesced(key string, discoverer TargetDiscoverer) (coalesced bool, err error) {
+	ctx := p.ctx
+	run, leader := joinProbeRun(key, ctx)
+	defer leaveProbeRun(key, run)
+
+	// the leading probe executes the run for all waiting probes, the run continues if the leader is gone
+	if leader {
+		go func() {
+			result, err := p.runProbe(run.ctx, discoverer)
+			run.finish(key, result, err)
+		}()
+	}
+
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		if !leader || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// waiting probes are bound to their own timeout, gone probes don't wait at all
+			return !leader, ctx.Err()
+		}
+		// the leading probe returns the (partial) result of its own run
+		<-run.done
+	}
+
+	coalesced = !leader
+	if run.err != nil {
+		if p.FetchStaleFromCache() {
+			p.logger.Warnf("serving stale metrics from cache: %v", run.err)
+			return coalesced, nil
+		}
+		return coalesced, run.err
+	}
+
+	shared := run.result
+	if coalesced {
+		p.metricSnapshot = shared.metrics
+		p.status = shared.status
+		p.targets = shared.targets
+	}
+
+	if p.isFailed() && p.FetchStaleFromCache() {
+		return coalesced, nil
+	}
+
+	if shared.cachedUntil != nil && p.response != nil {
+		p.response.Header().Add("X-metrics-cached-until", shared.cachedUntil.Format(time.RFC3339))
+	}
+
+	if shared.status.isPartial() && p.response != nil {
+		p.response.Header().Add("X-metrics-partial", "true")
+	}
+
+	p.publishMetricList()
+	p.publishProbeStatus()
+	return coalesced, nil
+}
+
+// runProbe runs discovery and collection of the probe bound to the context of the coalesced run
+func (p *MetricProber) runProbe(ctx context.Context, discoverer TargetDiscoverer) (*probeResult, error) {
+	// the run is bound to all waiting probes instead of the leading probe
+	probeCtx := p.ctx
+	p.ctx = ctx
+	defer func() {
+		p.ctx = probeCtx
+	}()
+
+	var err error
+	mergeErr := p.collectWithDeadline(func() {
+		if discoverer != nil {
+			if err = discoverer.DiscoverTargets(p.ctx, p); err != nil {
+				return
+			}
+			p.collectMetricsFromTargets()
+		} else {
+			p.collectMetricsFromSubscriptions()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mergeErr != nil {
+		return nil, mergeErr
+	}
+
+	// the response is not touched here, waiting probes might be gone already (timeout)
+	return &probeResult{
+		metrics:     p.metrics(),
+		status:      p.status,
+		targets:     p.targets,
+		cachedUntil: p.saveToCache(),
+	}, nil
+}
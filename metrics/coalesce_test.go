@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestJoinProbeRunLeader(t *testing.T) {
+	key := "test:leader"
+	ctx := context.Background()
+
+	first, leader := joinProbeRun(key, ctx)
+	if !leader {
+		t.Fatal("first probe must lead the run")
+	}
+
+	second, leader := joinProbeRun(key, ctx)
+	if leader || second != first {
+		t.Fatal("second probe must join the running run")
+	}
+
+	first.finish(key, &probeResult{}, nil)
+	leaveProbeRun(key, first)
+	leaveProbeRun(key, second)
+
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("finished run must be done")
+	}
+
+	third, leader := joinProbeRun(key, ctx)
+	defer leaveProbeRun(key, third)
+	if !leader || third == first {
+		t.Fatal("probe after the finished run must lead a new run")
+	}
+}
+
+func TestLeaveProbeRunCancelsAbandonedRun(t *testing.T) {
+	key := "test:abandoned"
+
+	run, _ := joinProbeRun(key, context.Background())
+	waiter, _ := joinProbeRun(key, context.Background())
+
+	leaveProbeRun(key, run)
+	if run.ctx.Err() != nil {
+		t.Fatal("run must continue while probes are waiting")
+	}
+
+	leaveProbeRun(key, waiter)
+	if run.ctx.Err() == nil {
+		t.Fatal("run must be canceled if no probe is waiting anymore")
+	}
+
+	next, leader := joinProbeRun(key, context.Background())
+	defer leaveProbeRun(key, next)
+	if !leader || next == run {
+		t.Fatal("probe must not join the canceled run")
+	}
+}
+
+// countingDiscoverer counts the probe runs, a run blocks until release is closed
+type countingDiscoverer struct {
+	runs    atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func newCountingDiscoverer(err error) *countingDiscoverer {
+	return &countingDiscoverer{started: make(chan struct{}, 1), release: make(chan struct{}), err: err}
+}
+
+func (d *countingDiscoverer) DiscoverTargets(ctx context.Context, prober *MetricProber) error {
+	d.runs.Add(1)
+	d.started <- struct{}{}
+
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	prober.status.setTargetUp(testResourceId("Microsoft.KeyVault/vaults", 1), true)
+	return nil
+}
+
+// waitForProbeRunWaiters waits until the expected number of probes joined the run of the key
+func waitForProbeRunWaiters(t *testing.T, key string, waiters int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		probeRunsLock.Lock()
+		run := probeRuns[key]
+		joined := run != nil && run.waiters == waiters
+		probeRunsLock.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d probes waiting for the run %s", waiters, key)
+}
+
+type coalescedResult struct {
+	prober    *MetricProber
+	coalesced bool
+	err       error
+}
+
+// startCoalescedProbes starts the probes, the first one leads the run
+func startCoalescedProbes(t *testing.T, key string, discoverer *countingDiscoverer, ctxList []context.Context) <-chan coalescedResult {
+	t.Helper()
+	results := make(chan coalescedResult, len(ctxList))
+	for i, ctx := range ctxList {
+		prober := newTestProber(ctx)
+		go func() {
+			coalesced, err := prober.RunCoalesced(key, discoverer)
+			results <- coalescedResult{prober: prober, coalesced: coalesced, err: err}
+		}()
+
+		if i == 0 {
+			<-discoverer.started
+		}
+		waitForProbeRunWaiters(t, key, i+1)
+	}
+	return results
+}
+
+func TestRunCoalescedRunsOnceForAllWaiters(t *testing.T) {
+	const probes = 5
+	key := "test:coalesced"
+	discoverer := newCountingDiscoverer(nil)
+
+	ctxList := []context.Context{}
+	for i := 0; i < probes; i++ {
+		ctxList = append(ctxList, context.Background())
+	}
+	results := startCoalescedProbes(t, key, discoverer, ctxList)
+	close(discoverer.release)
+
+	coalescedCount := 0
+	for i := 0; i < probes; i++ {
+		result := <-results
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.coalesced {
+			coalescedCount++
+		}
+
+		// every probe publishes the status of the shared run
+		families, err := result.prober.prometheus.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.ContainsFunc(families, func(family *dto.MetricFamily) bool {
+			return family.GetName() == ProbeTargetUpName && len(family.GetMetric()) == 1
+		}) {
+			t.Error("expected target status of the shared run")
+		}
+	}
+
+	if runs := discoverer.runs.Load(); runs != 1 {
+		t.Errorf("expected one run, got %d", runs)
+	}
+	if coalescedCount != probes-1 {
+		t.Errorf("expected %d coalesced probes, got %d", probes-1, coalescedCount)
+	}
+}
+
+func TestRunCoalescedWaiterCancelDoesNotAbortLeader(t *testing.T) {
+	key := "test:coalesced-cancel"
+	discoverer := newCountingDiscoverer(nil)
+
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	results := startCoalescedProbes(t, key, discoverer, []context.Context{context.Background(), waiterCtx})
+
+	cancelWaiter()
+	waiterResult := <-results
+	if !waiterResult.coalesced || !errors.Is(waiterResult.err, context.Canceled) {
+		t.Fatalf("expected canceled waiter, got coalesced=%v err=%v", waiterResult.coalesced, waiterResult.err)
+	}
+
+	close(discoverer.release)
+	leaderResult := <-results
+	if leaderResult.coalesced || leaderResult.err != nil {
+		t.Errorf("expected successful leader run, got coalesced=%v err=%v", leaderResult.coalesced, leaderResult.err)
+	}
+	if runs := discoverer.runs.Load(); runs != 1 {
+		t.Errorf("expected one run, got %d", runs)
+	}
+}
+
+func TestRunCoalescedLeaderErrorReachesWaiters(t *testing.T) {
+	const probes = 3
+	key := "test:coalesced-error"
+	runErr := errors.New("discovery failed")
+	discoverer := newCountingDiscoverer(runErr)
+
+	results := startCoalescedProbes(t, key, discoverer, []context.Context{context.Background(), context.Background(), context.Background()})
+	close(discoverer.release)
+
+	for i := 0; i < probes; i++ {
+		if result := <-results; !errors.Is(result.err, runErr) {
+			t.Errorf("expected error of the run, got %v", result.err)
+		}
+	}
+	if runs := discoverer.runs.Load(); runs != 1 {
+		t.Errorf("expected one run, got %d", runs)
+	}
+}
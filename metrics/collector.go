@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type (
+	// metricListCollector exposes all metrics of a MetricListSnapshot as const metrics, rows are emitted directly
+	// while collecting (no GaugeVec per metric name)
+	metricListCollector struct {
+		// sorted by metric name
+		collectors []*metricRowCollector
+		byName     map[string]*metricRowCollector
+	}
+
+	// metricRowCollector exposes the MetricRows of one metric name as const metrics (with timestamp if enabled)
+	metricRowCollector struct {
+		desc       *prometheus.Desc
+		labelNames []string
+		rows       []MetricRow
+		timestamps bool
+
+		// older rows of the same label set (replaced by a later row)
+		history []MetricRow
+	}
+)
+
+// newMetricListCollector creates the collector for the metrics snapshot
+func newMetricListCollector(list *MetricListSnapshot, timestamps bool) *metricListCollector {
+	collector := metricListCollector{
+		byName: map[string]*metricRowCollector{},
+	}
+
+	for _, metricName := range list.MetricNames() {
+		rowCollector := newMetricRowCollector(
+			metricName,
+			list.MetricHelp(metricName),
+			list.MetricLabelNames(metricName),
+			list.MetricRows(metricName),
+			timestamps,
+		)
+		collector.collectors = append(collector.collectors, rowCollector)
+		collector.byName[metricName] = rowCollector
+	}
+
+	return &collector
+}
+
+func (c *metricListCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+func (c *metricListCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors {
+		collector.Collect(ch)
+	}
+}
+
+// appendHistory adds the older rows of the metric family (if any)
+func (c *metricListCollector) appendHistory(family *dto.MetricFamily) error {
+	if collector, exists := c.byName[family.GetName()]; exists {
+		return collector.appendHistory(family)
+	}
+	return nil
+}
+
+// newMetricRowCollector creates the collector of one metric name (sorted label names), rows without some of the
+// label names are padded with empty label values (rows of one metric can have different labels, eg. resource tags or dimensions)
+func newMetricRowCollector(name, help string, labelNames []string, rows []MetricRow, timestamps bool) *metricRowCollector {
+	collector := metricRowCollector{
+		desc:       prometheus.NewDesc(name, help, labelNames, nil),
+		labelNames: labelNames,
+		timestamps: timestamps,
+	}
+
+	// keep only the last row for each label set (same behaviour as gauge.Set)
+	rowIndex := map[string]int{}
+	for _, row := range rows {
+		key := row.labelKey(collector.labelNames)
+		if i, exists := rowIndex[key]; exists {
+			collector.history = append(collector.history, collector.rows[i])
+			collector.rows[i] = row
+			continue
+		}
+		rowIndex[key] = len(collector.rows)
+		collector.rows = append(collector.rows, row)
+	}
+
+	return &collector
+}
+
+func (c *metricRowCollector) labelValues(row MetricRow) []string {
+	labelValues := make([]string, len(c.labelNames))
+	for i, labelName := range c.labelNames {
+		labelValues[i] = row.Labels[labelName]
+	}
+	return labelValues
+}
+
+func (c *metricRowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *metricRowCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, row := range c.rows {
+		ch <- c.metric(row)
+	}
+}
+
+// metric returns the const metric of the row, invalid rows (eg. label values which are not valid UTF-8)
+// are returned as invalid metric which fails the gather instead of panicking while collecting
+func (c *metricRowCollector) metric(row MetricRow) prometheus.Metric {
+	metric, err := prometheus.NewConstMetric(c.desc, prometheus.GaugeValue, row.Value, c.labelValues(row)...)
+	if err != nil {
+		return prometheus.NewInvalidMetric(c.desc, err)
+	}
+	if c.timestamps && row.Timestamp != nil {
+		metric = prometheus.NewMetricWithTimestamp(*row.Timestamp, metric)
+	}
+	return metric
+}
+
+// appendHistory adds the older rows to the gathered metric family, the registry cannot collect them itself
+// as it rejects multiple metrics with the same label set (even with different timestamps)
+func (c *metricRowCollector) appendHistory(family *dto.MetricFamily) error {
+	history := []*dto.Metric{}
+	for _, row := range c.history {
+		dtoMetric := &dto.Metric{}
+		if err := c.metric(row).Write(dtoMetric); err != nil {
+			return err
+		}
+		history = append(history, dtoMetric)
+	}
+
+	// older samples first
+	family.Metric = append(history, family.Metric...)
+	return nil
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestMetricList creates a list with the metrics and rows (one series per resource)
+func newTestMetricList(metrics, rows int) *MetricList {
+	list := NewMetricList()
+	for i := 0; i < metrics; i++ {
+		name := fmt.Sprintf("azurerm_test_metric_%d", i)
+		for j := 0; j < rows; j++ {
+			list.Add(name, MetricRow{
+				Labels: prometheus.Labels{
+					"resourceID":  fmt.Sprintf("/subscriptions/xxx/resourcegroups/rg/providers/microsoft.cache/redis/resource%d", j),
+					"aggregation": "average",
+				},
+				Value: float64(j),
+			})
+		}
+		list.SetMetricHelp(name, MetricHelpDefault)
+	}
+	return list
+}
+
+func TestMetricListCollectorInvalidRowDoesNotPanic(t *testing.T) {
+	list := NewMetricList()
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "valid"}, Value: 1})
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "invalid \xff"}, Value: 2})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newMetricListCollector(list.Snapshot(), false))
+
+	if _, err := registry.Gather(); err == nil {
+		t.Error("expected gather error for label value with invalid UTF-8")
+	}
+}
+
+func TestMetricListCollectorPadsMissingLabels(t *testing.T) {
+	list := NewMetricList()
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a", "tag_owner": "team"}, Value: 1})
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "b"}, Value: 2})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newMetricListCollector(list.Snapshot(), false))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].GetMetric()) != 2 {
+		t.Fatalf("expected one family with 2 metrics, got %v", families)
+	}
+	for _, metric := range families[0].GetMetric() {
+		if len(metric.GetLabel()) != 2 {
+			t.Errorf("expected 2 labels for each metric, got %v", metric.GetLabel())
+		}
+	}
+}
+
+// BenchmarkPublishGaugeVec publishes the metrics the previous way (one GaugeVec per metric name and probe)
+func BenchmarkPublishGaugeVec(b *testing.B) {
+	list := newTestMetricList(20, 500)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		registry := prometheus.NewRegistry()
+		for _, metricName := range list.GetMetricNames() {
+			gauge := prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: metricName,
+					Help: list.GetMetricHelp(metricName),
+				},
+				list.GetMetricLabelNames(metricName),
+			)
+			registry.MustRegister(gauge)
+
+			for _, row := range list.GetMetricList(metricName) {
+				gauge.With(row.Labels).Set(row.Value)
+			}
+		}
+
+		if _, err := registry.Gather(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublishMetricListCollector publishes the metrics by the streaming collector of the snapshot
+func BenchmarkPublishMetricListCollector(b *testing.B) {
+	snapshot := newTestMetricList(20, 500).Snapshot()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(newMetricListCollector(snapshot, false))
+
+		if _, err := registry.Gather(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
+)
+
+const (
+	DatapointPolicyLast  = "last"
+	DatapointPolicyFirst = "first"
+	DatapointPolicySum   = "sum"
+	DatapointPolicyAvg   = "avg"
+	DatapointPolicyMin   = "min"
+	DatapointPolicyMax   = "max"
+	DatapointPolicyAll   = "all"
+
+	DatapointPolicyDefault = DatapointPolicyLast
+)
+
+type (
+	datapoint struct {
+		Value     float64
+		Timestamp *time.Time
+	}
+
+	datapointAggregation struct {
+		Name  string
+		Value func(data *armmonitor.MetricValue) *float64
+	}
+)
+
+var (
+	// aggregations in the order they are sent to the channel
+	datapointAggregations = []datapointAggregation{
+		{Name: "total", Value: func(data *armmonitor.MetricValue) *float64 { return data.Total }},
+		{Name: "minimum", Value: func(data *armmonitor.MetricValue) *float64 { return data.Minimum }},
+		{Name: "maximum", Value: func(data *armmonitor.MetricValue) *float64 { return data.Maximum }},
+		{Name: "average", Value: func(data *armmonitor.MetricValue) *float64 { return data.Average }},
+		{Name: "count", Value: func(data *armmonitor.MetricValue) *float64 { return data.Count }},
+	}
+)
+
+func validateDatapointPolicy(policy string) error {
+	switch policy {
+	case DatapointPolicyLast, DatapointPolicyFirst, DatapointPolicySum, DatapointPolicyAvg, DatapointPolicyMin, DatapointPolicyMax, DatapointPolicyAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid datapoint policy \"%s\"", policy)
+	}
+}
+
+// applyDatapointPolicy reduces the (non-null) datapoints of one series based on the policy,
+// datapoints are expected in chronological order (as returned by Azure Monitor)
+func applyDatapointPolicy(policy string, datapoints []datapoint) []datapoint {
+	// NaN would win or lose every comparison of min/max and poison sum/avg
+	if slices.ContainsFunc(datapoints, isNaNDatapoint) {
+		datapoints = slices.DeleteFunc(slices.Clone(datapoints), isNaNDatapoint)
+	}
+
+	if len(datapoints) <= 1 {
+		return datapoints
+	}
+
+	first := datapoints[0]
+	last := datapoints[len(datapoints)-1]
+
+	switch policy {
+	case DatapointPolicyAll:
+		return datapoints
+	case DatapointPolicyFirst:
+		return []datapoint{first}
+	case DatapointPolicySum, DatapointPolicyAvg:
+		sum := 0.0
+		for _, row := range datapoints {
+			sum += row.Value
+		}
+		if policy == DatapointPolicyAvg {
+			sum = sum / float64(len(datapoints))
+		}
+		return []datapoint{{Value: sum, Timestamp: last.Timestamp}}
+	case DatapointPolicyMin:
+		ret := first
+		for _, row := range datapoints[1:] {
+			if row.Value < ret.Value {
+				ret = row
+			}
+		}
+		return []datapoint{ret}
+	case DatapointPolicyMax:
+		ret := first
+		for _, row := range datapoints[1:] {
+			if row.Value > ret.Value {
+				ret = row
+			}
+		}
+		return []datapoint{ret}
+	default:
+		return []datapoint{last}
+	}
+}
+
+func isNaNDatapoint(row datapoint) bool {
+	return math.IsNaN(row.Value)
+}
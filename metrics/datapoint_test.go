@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestApplyDatapointPolicy(t *testing.T) {
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := func(minute int) *time.Time {
+		timestamp := baseTime.Add(time.Duration(minute) * time.Minute)
+		return &timestamp
+	}
+
+	series := []datapoint{
+		{Value: 3, Timestamp: ts(0)},
+		{Value: 1, Timestamp: ts(1)},
+		{Value: 5, Timestamp: ts(2)},
+		{Value: 3, Timestamp: ts(3)},
+	}
+	seriesWithNaN := []datapoint{
+		{Value: math.NaN(), Timestamp: ts(0)},
+		{Value: 2, Timestamp: ts(1)},
+		{Value: math.NaN(), Timestamp: ts(2)},
+		{Value: 4, Timestamp: ts(3)},
+		{Value: math.NaN(), Timestamp: ts(4)},
+	}
+
+	testCases := []struct {
+		name       string
+		policy     string
+		datapoints []datapoint
+		expected   []datapoint
+	}{
+		{"last", DatapointPolicyLast, series, []datapoint{{Value: 3, Timestamp: ts(3)}}},
+		{"first", DatapointPolicyFirst, series, []datapoint{{Value: 3, Timestamp: ts(0)}}},
+		{"sum", DatapointPolicySum, series, []datapoint{{Value: 12, Timestamp: ts(3)}}},
+		{"avg", DatapointPolicyAvg, series, []datapoint{{Value: 3, Timestamp: ts(3)}}},
+		{"min", DatapointPolicyMin, series, []datapoint{{Value: 1, Timestamp: ts(1)}}},
+		{"max", DatapointPolicyMax, series, []datapoint{{Value: 5, Timestamp: ts(2)}}},
+		{"all", DatapointPolicyAll, series, series},
+		{"unknown policy uses last", "", series, []datapoint{{Value: 3, Timestamp: ts(3)}}},
+		{"empty series", DatapointPolicyMax, []datapoint{}, []datapoint{}},
+		{"single datapoint", DatapointPolicySum, series[2:3], series[2:3]},
+		{"last without NaN", DatapointPolicyLast, seriesWithNaN, []datapoint{{Value: 4, Timestamp: ts(3)}}},
+		{"first without NaN", DatapointPolicyFirst, seriesWithNaN, []datapoint{{Value: 2, Timestamp: ts(1)}}},
+		{"min without NaN", DatapointPolicyMin, seriesWithNaN, []datapoint{{Value: 2, Timestamp: ts(1)}}},
+		{"max without NaN", DatapointPolicyMax, seriesWithNaN, []datapoint{{Value: 4, Timestamp: ts(3)}}},
+		{"avg without NaN", DatapointPolicyAvg, seriesWithNaN, []datapoint{{Value: 3, Timestamp: ts(3)}}},
+		{"all without NaN", DatapointPolicyAll, seriesWithNaN, []datapoint{{Value: 2, Timestamp: ts(1)}, {Value: 4, Timestamp: ts(3)}}},
+		{"only NaN", DatapointPolicyLast, seriesWithNaN[:1], []datapoint{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			result := applyDatapointPolicy(testCase.policy, testCase.datapoints)
+			if !slices.EqualFunc(result, testCase.expected, func(a, b datapoint) bool {
+				return a.Value == b.Value && a.Timestamp.Equal(*b.Timestamp)
+			}) {
+				t.Errorf("expected %v, got %v", testCase.expected, result)
+			}
+		})
+	}
+
+	// NaN datapoints are removed from a copy, the series of the caller is unchanged
+	if !math.IsNaN(seriesWithNaN[0].Value) || len(seriesWithNaN) != 5 {
+		t.Errorf("series was modified: %v", seriesWithNaN)
+	}
+}
+
+func TestValidateDatapointPolicy(t *testing.T) {
+	for _, policy := range []string{DatapointPolicyLast, DatapointPolicyFirst, DatapointPolicySum, DatapointPolicyAvg, DatapointPolicyMin, DatapointPolicyMax, DatapointPolicyAll} {
+		if err := validateDatapointPolicy(policy); err != nil {
+			t.Errorf("expected valid policy %q, got %v", policy, err)
+		}
+	}
+
+	if err := validateDatapointPolicy("median"); err == nil {
+		t.Error("expected error for invalid policy")
+	}
+}
+
+func TestSendTimeseriesDataSkipsNilDatapoints(t *testing.T) {
+	prober := newTestProber(context.Background())
+	prober.settings.Datapoint = DatapointPolicyAll
+	result := AzureInsightBaseMetricsResult{prober: prober}
+
+	data := []*armmonitor.MetricValue{
+		{Average: to.Float64Ptr(1)},
+		{},
+		nil,
+		{Average: to.Float64Ptr(2), Maximum: to.Float64Ptr(3)},
+	}
+
+	metricsChannel := make(chan PrometheusMetricResult, 10)
+	result.sendTimeseriesDataToChannel(metricsChannel, prometheus.Labels{}, data)
+	close(metricsChannel)
+
+	values := map[string][]float64{}
+	for metric := range metricsChannel {
+		values[metric.Labels["aggregation"]] = append(values[metric.Labels["aggregation"]], metric.Value)
+	}
+
+	if !slices.Equal(values["average"], []float64{1, 2}) || !slices.Equal(values["maximum"], []float64{3}) || len(values) != 2 {
+		t.Errorf("expected only datapoints with values, got %v", values)
+	}
+}
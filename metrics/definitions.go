@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	MetricDefinitionInfoName = "azurerm_resource_metric_definition_info"
+)
+
+type (
+	MetricDefinitionList struct {
+		ResourceID string             `json:"resourceID"`
+		Metrics    []MetricDefinition `json:"metrics"`
+	}
+
+	// metricQuery is one set of metrics with the same aggregations (one request per 20 metrics)
+	metricQuery struct {
+		Metrics      []string
+		Aggregations []string
+	}
+
+	MetricDefinition struct {
+		Name               string   `json:"name"`
+		Namespace          string   `json:"namespace"`
+		Description        string   `json:"description"`
+		Unit               string   `json:"unit"`
+		PrimaryAggregation string   `json:"primaryAggregation"`
+		Aggregations       []string `json:"aggregations"`
+		TimeGrains         []string `json:"timeGrains"`
+		Dimensions         []string `json:"dimensions"`
+	}
+)
+
+func (p *MetricProber) MetricDefinitionsClient(subscriptionId string) (*armmonitor.MetricDefinitionsClient, error) {
+	return armmonitor.NewMetricDefinitionsClient(subscriptionId, p.azureCred(), p.armClientOptions())
+}
+
+// FetchMetricDefinitions fetches the metric definitions of a resource (using the metricNamespace of the request)
+func (p *MetricProber) FetchMetricDefinitions(resourceId string) (*MetricDefinitionList, error) {
+	ret := MetricDefinitionList{
+		ResourceID: resourceId,
+		Metrics:    []MetricDefinition{},
+	}
+
+	azureResource, err := armclient.ParseResourceId(resourceId)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.MetricDefinitionsClient(azureResource.Subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := armmonitor.MetricDefinitionsClientListOptions{}
+	if len(p.settings.MetricNamespace) >= 1 {
+		opts.Metricnamespace = to.StringPtr(p.settings.MetricNamespace)
+	}
+
+	pager := client.NewListPager(p.metricResourceURI(resourceId), &opts)
+	for pager.More() {
+		result, err := pager.NextPage(p.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range result.Value {
+			definition := MetricDefinition{
+				Namespace:    to.String(row.Namespace),
+				Description:  to.String(row.DisplayDescription),
+				Aggregations: []string{},
+				TimeGrains:   []string{},
+				Dimensions:   []string{},
+			}
+
+			if row.Name != nil {
+				definition.Name = to.String(row.Name.Value)
+			}
+
+			if row.Unit != nil {
+				definition.Unit = string(*row.Unit)
+			}
+
+			if row.PrimaryAggregationType != nil {
+				definition.PrimaryAggregation = strings.ToLower(string(*row.PrimaryAggregationType))
+			}
+
+			for _, aggregation := range row.SupportedAggregationTypes {
+				if aggregation != nil {
+					definition.Aggregations = append(definition.Aggregations, strings.ToLower(string(*aggregation)))
+				}
+			}
+
+			for _, availability := range row.MetricAvailabilities {
+				if availability != nil && availability.TimeGrain != nil {
+					definition.TimeGrains = append(definition.TimeGrains, to.String(availability.TimeGrain))
+				}
+			}
+
+			for _, dimension := range row.Dimensions {
+				if dimension != nil {
+					definition.Dimensions = append(definition.Dimensions, to.String(dimension.Value))
+				}
+			}
+
+			ret.Metrics = append(ret.Metrics, definition)
+		}
+	}
+
+	return &ret, nil
+}
+
+// PublishMetricDefinitions publishes the metric definitions as info metric
+func (p *MetricProber) PublishMetricDefinitions(definitionList *MetricDefinitionList) {
+	resourceType := ""
+	if azureResource, err := armclient.ParseResourceId(definitionList.ResourceID); err == nil {
+		resourceType = strings.TrimPrefix(azureResource.ResourceProvider(), "/")
+	}
+
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: MetricDefinitionInfoName,
+			Help: "Azure monitor metric definition",
+		},
+		[]string{
+			"resourceID",
+			"resourceType",
+			"metric",
+			"metricNamespace",
+			"unit",
+			"primaryAggregation",
+			"aggregations",
+			"timeGrains",
+			"dimensions",
+		},
+	)
+	p.prometheus.registry.MustRegister(gauge)
+
+	for _, definition := range definitionList.Metrics {
+		gauge.With(prometheus.Labels{
+			"resourceID":         strings.ToLower(definitionList.ResourceID),
+			"resourceType":       resourceType,
+			"metric":             definition.Name,
+			"metricNamespace":    definition.Namespace,
+			"unit":               definition.Unit,
+			"primaryAggregation": definition.PrimaryAggregation,
+			"aggregations":       strings.Join(definition.Aggregations, ","),
+			"timeGrains":         strings.Join(definition.TimeGrains, ","),
+			"dimensions":         strings.Join(definition.Dimensions, ","),
+		}).Set(1)
+	}
+}
+
+// IsMetricNamePattern checks if the metric name is a wildcard (glob with "*" and "?") or a regexp ("/regex/")
+func IsMetricNamePattern(name string) bool {
+	return (len(name) >= 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/")) || strings.ContainsAny(name, "*?")
+}
+
+// metricNamePatternRegexp compiles a metric name pattern to a case insensitive regexp
+func metricNamePatternRegexp(name string) (*regexp.Regexp, error) {
+	if len(name) >= 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/") {
+		return regexp.Compile("(?i)^(?:" + name[1:len(name)-1] + ")$")
+	}
+
+	pattern := regexp.QuoteMeta(name)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.Compile("(?i)^" + pattern + "$")
+}
+
+func hasMetricNamePatterns(metrics []string) bool {
+	for _, metric := range metrics {
+		if IsMetricNamePattern(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateMetricNamePatterns(metrics []string) error {
+	for _, metric := range metrics {
+		if IsMetricNamePattern(metric) {
+			if _, err := metricNamePatternRegexp(metric); err != nil {
+				return fmt.Errorf("invalid metric pattern \"%s\": %w", metric, err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildMetricQueries expands metric name patterns using the metric definitions of the target,
+// without aggregations each metric of a request with patterns is requested with its primary aggregation.
+// Requests without patterns don't fetch definitions (Azure uses the default aggregation of the metrics)
+func (p *MetricProber) buildMetricQueries(target MetricProbeTarget) ([]metricQuery, error) {
+	if !hasMetricNamePatterns(target.Metrics) {
+		return []metricQuery{{Metrics: target.Metrics, Aggregations: target.Aggregations}}, nil
+	}
+
+	definitionList, err := p.fetchMetricDefinitionsCached(target.ResourceId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch metric definitions: %w", err)
+	}
+
+	return expandMetricQueries(target, definitionList)
+}
+
+// expandMetricQueries expands the metric name patterns of the target and groups the metrics by aggregation
+func expandMetricQueries(target MetricProbeTarget, definitionList *MetricDefinitionList) ([]metricQuery, error) {
+	metricList := []string{}
+	uniqueMetrics := map[string]bool{}
+	addMetric := func(metric string) {
+		if _, exists := uniqueMetrics[strings.ToLower(metric)]; !exists {
+			uniqueMetrics[strings.ToLower(metric)] = true
+			metricList = append(metricList, metric)
+		}
+	}
+
+	for _, metric := range target.Metrics {
+		if !IsMetricNamePattern(metric) {
+			addMetric(metric)
+			continue
+		}
+
+		metricRegexp, err := metricNamePatternRegexp(metric)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric pattern \"%s\": %w", metric, err)
+		}
+
+		for _, definition := range definitionList.Metrics {
+			if metricRegexp.MatchString(definition.Name) {
+				addMetric(definition.Name)
+			}
+		}
+	}
+
+	if len(target.Aggregations) >= 1 {
+		return []metricQuery{{Metrics: metricList, Aggregations: target.Aggregations}}, nil
+	}
+
+	// group metrics by primary aggregation
+	primaryAggregations := map[string]string{}
+	for _, definition := range definitionList.Metrics {
+		primaryAggregations[strings.ToLower(definition.Name)] = definition.PrimaryAggregation
+	}
+
+	queryList := []metricQuery{}
+	queryIndex := map[string]int{}
+	for _, metric := range metricList {
+		aggregation := primaryAggregations[strings.ToLower(metric)]
+		if i, exists := queryIndex[aggregation]; exists {
+			queryList[i].Metrics = append(queryList[i].Metrics, metric)
+			continue
+		}
+
+		query := metricQuery{Metrics: []string{metric}}
+		if aggregation != "" {
+			query.Aggregations = []string{aggregation}
+		}
+		queryIndex[aggregation] = len(queryList)
+		queryList = append(queryList, query)
+	}
+
+	return queryList, nil
+}
+
+// fetchMetricDefinitionsCached fetches the metric definitions of a resource, definitions are cached per
+// resource and metric namespace (using the servicediscovery cache), resources of the same type can expose
+// different metrics (eg. by SKU or tier)
+func (p *MetricProber) fetchMetricDefinitionsCached(resourceId string) (*MetricDefinitionList, error) {
+	cache := p.serviceDiscoveryCache.cache
+	cacheKey := fmt.Sprintf("definitions:%s:%s", strings.ToLower(resourceId), strings.ToLower(p.settings.MetricNamespace))
+
+	if cache != nil {
+		if cacheData, ok, err := cache.Get(cacheKey); err != nil {
+			p.logger.Warnf("unable to fetch metric definitions from cache: %v", err)
+		} else if ok {
+			definitionList := MetricDefinitionList{}
+			if err := json.Unmarshal(cacheData, &definitionList); err == nil {
+				p.logger.Debugf("using metric definitions from cache")
+				return &definitionList, nil
+			}
+			p.logger.Debug("unable to parse cached metric definitions")
+		}
+	}
+
+	definitionList, err := p.FetchMetricDefinitions(resourceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if cacheData, err := json.Marshal(definitionList); err == nil {
+			if err := cache.Set(cacheKey, cacheData, *p.serviceDiscoveryCache.cacheDuration); err != nil {
+				p.logger.Warnf("unable to save metric definitions to cache: %v", err)
+			}
+		}
+	}
+
+	return definitionList, nil
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingCache counts the lookups of the wrapped cache
+type countingCache struct {
+	Cache
+	gets int
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool, error) {
+	c.gets++
+	return c.Cache.Get(key)
+}
+
+var testMetricDefinitions = MetricDefinitionList{
+	ResourceID: "/subscriptions/xxx/resourceGroups/example/providers/Microsoft.KeyVault/vaults/example",
+	Metrics: []MetricDefinition{
+		{Name: "ServiceApiHit", PrimaryAggregation: "count"},
+		{Name: "ServiceApiLatency", PrimaryAggregation: "average"},
+		{Name: "ServiceApiResult", PrimaryAggregation: "count"},
+		{Name: "Availability", PrimaryAggregation: "average"},
+		{Name: "SaturationShoebox", PrimaryAggregation: "average"},
+		{Name: "Http5xx", PrimaryAggregation: "total"},
+	},
+}
+
+func TestIsMetricNamePattern(t *testing.T) {
+	testCases := map[string]bool{
+		"Availability":     false,
+		"Percentage CPU":   false,
+		"*":                true,
+		"ServiceApi*":      true,
+		"Http?xx":          true,
+		"/^service.*/":     true,
+		"/":                false,
+		"//":               true,
+		"/subscriptions/x": false,
+	}
+
+	for name, expected := range testCases {
+		if result := IsMetricNamePattern(name); result != expected {
+			t.Errorf("IsMetricNamePattern(%q): expected %v, got %v", name, expected, result)
+		}
+	}
+}
+
+func TestMetricNamePatternRegexp(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		matches  []string
+		excludes []string
+	}{
+		{"*", []string{"Availability", "ServiceApiHit", ""}, nil},
+		{"ServiceApi*", []string{"ServiceApiHit", "serviceapilatency", "ServiceApi"}, []string{"Availability", "XServiceApiHit"}},
+		{"Http?xx", []string{"Http5xx", "http4XX"}, []string{"Httpxx", "Http50xx"}},
+		{"Saturation.Shoebox", []string{"Saturation.Shoebox"}, []string{"SaturationXShoebox"}},
+		{"/^service(apihit|apiresult)$/", []string{"ServiceApiHit", "ServiceApiResult"}, []string{"ServiceApiLatency"}},
+		{"/api/", []string{"api", "API"}, []string{"ServiceApiHit"}},
+		{"/hit|latency/", []string{"Hit", "latency"}, []string{"ServiceApiHit"}},
+	}
+
+	for _, testCase := range testCases {
+		metricRegexp, err := metricNamePatternRegexp(testCase.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.pattern, err)
+		}
+
+		for _, name := range testCase.matches {
+			if !metricRegexp.MatchString(name) {
+				t.Errorf("pattern %q must match %q", testCase.pattern, name)
+			}
+		}
+		for _, name := range testCase.excludes {
+			if metricRegexp.MatchString(name) {
+				t.Errorf("pattern %q must not match %q", testCase.pattern, name)
+			}
+		}
+	}
+}
+
+func TestValidateMetricNamePatterns(t *testing.T) {
+	if err := validateMetricNamePatterns([]string{"Availability", "ServiceApi*", "/^http.*/"}); err != nil {
+		t.Errorf("expected valid patterns, got %v", err)
+	}
+	if err := validateMetricNamePatterns([]string{"Availability", "/^(http/"}); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
+
+func TestExpandMetricQueries(t *testing.T) {
+	testCases := []struct {
+		name         string
+		metrics      []string
+		aggregations []string
+		expected     []metricQuery
+	}{
+		{
+			name:         "wildcard with aggregations",
+			metrics:      []string{"ServiceApi*"},
+			aggregations: []string{"total"},
+			expected:     []metricQuery{{Metrics: []string{"ServiceApiHit", "ServiceApiLatency", "ServiceApiResult"}, Aggregations: []string{"total"}}},
+		},
+		{
+			name:    "wildcard grouped by primary aggregation",
+			metrics: []string{"ServiceApi*"},
+			expected: []metricQuery{
+				{Metrics: []string{"ServiceApiHit", "ServiceApiResult"}, Aggregations: []string{"count"}},
+				{Metrics: []string{"ServiceApiLatency"}, Aggregations: []string{"average"}},
+			},
+		},
+		{
+			name:    "listed metrics and patterns without duplicates",
+			metrics: []string{"availability", "/^(availability|http5xx)$/", "Unknown"},
+			expected: []metricQuery{
+				{Metrics: []string{"availability"}, Aggregations: []string{"average"}},
+				{Metrics: []string{"Http5xx"}, Aggregations: []string{"total"}},
+				// metrics without definition use the default aggregation of Azure
+				{Metrics: []string{"Unknown"}},
+			},
+		},
+		{
+			name:     "pattern without match",
+			metrics:  []string{"Cpu*"},
+			expected: []metricQuery{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			target := MetricProbeTarget{Metrics: testCase.metrics, Aggregations: testCase.aggregations}
+			queryList, err := expandMetricQueries(target, &testMetricDefinitions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.EqualFunc(queryList, testCase.expected, func(a, b metricQuery) bool {
+				return slices.Equal(a.Metrics, b.Metrics) && slices.Equal(a.Aggregations, b.Aggregations)
+			}) {
+				t.Errorf("expected queries %v, got %v", testCase.expected, queryList)
+			}
+		})
+	}
+}
+
+func TestBuildMetricQueriesFetchesDefinitionsOnlyForPatterns(t *testing.T) {
+	cacheDuration := time.Minute
+	cache := &countingCache{Cache: NewMemoryCache(MemoryCacheConfig{})}
+	defer cache.Close() // nolint:errcheck
+
+	definitionData, err := json.Marshal(testMetricDefinitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheKey := fmt.Sprintf("definitions:%s:", strings.ToLower(testMetricDefinitions.ResourceID))
+	if err := cache.Set(cacheKey, definitionData, cacheDuration); err != nil {
+		t.Fatal(err)
+	}
+
+	prober := newTestProber(context.Background())
+	prober.EnableServiceDiscoveryCache(cache, &cacheDuration)
+
+	// listed metrics without aggregation are requested as they are (Azure picks the default aggregation)
+	target := MetricProbeTarget{ResourceId: testMetricDefinitions.ResourceID, Metrics: []string{"Availability", "ServiceApiHit"}}
+	queryList, err := prober.buildMetricQueries(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryList) != 1 || !slices.Equal(queryList[0].Metrics, target.Metrics) || len(queryList[0].Aggregations) != 0 {
+		t.Errorf("expected one query of the listed metrics, got %v", queryList)
+	}
+	if cache.gets != 0 {
+		t.Errorf("expected no metric definitions lookup without patterns, got %d", cache.gets)
+	}
+
+	target.Metrics = []string{"Availability", "Http*"}
+	queryList, err = prober.buildMetricQueries(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryList) != 2 || cache.gets != 1 {
+		t.Errorf("expected queries by primary aggregation using the cached definitions, got %v (%d lookups)", queryList, cache.gets)
+	}
+}
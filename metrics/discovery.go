@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+)
+
+type (
+	// TargetDiscoverer finds the targets of a probe and adds them to the prober
+	TargetDiscoverer interface {
+		DiscoverTargets(ctx context.Context, prober *MetricProber) error
+	}
+
+	// StaticTargetDiscoverer uses a fixed list of resource ids as targets
+	StaticTargetDiscoverer struct {
+		ResourceIds []string
+	}
+
+	// ResourceFilterDiscoverer finds targets using the resources API ($filter)
+	ResourceFilterDiscoverer struct{}
+
+	// ScrapeTagDiscoverer finds targets using the resources API ($filter), metrics and
+	// aggregations are configured by resource tags
+	ScrapeTagDiscoverer struct {
+		MetricTagName      string
+		AggregationTagName string
+	}
+
+	// ResourceGraphDiscoverer finds targets using a Kusto query and the ResourceGraph API
+	ResourceGraphDiscoverer struct {
+		ResourceType string
+	}
+)
+
+func (d StaticTargetDiscoverer) DiscoverTargets(ctx context.Context, prober *MetricProber) error {
+	targetList := []MetricProbeTarget{}
+	for _, resourceId := range d.ResourceIds {
+		targetList = append(
+			targetList,
+			MetricProbeTarget{
+				ResourceId:   resourceId,
+				Metrics:      prober.settings.Metrics,
+				Aggregations: prober.settings.Aggregations,
+			},
+		)
+	}
+	prober.AddTarget(targetList...)
+	return nil
+}
+
+func (d ResourceFilterDiscoverer) DiscoverTargets(ctx context.Context, prober *MetricProber) error {
+	for _, subscription := range prober.settings.Subscriptions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		prober.ServiceDiscovery.FindSubscriptionResources(ctx, subscription, prober.settings.Filter)
+	}
+	return nil
+}
+
+func (d ScrapeTagDiscoverer) DiscoverTargets(ctx context.Context, prober *MetricProber) error {
+	for _, subscription := range prober.settings.Subscriptions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		prober.ServiceDiscovery.FindSubscriptionResourcesWithScrapeTags(ctx, subscription, prober.settings.Filter, d.MetricTagName, d.AggregationTagName)
+	}
+	return nil
+}
+
+func (d ResourceGraphDiscoverer) DiscoverTargets(ctx context.Context, prober *MetricProber) error {
+	return prober.ServiceDiscovery.FindResourceGraph(ctx, prober.settings.Subscriptions, d.ResourceType, prober.settings.Filter)
+}
@@ -0,0 +1,369 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
+	iso8601 "github.com/channelmeter/iso8601duration"
+	"github.com/remeh/sizedwaitgroup"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/azuresdk/cloudconfig"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	AzureMetricBatchApiVersion           = "2023-10-01"
+	AzureMetricBatchApiMaxResourceNumber = 50
+
+	MetricApiArm   = "arm"
+	MetricApiBatch = "batch"
+)
+
+type (
+	// MetricsBatchClient queries the Azure Monitor data plane (metrics:getBatch) for multiple resources at once
+	MetricsBatchClient struct {
+		pipeline       runtime.Pipeline
+		endpointSuffix string
+	}
+
+	MetricsBatchQueryOptions struct {
+		Timespan        string
+		Interval        *string
+		Metricnamespace string
+		Metricnames     []string
+		Aggregations    []string
+		Top             *int32
+		Filter          string
+		Orderby         string
+	}
+
+	metricsBatchRequest struct {
+		ResourceIds []string `json:"resourceids"`
+	}
+
+	metricsBatchResponse struct {
+		Values []metricsBatchResponseValue `json:"values"`
+	}
+
+	metricsBatchResponseValue struct {
+		ResourceId     string               `json:"resourceid"`
+		ResourceRegion string               `json:"resourceregion"`
+		Namespace      string               `json:"namespace"`
+		Value          []*armmonitor.Metric `json:"value"`
+	}
+
+	// metricsBatchGroup contains all targets which can be queried with one batch request
+	// (same subscription, region, resource type and metrics)
+	metricsBatchGroup struct {
+		SubscriptionId string
+		Region         string
+		ResourceType   string
+		Query          metricQuery
+		Targets        []MetricProbeTarget
+	}
+)
+
+func validateMetricApi(api string) error {
+	switch api {
+	case MetricApiArm, MetricApiBatch:
+		return nil
+	default:
+		return fmt.Errorf("invalid metric api \"%s\" (must be \"%s\" or \"%s\")", api, MetricApiArm, MetricApiBatch)
+	}
+}
+
+func (p *MetricProber) MetricsBatchClient() (*MetricsBatchClient, error) {
+	endpointSuffix := p.Conf.Azure.MetricsBatchEndpoint
+	if endpointSuffix == "" {
+		switch p.AzureClient.GetCloudName() {
+		case cloudconfig.AzurePublicCloud:
+			endpointSuffix = "metrics.monitor.azure.com"
+		case cloudconfig.AzureChinaCloud:
+			endpointSuffix = "metrics.monitor.azure.cn"
+		case cloudconfig.AzureGovernmentCloud:
+			endpointSuffix = "metrics.monitor.azure.us"
+		default:
+			return nil, fmt.Errorf("no metrics batch endpoint known for cloud \"%s\", please set it explicitly", p.AzureClient.GetCloudName())
+		}
+	}
+
+	clientOpts := p.AzureClient.NewAzCoreClientOptions()
+	if p.azureTransport != nil {
+		clientOpts.Transport = p.azureTransport
+	}
+	clientOpts.PerCallPolicies = append(
+		clientOpts.PerCallPolicies,
+		noCachePolicy{},
+	)
+	if p.RetryPolicy != nil {
+		p.RetryPolicy.Apply(clientOpts)
+	}
+	if p.RequestLimiter != nil {
+		clientOpts.PerRetryPolicies = append(
+			clientOpts.PerRetryPolicies,
+			p.RequestLimiter.Policy(),
+		)
+	}
+
+	scope := fmt.Sprintf("https://%s/.default", endpointSuffix)
+	pipeline := runtime.NewPipeline(
+		"azure-metrics-exporter",
+		"batch",
+		runtime.PipelineOptions{
+			PerRetry: []policy.Policy{
+				runtime.NewBearerTokenPolicy(p.azureCred(), []string{scope}, nil),
+			},
+		},
+		clientOpts,
+	)
+
+	return &MetricsBatchClient{
+		pipeline:       pipeline,
+		endpointSuffix: endpointSuffix,
+	}, nil
+}
+
+// QueryResources queries the metrics of up to 50 resources (same subscription, region and resource type)
+func (c *MetricsBatchClient) QueryResources(ctx context.Context, subscriptionId, region string, resourceIds []string, opts MetricsBatchQueryOptions) ([]metricsBatchResponseValue, error) {
+	startTime, endTime, err := metricsBatchTimeRange(opts.Timespan, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("api-version", AzureMetricBatchApiVersion)
+	query.Set("starttime", startTime)
+	query.Set("endtime", endTime)
+	query.Set("metricnamespace", opts.Metricnamespace)
+	query.Set("metricnames", strings.Join(opts.Metricnames, ","))
+	if opts.Interval != nil {
+		query.Set("interval", *opts.Interval)
+	}
+	if len(opts.Aggregations) >= 1 {
+		query.Set("aggregation", strings.Join(opts.Aggregations, ","))
+	}
+	if opts.Top != nil {
+		query.Set("top", fmt.Sprintf("%d", *opts.Top))
+	}
+	if opts.Filter != "" {
+		query.Set("filter", opts.Filter)
+	}
+	if opts.Orderby != "" {
+		query.Set("orderby", opts.Orderby)
+	}
+
+	endpoint := fmt.Sprintf(
+		"https://%s.%s/subscriptions/%s/metrics:getBatch?%s",
+		url.PathEscape(strings.ToLower(region)),
+		c.endpointSuffix,
+		url.PathEscape(subscriptionId),
+		query.Encode(),
+	)
+
+	req, err := runtime.NewRequest(ctx, http.MethodPost, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runtime.MarshalAsJSON(req, metricsBatchRequest{ResourceIds: resourceIds}); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.pipeline.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, runtime.NewResponseError(resp)
+	}
+
+	result := metricsBatchResponse{}
+	if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Values, nil
+}
+
+// metricsBatchTimeRange converts the timespan (ISO8601 duration or start/end) to start and end time,
+// the batch api doesn't support timespans
+func metricsBatchTimeRange(timespan string, now time.Time) (startTime, endTime string, err error) {
+	if start, end, found := strings.Cut(timespan, "/"); found {
+		return start, end, nil
+	}
+
+	duration, err := iso8601.FromString(timespan)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to parse timespan \"%s\": %w", timespan, err)
+	}
+
+	now = now.UTC()
+	return now.Add(-duration.ToDuration()).Format(time.RFC3339), now.Format(time.RFC3339), nil
+}
+
+// buildMetricsBatchGroups groups the targets by subscription, region, resource type and metrics,
+// targets without region cannot be queried by the batch api and are returned separately
+func (p *MetricProber) buildMetricsBatchGroups(subscriptionId string, targetList []MetricProbeTarget) (groupList []*metricsBatchGroup, armTargetList []MetricProbeTarget) {
+	groupIndex := map[string]*metricsBatchGroup{}
+
+	batchTargetList := []MetricProbeTarget{}
+	for _, target := range targetList {
+		if target.Location == "" {
+			armTargetList = append(armTargetList, target)
+			continue
+		}
+		batchTargetList = append(batchTargetList, target)
+	}
+
+	// metric patterns are expanded by the definitions of each resource, fetched in parallel
+	queryLists := make([][]metricQuery, len(batchTargetList))
+	wgTargets := sizedwaitgroup.New(p.Conf.Prober.ConcurrencySubscriptionResource)
+	for i, target := range batchTargetList {
+		// probe is gone or timed out, don't start any further requests
+		if err := p.ctx.Err(); err != nil {
+			p.reportTargetError(subscriptionId, target, ProbeErrorReasonQuery, err)
+			continue
+		}
+
+		wgTargets.Add()
+		go func(i int, target MetricProbeTarget) {
+			defer wgTargets.Done()
+
+			queryList, err := p.buildMetricQueries(target)
+			if err != nil {
+				p.reportTargetError(subscriptionId, target, ProbeErrorReasonQuery, err)
+				return
+			}
+			queryLists[i] = queryList
+		}(i, target)
+	}
+	wgTargets.Wait()
+
+	for i, target := range batchTargetList {
+		if queryLists[i] == nil {
+			continue
+		}
+
+		azureResource, err := armclient.ParseResourceId(target.ResourceId)
+		if err != nil {
+			p.reportTargetError(subscriptionId, target, ProbeErrorReasonQuery, fmt.Errorf("unable to parse resource id: %w", err))
+			continue
+		}
+
+		resourceType := strings.TrimPrefix(azureResource.ResourceProvider(), "/")
+		for _, query := range queryLists[i] {
+			groupKey := strings.ToLower(strings.Join(
+				[]string{
+					azureResource.Subscription,
+					target.Location,
+					resourceType,
+					strings.Join(query.Metrics, ","),
+					strings.Join(query.Aggregations, ","),
+				},
+				"|",
+			))
+
+			if _, exists := groupIndex[groupKey]; !exists {
+				group := &metricsBatchGroup{
+					SubscriptionId: azureResource.Subscription,
+					Region:         target.Location,
+					ResourceType:   resourceType,
+					Query:          query,
+				}
+				groupIndex[groupKey] = group
+				groupList = append(groupList, group)
+			}
+			groupIndex[groupKey].Targets = append(groupIndex[groupKey].Targets, target)
+		}
+	}
+
+	return
+}
+
+// FetchMetricsBatch queries the metrics of all targets of the group (in chunks of 50 resources and 20 metrics)
+func (p *MetricProber) FetchMetricsBatch(client *MetricsBatchClient, group *metricsBatchGroup, channel chan<- PrometheusMetricResult) error {
+	metricNamespace := p.settings.MetricNamespace
+	if metricNamespace == "" {
+		metricNamespace = group.ResourceType
+	}
+
+	// results are returned by the resource uri (eg. storage sub namespaces use <account>/blobServices/default)
+	targetIndex := map[string]MetricProbeTarget{}
+	for _, target := range group.Targets {
+		targetIndex[strings.ToLower(target.ResourceId)] = target
+		targetIndex[strings.ToLower(p.metricResourceURI(target.ResourceId))] = target
+	}
+
+	for i := 0; i < len(group.Targets); i += AzureMetricBatchApiMaxResourceNumber {
+		end := i + AzureMetricBatchApiMaxResourceNumber
+		if end > len(group.Targets) {
+			end = len(group.Targets)
+		}
+
+		resourceIds := []string{}
+		for _, target := range group.Targets[i:end] {
+			resourceIds = append(resourceIds, p.metricResourceURI(target.ResourceId))
+		}
+
+		// request metrics in 20 metrics chunks (azure metric api limitation)
+		for j := 0; j < len(group.Query.Metrics); j += AzureMetricApiMaxMetricNumber {
+			metricEnd := j + AzureMetricApiMaxMetricNumber
+			if metricEnd > len(group.Query.Metrics) {
+				metricEnd = len(group.Query.Metrics)
+			}
+
+			// probe is gone or timed out, don't start any further requests
+			if err := p.ctx.Err(); err != nil {
+				return err
+			}
+
+			opts := MetricsBatchQueryOptions{
+				Timespan:        p.settings.Timespan,
+				Interval:        p.settings.Interval,
+				Metricnamespace: metricNamespace,
+				Metricnames:     group.Query.Metrics[j:metricEnd],
+				Aggregations:    group.Query.Aggregations,
+				Top:             p.settings.MetricTop,
+				Filter:          p.settings.MetricFilter,
+				Orderby:         p.settings.MetricOrderBy,
+			}
+
+			values, err := client.QueryResources(p.ctx, group.SubscriptionId, group.Region, resourceIds, opts)
+			if err != nil {
+				return err
+			}
+
+			for _, value := range values {
+				target, exists := targetIndex[strings.ToLower(value.ResourceId)]
+				if !exists {
+					target = MetricProbeTarget{ResourceId: value.ResourceId}
+				}
+
+				result := AzureInsightMetricsResult{
+					AzureInsightBaseMetricsResult: AzureInsightBaseMetricsResult{
+						prober: p,
+					},
+					target: &target,
+					Result: &armmonitor.MetricsClientListResponse{
+						Response: armmonitor.Response{
+							Value:    value.Value,
+							Interval: p.settings.Interval,
+							Timespan: to.StringPtr(p.settings.Timespan),
+						},
+					},
+				}
+				result.SendMetricToChannel(channel)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsBatchTimeRange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	testCases := []struct {
+		timespan  string
+		startTime string
+		endTime   string
+		valid     bool
+	}{
+		{"PT1M", "2024-01-01T10:59:00Z", "2024-01-01T11:00:00Z", true},
+		{"PT1H", "2024-01-01T10:00:00Z", "2024-01-01T11:00:00Z", true},
+		{"P1D", "2023-12-31T11:00:00Z", "2024-01-01T11:00:00Z", true},
+		{"2024-01-01T00:00:00Z/2024-01-01T01:00:00Z", "2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z", true},
+		{"1h", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, testCase := range testCases {
+		startTime, endTime, err := metricsBatchTimeRange(testCase.timespan, now)
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("%q: expected error for invalid timespan", testCase.timespan)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", testCase.timespan, err)
+			continue
+		}
+		if startTime != testCase.startTime || endTime != testCase.endTime {
+			t.Errorf("%q: expected %s/%s, got %s/%s", testCase.timespan, testCase.startTime, testCase.endTime, startTime, endTime)
+		}
+	}
+}
+
+func TestBuildMetricsBatchGroups(t *testing.T) {
+	prober := newTestProber(context.Background())
+
+	vaultMetrics := []string{"Availability", "ServiceApiHit"}
+	targetList := []MetricProbeTarget{
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 1), Location: "westeurope", Metrics: vaultMetrics},
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 2), Location: "westeurope", Metrics: vaultMetrics},
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 3), Location: "northeurope", Metrics: vaultMetrics},
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 4), Location: "westeurope", Metrics: []string{"Availability"}},
+		{ResourceId: testResourceId("Microsoft.Storage/storageAccounts", 1), Location: "westeurope", Metrics: []string{"Availability"}},
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 5), Metrics: vaultMetrics},
+	}
+
+	groupList, armTargetList := prober.buildMetricsBatchGroups(testSubscriptionId, targetList)
+
+	if len(armTargetList) != 1 || armTargetList[0].ResourceId != targetList[5].ResourceId {
+		t.Errorf("expected target without region to use the arm api, got %v", armTargetList)
+	}
+
+	type groupSummary struct {
+		region       string
+		resourceType string
+		metrics      string
+		targets      int
+	}
+	expected := []groupSummary{
+		{"westeurope", "microsoft.keyvault/vaults", "Availability,ServiceApiHit", 2},
+		{"northeurope", "microsoft.keyvault/vaults", "Availability,ServiceApiHit", 1},
+		{"westeurope", "microsoft.keyvault/vaults", "Availability", 1},
+		{"westeurope", "microsoft.storage/storageaccounts", "Availability", 1},
+	}
+
+	summary := []groupSummary{}
+	for _, group := range groupList {
+		if group.SubscriptionId != testSubscriptionId {
+			t.Errorf("unexpected subscription %s", group.SubscriptionId)
+		}
+		summary = append(summary, groupSummary{group.Region, group.ResourceType, strings.Join(group.Query.Metrics, ","), len(group.Targets)})
+	}
+
+	if !slices.Equal(summary, expected) {
+		t.Errorf("expected groups %v, got %v", expected, summary)
+	}
+}
+
+func TestBuildMetricsBatchGroupsStopsAfterDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	prober := newTestProber(ctx)
+	targetList := []MetricProbeTarget{
+		{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 1), Location: "westeurope", Metrics: []string{"*"}},
+	}
+
+	groupList, _ := prober.buildMetricsBatchGroups(testSubscriptionId, targetList)
+	if len(groupList) != 0 {
+		t.Errorf("expected no groups of a canceled probe, got %d", len(groupList))
+	}
+	if !prober.status.hasErrors() {
+		t.Error("expected error of canceled target")
+	}
+}
+
+func TestFetchMetricsBatchChunks(t *testing.T) {
+	const resources = 120
+
+	transport := &fakeAzureTransport{}
+	prober := newTestAzureProber(context.Background(), transport)
+
+	metrics := []string{}
+	for i := 0; i < 25; i++ {
+		metrics = append(metrics, fmt.Sprintf("metric%d", i))
+	}
+
+	group := &metricsBatchGroup{
+		SubscriptionId: testSubscriptionId,
+		Region:         "westeurope",
+		ResourceType:   "Microsoft.KeyVault/vaults",
+		Query:          metricQuery{Metrics: metrics, Aggregations: []string{"average"}},
+	}
+	for i := 0; i < resources; i++ {
+		group.Targets = append(group.Targets, MetricProbeTarget{ResourceId: testResourceId(group.ResourceType, i), Location: group.Region})
+	}
+
+	client, err := prober.MetricsBatchClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricsChannel := make(chan PrometheusMetricResult, resources*len(metrics))
+	if err := prober.FetchMetricsBatch(client, group, metricsChannel); err != nil {
+		t.Fatal(err)
+	}
+	close(metricsChannel)
+
+	// 3 resource chunks (50, 50, 20) with 2 metric chunks (20, 5) each
+	requests := transport.Requests("metrics:getBatch")
+	if len(requests) != 6 {
+		t.Fatalf("expected 6 batch requests, got %d", len(requests))
+	}
+
+	resourceCounts := []int{}
+	metricCounts := []int{}
+	for _, req := range requests {
+		batchRequest := metricsBatchRequest{}
+		if err := json.Unmarshal(req.Body, &batchRequest); err != nil {
+			t.Fatal(err)
+		}
+		resourceCounts = append(resourceCounts, len(batchRequest.ResourceIds))
+
+		requestUrl, err := url.Parse(req.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(requestUrl.Host, "westeurope.") || requestUrl.Query().Get("metricnamespace") != group.ResourceType {
+			t.Errorf("unexpected batch request %s", req.URL)
+		}
+		metricCounts = append(metricCounts, len(strings.Split(requestUrl.Query().Get("metricnames"), ",")))
+	}
+
+	if expected := []int{50, 50, 50, 50, 20, 20}; !slices.Equal(resourceCounts, expected) {
+		t.Errorf("expected resources per request %v, got %v", expected, resourceCounts)
+	}
+	if expected := []int{20, 5, 20, 5, 20, 5}; !slices.Equal(metricCounts, expected) {
+		t.Errorf("expected metrics per request %v, got %v", expected, metricCounts)
+	}
+
+	if count := len(metricsChannel); count != resources*len(metrics) {
+		t.Errorf("expected %d metrics, got %d", resources*len(metrics), count)
+	}
+}
+
+func TestFetchMetricsBatchStorageNamespace(t *testing.T) {
+	transport := &fakeAzureTransport{}
+	prober := newTestAzureProber(context.Background(), transport)
+	prober.settings.MetricNamespace = "Microsoft.Storage/storageAccounts/blobServices"
+
+	target := MetricProbeTarget{ResourceId: testResourceId("Microsoft.Storage/storageAccounts", 1), Location: "westeurope"}
+	group := &metricsBatchGroup{
+		SubscriptionId: testSubscriptionId,
+		Region:         "westeurope",
+		ResourceType:   "Microsoft.Storage/storageAccounts",
+		Query:          metricQuery{Metrics: []string{"BlobCount"}},
+		Targets:        []MetricProbeTarget{target},
+	}
+
+	client, err := prober.MetricsBatchClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricsChannel := make(chan PrometheusMetricResult, 10)
+	if err := prober.FetchMetricsBatch(client, group, metricsChannel); err != nil {
+		t.Fatal(err)
+	}
+	close(metricsChannel)
+
+	requests := transport.Requests("metrics:getBatch")
+	if len(requests) != 1 {
+		t.Fatalf("expected one batch request, got %d", len(requests))
+	}
+
+	batchRequest := metricsBatchRequest{}
+	if err := json.Unmarshal(requests[0].Body, &batchRequest); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{target.ResourceId + "/blobServices/default"}; !slices.Equal(batchRequest.ResourceIds, expected) {
+		t.Errorf("expected resource uri %v, got %v", expected, batchRequest.ResourceIds)
+	}
+
+	// results of the resource uri belong to the storage account
+	metric, ok := <-metricsChannel
+	if !ok || metric.Labels["resourceID"] != strings.ToLower(target.ResourceId) {
+		t.Errorf("expected metric of the storage account, got %v", metric)
+	}
+}
+
+func TestFetchMetricsBatchStopsAfterDeadline(t *testing.T) {
+	transport := &fakeAzureTransport{}
+	ctx, cancel := context.WithCancel(context.Background())
+	prober := newTestAzureProber(ctx, transport)
+	cancel()
+
+	group := &metricsBatchGroup{
+		SubscriptionId: testSubscriptionId,
+		Region:         "westeurope",
+		ResourceType:   "Microsoft.KeyVault/vaults",
+		Query:          metricQuery{Metrics: []string{"Availability"}},
+		Targets:        []MetricProbeTarget{{ResourceId: testResourceId("Microsoft.KeyVault/vaults", 1)}},
+	}
+
+	client, err := prober.MetricsBatchClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := prober.FetchMetricsBatch(client, group, make(chan PrometheusMetricResult, 10)); err == nil {
+		t.Error("expected error of canceled probe")
+	}
+	if requests := transport.Requests(""); len(requests) != 0 {
+		t.Errorf("expected no requests after the deadline, got %d", len(requests))
+	}
+}
@@ -2,8 +2,11 @@ package metrics
 
 import (
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
 type (
@@ -12,7 +15,9 @@ type (
 	}
 )
 
-func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, value float64) (metric PrometheusMetricResult) {
+// buildMetric builds the metric of the row using the name, help and labels templates, returns false if the
+// metric has no valid name (the name template rendered an invalid name and the default name is invalid too)
+func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, value float64, timestamp *time.Time) (metric PrometheusMetricResult, valid bool) {
 	// copy map to ensure we don't keep references
 	metricLabels := prometheus.Labels{}
 	for labelName, labelValue := range labels {
@@ -20,9 +25,10 @@ func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, va
 	}
 
 	metric = PrometheusMetricResult{
-		Name:   r.prober.settings.MetricTemplate,
-		Labels: metricLabels,
-		Value:  value,
+		Name:      r.prober.settings.MetricTemplate,
+		Labels:    metricLabels,
+		Value:     value,
+		Timestamp: timestamp,
 	}
 
 	// fallback if template is empty (should not be)
@@ -36,9 +42,22 @@ func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, va
 		resourceType = r.prober.settings.MetricNamespace
 	}
 
+	// Go templates get all labels before placeholders are removed
+	templates := r.prober.settings.templates
+	var templateData map[string]string
+	if templates != nil {
+		templateData = metricTemplateData(metric.Labels, r.prober.settings.Name, resourceType)
+	}
+
 	// set help
 	metric.Help = r.prober.settings.HelpTemplate
-	if metricNamePlaceholders.MatchString(metric.Help) {
+	if templates != nil && templates.help != nil {
+		if help, err := templates.renderHelp(templateData); err == nil {
+			metric.Help = help
+		} else {
+			r.prober.logger.Warn(err)
+		}
+	} else if metricNamePlaceholders.MatchString(metric.Help) {
 		metric.Help = metricNamePlaceholders.ReplaceAllStringFunc(
 			metric.Help,
 			func(fieldName string) string {
@@ -58,7 +77,19 @@ func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, va
 		)
 	}
 
-	if metricNamePlaceholders.MatchString(metric.Name) {
+	if templates != nil && templates.name != nil {
+		if name, err := templates.renderName(templateData); err == nil {
+			metric.Name = name
+		} else {
+			r.prober.logger.Warn(err)
+			metric.Name = r.prober.settings.Name
+		}
+
+		// remove labels, when we add them to metric name
+		for fieldName := range templates.nameFields {
+			delete(metric.Labels, fieldName)
+		}
+	} else if metricNamePlaceholders.MatchString(metric.Name) {
 		metric.Name = metricNamePlaceholders.ReplaceAllStringFunc(
 			metric.Name,
 			func(fieldName string) string {
@@ -80,10 +111,65 @@ func (r *AzureInsightBaseMetricsResult) buildMetric(labels prometheus.Labels, va
 		)
 	}
 
-	// sanitize metric name
-	metric.Name = metricNameReplacer.Replace(metric.Name)
-	metric.Name = strings.ToLower(metric.Name)
-	metric.Name = metricNameNotAllowedChars.ReplaceAllString(metric.Name, "")
+	// additional labels of labels template
+	if templates != nil && templates.labels != nil {
+		if labels, err := templates.renderLabels(templateData); err == nil {
+			for labelName, labelValue := range labels {
+				if labelValue == "" {
+					delete(metric.Labels, labelName)
+				} else {
+					metric.Labels[labelName] = labelValue
+				}
+			}
+		} else {
+			r.prober.logger.Warn(err)
+		}
+	}
+
+	metric.Name = sanitizeMetricName(metric.Name)
 
-	return
+	// invalid names (eg. empty output of the name template) would fail the registration of all metrics
+	if !model.IsValidMetricName(model.LabelValue(metric.Name)) {
+		r.prober.logger.Warnf("metric name template returned invalid metric name \"%s\", using \"%s\"", metric.Name, r.prober.settings.Name)
+		r.prober.status.addError(labels["subscriptionID"], ProbeErrorReasonTemplate)
+
+		metric.Name = sanitizeMetricName(r.prober.settings.Name)
+		if !model.IsValidMetricName(model.LabelValue(metric.Name)) {
+			return metric, false
+		}
+	}
+
+	return metric, true
+}
+
+// sanitizeMetricName replaces separators by underscores and removes characters not allowed in metric names
+func sanitizeMetricName(name string) string {
+	name = metricNameReplacer.Replace(name)
+	name = strings.ToLower(name)
+	return metricNameNotAllowedChars.ReplaceAllString(name, "")
+}
+
+// sendTimeseriesDataToChannel sends the datapoints of one timeseries for each aggregation,
+// multiple datapoints of the same series are reduced by the datapoint policy.
+// The channel is drained until it's closed (see addMetricsFromChannel), so already fetched
+// datapoints are always sent, even after the deadline of the collection
+func (r *AzureInsightBaseMetricsResult) sendTimeseriesDataToChannel(channel chan<- PrometheusMetricResult, metricLabels prometheus.Labels, data []*armmonitor.MetricValue) {
+	for _, aggregation := range datapointAggregations {
+		datapoints := []datapoint{}
+		for _, timeseriesData := range data {
+			if timeseriesData == nil {
+				continue
+			}
+			if value := aggregation.Value(timeseriesData); value != nil {
+				datapoints = append(datapoints, datapoint{Value: *value, Timestamp: timeseriesData.TimeStamp})
+			}
+		}
+
+		metricLabels["aggregation"] = aggregation.Name
+		for _, row := range applyDatapointPolicy(r.prober.settings.Datapoint, datapoints) {
+			if metric, valid := r.buildMetric(metricLabels, row.Value, row.Timestamp); valid {
+				channel <- metric
+			}
+		}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,25 +15,30 @@ var (
 	metricNamePlaceholders     = regexp.MustCompile(`{([^}]+)}`)
 	metricNameNotAllowedChars  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
 	metricLabelNotAllowedChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	metricLabelName            = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 	metricNameReplacer         = strings.NewReplacer("-", "_", " ", "_", "/", "_", ".", "_")
 )
 
 type (
 	PrometheusMetricResult struct {
-		Name   string
-		Labels prometheus.Labels
-		Value  float64
-		Help   string
+		Name      string
+		Labels    prometheus.Labels
+		Value     float64
+		Timestamp *time.Time
+		Help      string
 	}
 )
 
 func (p *MetricProber) MetricsClient(subscriptionId string) (*armmonitor.MetricsClient, error) {
-	clientOpts := p.AzureClient.NewArmClientOptions()
+	clientOpts := p.armClientOptions()
 	clientOpts.PerCallPolicies = append(
 		clientOpts.PerCallPolicies,
 		noCachePolicy{},
 	)
-	return armmonitor.NewMetricsClient(subscriptionId, p.AzureClient.GetCred(), clientOpts)
+	if p.RetryPolicy != nil {
+		p.RetryPolicy.Apply(&clientOpts.ClientOptions)
+	}
+	return armmonitor.NewMetricsClient(subscriptionId, p.azureCred(), clientOpts)
 }
 
 func (p *MetricProber) FetchMetricsFromTarget(client *armmonitor.MetricsClient, target MetricProbeTarget, metrics, aggregations []string) (AzureInsightMetricsResult, error) {
@@ -70,17 +76,9 @@ func (p *MetricProber) FetchMetricsFromTarget(client *armmonitor.MetricsClient,
 		opts.Orderby = to.StringPtr(p.settings.MetricOrderBy)
 	}
 
-	resourceURI := target.ResourceId
-	if strings.HasPrefix(strings.ToLower(p.settings.MetricNamespace), "microsoft.storage/storageaccounts/") {
-		splitNamespace := strings.Split(p.settings.MetricNamespace, "/")
-		// Storage accounts have an extra requirement that their ResourceURI include <type>/default
-		storageAccountType := splitNamespace[len(splitNamespace)-1]
-		resourceURI = resourceURI + fmt.Sprintf("/%s/default", storageAccountType)
-	}
-
 	result, err := client.List(
 		p.ctx,
-		resourceURI,
+		p.metricResourceURI(target.ResourceId),
 		&opts,
 	)
 
@@ -90,3 +88,14 @@ func (p *MetricProber) FetchMetricsFromTarget(client *armmonitor.MetricsClient,
 
 	return ret, err
 }
+
+func (p *MetricProber) metricResourceURI(resourceId string) string {
+	resourceURI := resourceId
+	if strings.HasPrefix(strings.ToLower(p.settings.MetricNamespace), "microsoft.storage/storageaccounts/") {
+		splitNamespace := strings.Split(p.settings.MetricNamespace, "/")
+		// Storage accounts have an extra requirement that their ResourceURI include <type>/default
+		storageAccountType := splitNamespace[len(splitNamespace)-1]
+		resourceURI = resourceURI + fmt.Sprintf("/%s/default", storageAccountType)
+	}
+	return resourceURI
+}
@@ -67,7 +67,7 @@ func (r *AzureInsightSubscriptionMetricsResult) SendMetricToChannel(channel chan
 						}
 
 						// add resource tags as labels
-						metricLabels = r.prober.AzureResourceTagManager.AddResourceTagsToPrometheusLabels(r.prober.ctx, metricLabels, resourceId)
+						metricLabels = r.prober.addResourceTagLabels(metricLabels, resourceId)
 
 						if len(dimensions) == 1 {
 							// we have only one dimension
@@ -85,47 +85,7 @@ func (r *AzureInsightSubscriptionMetricsResult) SendMetricToChannel(channel chan
 							}
 						}
 
-						for _, timeseriesData := range timeseries.Data {
-							if timeseriesData.Total != nil {
-								metricLabels["aggregation"] = "total"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Total,
-								)
-							}
-
-							if timeseriesData.Minimum != nil {
-								metricLabels["aggregation"] = "minimum"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Minimum,
-								)
-							}
-
-							if timeseriesData.Maximum != nil {
-								metricLabels["aggregation"] = "maximum"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Maximum,
-								)
-							}
-
-							if timeseriesData.Average != nil {
-								metricLabels["aggregation"] = "average"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Average,
-								)
-							}
-
-							if timeseriesData.Count != nil {
-								metricLabels["aggregation"] = "count"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Count,
-								)
-							}
-						}
+						r.sendTimeseriesDataToChannel(channel, metricLabels, timeseries.Data)
 					}
 				}
 			}
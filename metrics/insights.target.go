@@ -45,15 +45,10 @@ func (r *AzureInsightMetricsResult) SendMetricToChannel(channel chan<- Prometheu
 							metricUnit = string(*metric.Unit)
 						}
 
-						subscriptionName := ""
-						if subscription, err := r.prober.AzureClient.GetCachedSubscription(r.prober.ctx, azureResource.Subscription); err == nil && subscription != nil {
-							subscriptionName = to.String(subscription.DisplayName)
-						}
-
 						metricLabels := prometheus.Labels{
 							"resourceID":       strings.ToLower(resourceId),
 							"subscriptionID":   azureResource.Subscription,
-							"subscriptionName": subscriptionName,
+							"subscriptionName": r.prober.subscriptionName(azureResource.Subscription),
 							"resourceGroup":    azureResource.ResourceGroup,
 							"resourceName":     azureResource.ResourceName,
 							"metric":           to.String(metric.Name.Value),
@@ -64,7 +59,7 @@ func (r *AzureInsightMetricsResult) SendMetricToChannel(channel chan<- Prometheu
 						}
 
 						// add resource tags as labels
-						metricLabels = r.prober.AzureResourceTagManager.AddResourceTagsToPrometheusLabels(r.prober.ctx, metricLabels, resourceId)
+						metricLabels = r.prober.addResourceTagLabels(metricLabels, resourceId)
 
 						if len(dimensions) == 1 {
 							// we have only one dimension
@@ -82,47 +77,7 @@ func (r *AzureInsightMetricsResult) SendMetricToChannel(channel chan<- Prometheu
 							}
 						}
 
-						for _, timeseriesData := range timeseries.Data {
-							if timeseriesData.Total != nil {
-								metricLabels["aggregation"] = "total"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Total,
-								)
-							}
-
-							if timeseriesData.Minimum != nil {
-								metricLabels["aggregation"] = "minimum"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Minimum,
-								)
-							}
-
-							if timeseriesData.Maximum != nil {
-								metricLabels["aggregation"] = "maximum"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Maximum,
-								)
-							}
-
-							if timeseriesData.Average != nil {
-								metricLabels["aggregation"] = "average"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Average,
-								)
-							}
-
-							if timeseriesData.Count != nil {
-								metricLabels["aggregation"] = "count"
-								channel <- r.buildMetric(
-									metricLabels,
-									*timeseriesData.Count,
-								)
-							}
-						}
+						r.sendTimeseriesDataToChannel(channel, metricLabels, timeseries.Data)
 					}
 				}
 			}
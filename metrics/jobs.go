@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+const (
+	MetricJobDiscoveryResource      = "resource"
+	MetricJobDiscoveryList          = "list"
+	MetricJobDiscoveryScrape        = "scrape"
+	MetricJobDiscoveryResourceGraph = "resourcegraph"
+	MetricJobDiscoverySubscription  = "subscription"
+
+	MetricJobCollectIntervalDefault = 1 * time.Minute
+)
+
+var (
+	// paths of the exporter handlers, job paths must not use them (duplicate patterns panic the http mux)
+	metricJobReservedPaths = []string{
+		"/healthz",
+		"/readyz",
+		"/query",
+		config.ProbeMetricsSubscriptionUrl,
+		config.AdminCacheUrl,
+	}
+)
+
+type (
+	MetricJobConfig struct {
+		Jobs []*MetricJob
+	}
+
+	MetricJob struct {
+		Job             string        `yaml:"job"`
+		Path            string        `yaml:"path"`
+		Discovery       string        `yaml:"discovery"`
+		CollectInterval time.Duration `yaml:"collectInterval"`
+
+		// discovery "resource"
+		Targets []string `yaml:"targets"`
+
+		// discovery "scrape"
+		MetricTagName      string `yaml:"metricTagName"`
+		AggregationTagName string `yaml:"aggregationTagName"`
+
+		RequestMetricSettings `yaml:",inline"`
+	}
+)
+
+func NewMetricJobConfigFromFile(path string, opts config.Opts) (*MetricJobConfig, error) {
+	content, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("unable to read job config \"%s\": %w", path, err)
+	}
+
+	rawConf := struct {
+		Jobs []yaml.Node `yaml:"jobs"`
+	}{}
+	if err := yaml.Unmarshal(content, &rawConf); err != nil {
+		return nil, fmt.Errorf("unable to parse job config \"%s\": %w", path, err)
+	}
+
+	conf := MetricJobConfig{}
+	jobNames := map[string]bool{}
+	for _, jobNode := range rawConf.Jobs {
+		job := NewMetricJob(opts)
+		if err := jobNode.Decode(job); err != nil {
+			return nil, fmt.Errorf("unable to parse job config \"%s\": %w", path, err)
+		}
+
+		if err := job.Validate(); err != nil {
+			return nil, err
+		}
+
+		if _, exists := jobNames[job.Job]; exists {
+			return nil, fmt.Errorf("job \"%s\" is defined multiple times", job.Job)
+		}
+		jobNames[job.Job] = true
+
+		conf.Jobs = append(conf.Jobs, job)
+	}
+
+	return &conf, nil
+}
+
+// NewMetricJob creates a job with the same defaults as the probe query parameters
+func NewMetricJob(opts config.Opts) *MetricJob {
+	job := MetricJob{
+		CollectInterval: MetricJobCollectIntervalDefault,
+	}
+	job.Name = PrometheusMetricNameDefault
+	job.Timespan = "PT1M"
+	job.ValidateDimensions = true
+	job.MetricTemplate = opts.Metrics.Template
+	job.HelpTemplate = opts.Metrics.Help
+	job.LabelsTemplate = opts.Metrics.Labels
+	job.MetricTimestamp = opts.Metrics.Timestamp
+	job.Datapoint = DatapointPolicyDefault
+	job.MergePolicy = MergePolicyDefault
+	job.Api = MetricApiArm
+	return &job
+}
+
+func (j *MetricJob) Validate() error {
+	if j.Job == "" {
+		return fmt.Errorf("job name (\"job\") is missing")
+	}
+
+	if err := validateMetricJobPath(j.Path); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if j.CollectInterval.Seconds() <= 0 {
+		return fmt.Errorf("job \"%s\": collectInterval must be positive", j.Job)
+	}
+
+	// each subscription is only collected once
+	j.Subscriptions = normalizeStringList(j.Subscriptions)
+	if len(j.Subscriptions) == 0 {
+		return fmt.Errorf("job \"%s\": subscriptions are missing", j.Job)
+	}
+
+	if err := validateDatapointPolicy(j.Datapoint); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if err := j.parseTemplates(); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if err := j.compileRelabelConfigs(); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if err := validateMergePolicy(j.MergePolicy); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if err := validateMetricApi(j.Api); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	if err := validateMetricNamePatterns(j.Metrics); err != nil {
+		return fmt.Errorf("job \"%s\": %w", j.Job, err)
+	}
+
+	switch j.Discovery {
+	case MetricJobDiscoveryResource:
+		if len(j.Targets) == 0 {
+			return fmt.Errorf("job \"%s\": targets are missing", j.Job)
+		}
+	case MetricJobDiscoveryList, MetricJobDiscoveryScrape:
+		if j.ResourceType != "" && j.Filter != "" {
+			return fmt.Errorf("job \"%s\": \"resourceType\" and \"filter\" are mutually exclusive", j.Job)
+		} else if j.ResourceType != "" {
+			j.Filter = fmt.Sprintf(
+				"resourceType eq '%s'",
+				strings.ReplaceAll(j.ResourceType, "'", "\\'"),
+			)
+		} else if j.Filter == "" {
+			return fmt.Errorf("job \"%s\": \"resourceType\" or \"filter\" is missing", j.Job)
+		}
+
+		if j.Discovery == MetricJobDiscoveryScrape && (j.MetricTagName == "" || j.AggregationTagName == "") {
+			return fmt.Errorf("job \"%s\": \"metricTagName\" and \"aggregationTagName\" are required", j.Job)
+		}
+	case MetricJobDiscoveryResourceGraph, MetricJobDiscoverySubscription:
+		if j.ResourceType == "" {
+			return fmt.Errorf("job \"%s\": resourceType is missing", j.Job)
+		}
+
+		if j.Discovery == MetricJobDiscoverySubscription && j.HasMetricNamePatterns() {
+			return fmt.Errorf("job \"%s\": metric patterns are not supported with discovery \"subscription\"", j.Job)
+		}
+	default:
+		return fmt.Errorf("job \"%s\": invalid discovery \"%s\"", j.Job, j.Discovery)
+	}
+
+	return nil
+}
+
+// validateMetricJobPath checks the http path of a job, jobs can share a path (or use /metrics)
+// but must not use the path of another handler of the exporter
+func validateMetricJobPath(path string) error {
+	if path == "" || path == config.MetricsUrl {
+		return nil
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path \"%s\" must start with \"/\"", path)
+	}
+
+	// wildcards and methods are part of the http mux pattern syntax
+	if strings.ContainsAny(path, "{} \t") {
+		return fmt.Errorf("path \"%s\" must not contain wildcards or whitespace", path)
+	}
+
+	for _, reservedPath := range metricJobReservedPaths {
+		if path == reservedPath || strings.HasPrefix(path, reservedPath+"/") {
+			return fmt.Errorf("path \"%s\" is reserved by the exporter", path)
+		}
+	}
+
+	return nil
+}
+
+// Settings returns a deep copy of the job settings, each job run works on its own copy
+func (j *MetricJob) Settings() RequestMetricSettings {
+	return j.RequestMetricSettings.Clone()
+}
+
+// TargetDiscoverer returns the target discoverer of the job, nil for discovery "subscription"
+// (metrics are fetched on subscription scope without targets)
+func (j *MetricJob) TargetDiscoverer() TargetDiscoverer {
+	switch j.Discovery {
+	case MetricJobDiscoveryResource:
+		return StaticTargetDiscoverer{ResourceIds: j.Targets}
+	case MetricJobDiscoveryList:
+		return ResourceFilterDiscoverer{}
+	case MetricJobDiscoveryScrape:
+		return ScrapeTagDiscoverer{MetricTagName: j.MetricTagName, AggregationTagName: j.AggregationTagName}
+	case MetricJobDiscoveryResourceGraph:
+		return ResourceGraphDiscoverer{ResourceType: j.ResourceType}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+func TestMetricJobSettingsIsDeepCopy(t *testing.T) {
+	interval := "PT5M"
+	metricTop := int32(10)
+	cache := time.Minute
+
+	job := MetricJob{}
+	job.Subscriptions = []string{"sub1"}
+	job.Metrics = []string{"Availability"}
+	job.Aggregations = []string{"average"}
+	job.Regions = []string{"westeurope"}
+	job.Interval = &interval
+	job.MetricTop = &metricTop
+	job.Cache = &cache
+	job.StaticLabels = map[string]string{"team": "security"}
+	job.RelabelConfigs = []*RelabelConfig{{SourceLabels: []string{"resourceGroup"}, TargetLabel: "rg"}}
+
+	settings := job.Settings()
+	settings.Subscriptions[0] = "changed"
+	settings.Metrics[0] = "changed"
+	settings.Aggregations[0] = "changed"
+	settings.Regions[0] = "changed"
+	*settings.Interval = "changed"
+	*settings.MetricTop = 1
+	*settings.Cache = time.Hour
+	settings.StaticLabels["team"] = "changed"
+	settings.RelabelConfigs[0].TargetLabel = "changed"
+	settings.RelabelConfigs[0].SourceLabels[0] = "changed"
+
+	if job.Subscriptions[0] != "sub1" || job.Metrics[0] != "Availability" || job.Aggregations[0] != "average" || job.Regions[0] != "westeurope" {
+		t.Errorf("job lists were changed by the settings copy: %v %v %v %v", job.Subscriptions, job.Metrics, job.Aggregations, job.Regions)
+	}
+	if *job.Interval != "PT5M" || *job.MetricTop != 10 || *job.Cache != time.Minute {
+		t.Errorf("job pointers were changed by the settings copy")
+	}
+	if job.StaticLabels["team"] != "security" {
+		t.Errorf("job static labels were changed by the settings copy: %v", job.StaticLabels)
+	}
+	if job.RelabelConfigs[0].TargetLabel != "rg" || job.RelabelConfigs[0].SourceLabels[0] != "resourceGroup" {
+		t.Errorf("job relabel rules were changed by the settings copy: %+v", *job.RelabelConfigs[0])
+	}
+}
+
+func TestMetricJobValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(job *MetricJob)
+		valid  bool
+	}{
+		{"valid", func(job *MetricJob) {}, true},
+		{"metrics path", func(job *MetricJob) { job.Path = "/metrics" }, true},
+		{"own path", func(job *MetricJob) { job.Path = "/metrics/keyvault" }, true},
+		{"missing job name", func(job *MetricJob) { job.Job = "" }, false},
+		{"relative path", func(job *MetricJob) { job.Path = "metrics" }, false},
+		{"probe path", func(job *MetricJob) { job.Path = "/probe/metrics" }, false},
+		{"probe sub path", func(job *MetricJob) { job.Path = "/probe/metrics/list" }, false},
+		{"healthz path", func(job *MetricJob) { job.Path = "/healthz" }, false},
+		{"readyz path", func(job *MetricJob) { job.Path = "/readyz" }, false},
+		{"query path", func(job *MetricJob) { job.Path = "/query" }, false},
+		{"admin path", func(job *MetricJob) { job.Path = "/admin/cache/entry" }, false},
+		{"wildcard path", func(job *MetricJob) { job.Path = "/metrics/{job}" }, false},
+		{"missing subscriptions", func(job *MetricJob) { job.Subscriptions = []string{" "} }, false},
+		{"invalid interval", func(job *MetricJob) { job.CollectInterval = 0 }, false},
+		{"missing targets", func(job *MetricJob) { job.Targets = nil }, false},
+		{"invalid discovery", func(job *MetricJob) { job.Discovery = "tags" }, false},
+		{"list without filter", func(job *MetricJob) { job.Discovery = MetricJobDiscoveryList }, false},
+		{"list with resource type", func(job *MetricJob) {
+			job.Discovery = MetricJobDiscoveryList
+			job.ResourceType = "Microsoft.KeyVault/vaults"
+		}, true},
+		{"invalid metric pattern", func(job *MetricJob) { job.Metrics = []string{"/(/"} }, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			job := NewMetricJob(config.Opts{})
+			job.Job = "test"
+			job.Discovery = MetricJobDiscoveryResource
+			job.Targets = []string{"/subscriptions/xxx/resourceGroups/example/providers/Microsoft.KeyVault/vaults/example"}
+			job.Subscriptions = []string{"xxx"}
+			testCase.modify(job)
+
+			err := job.Validate()
+			if testCase.valid && err != nil {
+				t.Errorf("expected valid job, got %v", err)
+			}
+			if !testCase.valid && err == nil {
+				t.Error("expected error for invalid job")
+			}
+		})
+	}
+}
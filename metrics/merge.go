@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	MergePolicyError = "error"
+	MergePolicyFirst = "first"
+	MergePolicyLast  = "last"
+	MergePolicySum   = "sum"
+	MergePolicyMax   = "max"
+	MergePolicyMin   = "min"
+
+	MergePolicyDefault = MergePolicyLast
+)
+
+var (
+	ErrMetricCollision = errors.New("duplicate metric series")
+)
+
+func validateMergePolicy(policy string) error {
+	switch policy {
+	case MergePolicyError, MergePolicyFirst, MergePolicyLast, MergePolicySum, MergePolicyMax, MergePolicyMin:
+		return nil
+	default:
+		return fmt.Errorf("invalid merge policy \"%s\"", policy)
+	}
+}
+
+// mergeMetricRows merges two rows with the same name and labels (eg. labels removed by the metric name template)
+func mergeMetricRows(policy string, existing, row MetricRow) MetricRow {
+	switch policy {
+	case MergePolicyFirst, MergePolicyError:
+		return existing
+	case MergePolicySum:
+		existing.Value += row.Value
+		return existing
+	case MergePolicyMax:
+		if row.Value > existing.Value || math.IsNaN(existing.Value) {
+			return row
+		}
+		return existing
+	case MergePolicyMin:
+		if row.Value < existing.Value || math.IsNaN(existing.Value) {
+			return row
+		}
+		return existing
+	default:
+		return row
+	}
+}
+
+// metricCollisionError returns the error of the merge policy "error" for the colliding series
+func metricCollisionError(name string, row MetricRow) error {
+	labels := make([]string, 0, len(row.Labels))
+	for labelName, labelValue := range row.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", labelName, labelValue))
+	}
+	sort.Strings(labels)
+
+	return fmt.Errorf("%w %s{%s} (check metric name template or use parameter \"merge\")", ErrMetricCollision, name, strings.Join(labels, ","))
+}
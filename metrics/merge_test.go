@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMergeMetricRows(t *testing.T) {
+	existing := MetricRow{Value: 2}
+	row := MetricRow{Value: 5}
+	nan := MetricRow{Value: math.NaN()}
+
+	tests := []struct {
+		policy   string
+		existing MetricRow
+		row      MetricRow
+		expected float64
+	}{
+		{policy: MergePolicyFirst, existing: existing, row: row, expected: 2},
+		{policy: MergePolicyError, existing: existing, row: row, expected: 2},
+		{policy: MergePolicyLast, existing: existing, row: row, expected: 5},
+		{policy: MergePolicySum, existing: existing, row: row, expected: 7},
+		{policy: MergePolicyMax, existing: existing, row: row, expected: 5},
+		{policy: MergePolicyMax, existing: row, row: existing, expected: 5},
+		{policy: MergePolicyMax, existing: nan, row: row, expected: 5},
+		{policy: MergePolicyMin, existing: existing, row: row, expected: 2},
+		{policy: MergePolicyMin, existing: row, row: existing, expected: 2},
+		{policy: MergePolicyMin, existing: nan, row: row, expected: 5},
+	}
+
+	for _, test := range tests {
+		if merged := mergeMetricRows(test.policy, test.existing, test.row); merged.Value != test.expected {
+			t.Errorf("policy %s: merge of %v and %v expected %v, got %v", test.policy, test.existing.Value, test.row.Value, test.expected, merged.Value)
+		}
+	}
+}
+
+func TestValidateMergePolicy(t *testing.T) {
+	for _, policy := range []string{MergePolicyError, MergePolicyFirst, MergePolicyLast, MergePolicySum, MergePolicyMax, MergePolicyMin} {
+		if err := validateMergePolicy(policy); err != nil {
+			t.Errorf("policy %s must be valid: %v", policy, err)
+		}
+	}
+
+	if err := validateMergePolicy("avg"); err == nil {
+		t.Error("policy avg must be invalid")
+	}
+}
+
+func TestMetricListMergePolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		expected   float64
+		collisions int
+		err        bool
+	}{
+		{policy: MergePolicyFirst, expected: 1, collisions: 2},
+		{policy: MergePolicyLast, expected: 2, collisions: 2},
+		{policy: MergePolicySum, expected: 6, collisions: 2},
+		{policy: MergePolicyMax, expected: 3, collisions: 2},
+		{policy: MergePolicyMin, expected: 1, collisions: 2},
+		{policy: MergePolicyError, expected: 1, collisions: 2, err: true},
+	}
+
+	for _, test := range tests {
+		list := NewMetricList()
+		list.SetMergePolicy(test.policy, false)
+
+		for _, value := range []float64{1, 3, 2} {
+			list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: value})
+		}
+		list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "b"}, Value: 10})
+
+		rows := list.GetMetricList("azurerm_test_metric")
+		if len(rows) != 2 {
+			t.Fatalf("policy %s: expected 2 rows, got %d", test.policy, len(rows))
+		}
+		if rows[0].Value != test.expected {
+			t.Errorf("policy %s: expected merged value %v, got %v", test.policy, test.expected, rows[0].Value)
+		}
+		if collisions := list.Collisions()["azurerm_test_metric"]; collisions != test.collisions {
+			t.Errorf("policy %s: expected %d collisions, got %d", test.policy, test.collisions, collisions)
+		}
+		if err := list.MergeError(); test.err != (err != nil) || (err != nil && !errors.Is(err, ErrMetricCollision)) {
+			t.Errorf("policy %s: unexpected merge error %v", test.policy, err)
+		}
+	}
+}
+
+func TestMetricListMergeByTimestamp(t *testing.T) {
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+
+	list := NewMetricList()
+	list.SetMergePolicy(MergePolicySum, true)
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1, Timestamp: &first})
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 2, Timestamp: &second})
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 3, Timestamp: &second})
+
+	rows := list.GetMetricList("azurerm_test_metric")
+	if len(rows) != 2 {
+		t.Fatalf("datapoints with different timestamps must not be merged, got %d rows", len(rows))
+	}
+	if rows[1].Value != 5 {
+		t.Errorf("datapoints with the same timestamp must be merged, got %v", rows[1].Value)
+	}
+}
+
+func TestMetricListCountsCollisionsProcessWide(t *testing.T) {
+	counter := metricSeriesCollisions.WithLabelValues("azurerm_test_collisions_total")
+	before := testutil.ToFloat64(counter)
+
+	// collisions of all lists are counted, also without error
+	for _, policy := range []string{MergePolicyLast, MergePolicyError} {
+		list := NewMetricList()
+		list.SetMergePolicy(policy, false)
+		for _, value := range []float64{1, 2, 3} {
+			list.Add("azurerm_test_collisions_total", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: value})
+		}
+		list.Add("azurerm_test_collisions_total", MetricRow{Labels: prometheus.Labels{"resourceName": "b"}, Value: 1})
+	}
+
+	if collisions := testutil.ToFloat64(counter) - before; collisions != 4 {
+		t.Errorf("expected 4 collisions, got %v", collisions)
+	}
+}
@@ -1,25 +1,83 @@
 package metrics
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	MetricHelpDefault = "Azure monitor insight metric"
+
+	// MetricListCacheVersion is the version of the serialized MetricList,
+	// needs to be increased on incompatible changes
+	MetricListCacheVersion = 2
 )
 
 type (
+	// MetricList collects the metrics of a probe (not safe for concurrent use), it's published
+	// and cached as immutable MetricListSnapshot
 	MetricList struct {
 		List map[string][]MetricRow
 		Help map[string]string
+
+		// merge of rows with the same name and labels (appended without merge policy)
+		merge struct {
+			policy      string
+			byTimestamp bool
+
+			// row index by metric name and series
+			index      map[string]map[string]int
+			collisions map[string]int
+			err        error
+		}
 	}
 
 	MetricRow struct {
-		Labels prometheus.Labels
-		Value  float64
+		Labels    prometheus.Labels `json:"labels"`
+		Value     float64           `json:"value"`
+		Timestamp *time.Time        `json:"timestamp,omitempty"`
+	}
+
+	// MetricListCacheEntry is a MetricList loaded from the cache
+	MetricListCacheEntry struct {
+		List *MetricListSnapshot
+
+		// time of the collection
+		CreatedAt time.Time
+
+		// entry is fresh until this time and stale afterwards
+		ExpiresAt time.Time
+	}
+
+	metricListCache struct {
+		Version   int                    `json:"version"`
+		CreatedAt time.Time              `json:"createdAt"`
+		ExpiresAt time.Time              `json:"expiresAt"`
+		List      map[string][]MetricRow `json:"list"`
+		Help      map[string]string      `json:"help"`
 	}
 )
 
+var (
+	// metricSeriesCollisions counts the merged rows of all probes by metric name (process-wide,
+	// unlike the per probe gauge of the probe status)
+	metricSeriesCollisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurerm_metric_series_collisions_total",
+			Help: "Azure metrics exporter rows of all probes merged by the merge policy by metric name",
+		},
+		[]string{"metric"},
+	)
+)
+
+// RegisterMetricListMetrics registers the process-wide metrics of all metric lists (eg. series collisions)
+func RegisterMetricListMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(metricSeriesCollisions)
+}
+
 func NewMetricList() *MetricList {
 	list := MetricList{}
 	list.List = map[string][]MetricRow{}
@@ -27,12 +85,90 @@ func NewMetricList() *MetricList {
 	return &list
 }
 
+// NewMetricListFromCache parses a MetricListSnapshot serialized by MarshalCache
+func NewMetricListFromCache(data []byte) (*MetricListCacheEntry, error) {
+	cacheData := metricListCache{}
+	if err := json.Unmarshal(data, &cacheData); err != nil {
+		return nil, err
+	}
+
+	if cacheData.Version != MetricListCacheVersion {
+		return nil, fmt.Errorf("unsupported metric list cache version %d", cacheData.Version)
+	}
+
+	builder := NewMetricListSnapshotBuilder()
+	for name, rows := range cacheData.List {
+		// rows are decoded, no need to copy them again
+		builder.add(name, rows, false)
+		if help, exists := cacheData.Help[name]; exists {
+			builder.SetMetricHelp(name, help)
+		}
+	}
+	return &MetricListCacheEntry{
+		List:      builder.Build(),
+		CreatedAt: cacheData.CreatedAt,
+		ExpiresAt: cacheData.ExpiresAt,
+	}, nil
+}
+
+// Age returns the age of the cached metrics
+func (e *MetricListCacheEntry) Age(now time.Time) time.Duration {
+	return now.Sub(e.CreatedAt)
+}
+
+// IsStale returns true if the entry is expired (but still stored for stale serving)
+func (e *MetricListCacheEntry) IsStale(now time.Time) bool {
+	return now.After(e.ExpiresAt)
+}
+
+// SetMergePolicy sets the policy for rows with the same name and labels, with byTimestamp rows with different
+// timestamps are different datapoints of the series and not merged (datapoint policy all)
+func (l *MetricList) SetMergePolicy(policy string, byTimestamp bool) {
+	l.merge.policy = policy
+	l.merge.byTimestamp = byTimestamp
+	l.merge.index = map[string]map[string]int{}
+	l.merge.collisions = map[string]int{}
+}
+
 func (l *MetricList) Add(name string, metric ...MetricRow) {
 	if _, ok := l.List[name]; !ok {
 		l.List[name] = []MetricRow{}
 	}
 
-	l.List[name] = append(l.List[name], metric...)
+	if l.merge.policy == "" {
+		l.List[name] = append(l.List[name], metric...)
+		return
+	}
+
+	if _, ok := l.merge.index[name]; !ok {
+		l.merge.index[name] = map[string]int{}
+	}
+
+	for _, row := range metric {
+		key := row.seriesKey(l.merge.byTimestamp)
+		if i, exists := l.merge.index[name][key]; exists {
+			l.merge.collisions[name]++
+			metricSeriesCollisions.WithLabelValues(name).Inc()
+			if l.merge.policy == MergePolicyError && l.merge.err == nil {
+				l.merge.err = metricCollisionError(name, row)
+			}
+			l.List[name][i] = mergeMetricRows(l.merge.policy, l.List[name][i], row)
+			continue
+		}
+
+		l.merge.index[name][key] = len(l.List[name])
+		l.List[name] = append(l.List[name], row)
+	}
+}
+
+// Collisions returns the number of merged rows by metric name
+func (l *MetricList) Collisions() map[string]int {
+	return l.merge.collisions
+}
+
+// MergeError returns the first collision if the merge policy is "error"
+func (l *MetricList) MergeError() error {
+	return l.merge.err
 }
 
 func (l *MetricList) GetMetricNames() (list []string) {
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// MetricListSnapshot is an immutable copy of a MetricList with sorted metric names, label names and rows,
+	// it's safe for concurrent use (eg. shared by coalesced probes or published while a new list is built),
+	// snapshots are created by MetricList.Snapshot or a MetricListSnapshotBuilder
+	MetricListSnapshot struct {
+		// sorted by name
+		metrics []metricSnapshot
+		index   map[string]int
+	}
+
+	metricSnapshot struct {
+		name       string
+		help       string
+		labelNames []string
+
+		// sorted by label values, rows with the same labels keep their order (eg. datapoints of one series)
+		rows []MetricRow
+	}
+
+	// MetricListSnapshotBuilder creates a MetricListSnapshot, metrics of the source snapshot are shared
+	// until they are changed (copy-on-write), so cached snapshots can be derived without copying them,
+	// the builder is not safe for concurrent use
+	MetricListSnapshotBuilder struct {
+		source *MetricListSnapshot
+
+		// changed (copied from source) or added metrics by name, sorted on Build
+		changed map[string]*metricSnapshot
+		removed map[string]struct{}
+	}
+
+	// metricRowSorter sorts rows by their precomputed label keys
+	metricRowSorter struct {
+		rows []MetricRow
+		keys []string
+	}
+)
+
+// Snapshot returns an immutable, sorted copy of the list (labels and timestamps are copied,
+// later changes of the list don't affect the snapshot)
+func (l *MetricList) Snapshot() *MetricListSnapshot {
+	return l.snapshot(true)
+}
+
+func (l *MetricList) snapshot(clone bool) *MetricListSnapshot {
+	builder := NewMetricListSnapshotBuilder()
+	for name, rows := range l.List {
+		builder.add(name, rows, clone)
+		builder.SetMetricHelp(name, l.GetMetricHelp(name))
+	}
+	return builder.Build()
+}
+
+// NewMetricListSnapshotBuilder returns a builder of a new snapshot
+func NewMetricListSnapshotBuilder() *MetricListSnapshotBuilder {
+	return (&MetricListSnapshot{}).Builder()
+}
+
+// Builder returns a builder of a snapshot derived from the snapshot, the snapshot itself is not changed
+func (s *MetricListSnapshot) Builder() *MetricListSnapshotBuilder {
+	return &MetricListSnapshotBuilder{
+		source:  s,
+		changed: map[string]*metricSnapshot{},
+		removed: map[string]struct{}{},
+	}
+}
+
+// Add appends the rows to the metric (labels and timestamps are copied)
+func (b *MetricListSnapshotBuilder) Add(name string, rows ...MetricRow) {
+	b.add(name, rows, true)
+}
+
+func (b *MetricListSnapshotBuilder) add(name string, rows []MetricRow, clone bool) {
+	metric := b.metric(name)
+	for _, row := range rows {
+		if clone {
+			row = row.clone()
+		}
+		metric.rows = append(metric.rows, row)
+	}
+}
+
+func (b *MetricListSnapshotBuilder) SetMetricHelp(name, help string) {
+	b.metric(name).help = help
+}
+
+// Remove removes the metric with all its rows
+func (b *MetricListSnapshotBuilder) Remove(name string) {
+	delete(b.changed, name)
+	b.removed[name] = struct{}{}
+}
+
+// metric returns the writable metric, metrics of the source are copied on the first change
+func (b *MetricListSnapshotBuilder) metric(name string) *metricSnapshot {
+	if metric, exists := b.changed[name]; exists {
+		return metric
+	}
+
+	metric := &metricSnapshot{name: name, help: MetricHelpDefault}
+	if _, removed := b.removed[name]; !removed {
+		if i, exists := b.source.index[name]; exists {
+			// rows of snapshots are never modified, only the slice is copied
+			metric.help = b.source.metrics[i].help
+			metric.rows = slices.Clone(b.source.metrics[i].rows)
+		}
+	}
+	delete(b.removed, name)
+	b.changed[name] = metric
+	return metric
+}
+
+// Build returns the snapshot with the changes, unchanged metrics are shared with the source snapshot.
+// Later changes of the builder don't affect the returned snapshot (they're based on it)
+func (b *MetricListSnapshotBuilder) Build() *MetricListSnapshot {
+	names := make([]string, 0, len(b.source.metrics)+len(b.changed))
+	for _, metric := range b.source.metrics {
+		_, changed := b.changed[metric.name]
+		_, removed := b.removed[metric.name]
+		if !changed && !removed {
+			names = append(names, metric.name)
+		}
+	}
+	for name := range b.changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshot := &MetricListSnapshot{
+		metrics: make([]metricSnapshot, 0, len(names)),
+		index:   make(map[string]int, len(names)),
+	}
+	for _, name := range names {
+		metric, changed := b.changed[name]
+		if !changed {
+			snapshot.index[name] = len(snapshot.metrics)
+			snapshot.metrics = append(snapshot.metrics, b.source.metrics[b.source.index[name]])
+			continue
+		}
+
+		labelNames := map[string]struct{}{}
+		for _, row := range metric.rows {
+			for labelName := range row.Labels {
+				labelNames[labelName] = struct{}{}
+			}
+		}
+		metric.labelNames = make([]string, 0, len(labelNames))
+		for labelName := range labelNames {
+			metric.labelNames = append(metric.labelNames, labelName)
+		}
+		sort.Strings(metric.labelNames)
+
+		keys := make([]string, len(metric.rows))
+		for i, row := range metric.rows {
+			keys[i] = row.labelKey(metric.labelNames)
+		}
+		sort.Stable(metricRowSorter{rows: metric.rows, keys: keys})
+
+		snapshot.index[name] = len(snapshot.metrics)
+		snapshot.metrics = append(snapshot.metrics, *metric)
+	}
+
+	// further changes are copied from the built snapshot
+	b.source = snapshot
+	b.changed = map[string]*metricSnapshot{}
+	b.removed = map[string]struct{}{}
+	return snapshot
+}
+
+// Len returns the number of metric names
+func (s *MetricListSnapshot) Len() int {
+	return len(s.metrics)
+}
+
+// Rows returns the number of rows of all metrics
+func (s *MetricListSnapshot) Rows() int {
+	ret := 0
+	for _, metric := range s.metrics {
+		ret += len(metric.rows)
+	}
+	return ret
+}
+
+// MetricNames returns the sorted metric names
+func (s *MetricListSnapshot) MetricNames() []string {
+	ret := make([]string, len(s.metrics))
+	for i, metric := range s.metrics {
+		ret[i] = metric.name
+	}
+	return ret
+}
+
+func (s *MetricListSnapshot) MetricHelp(name string) string {
+	if i, exists := s.index[name]; exists {
+		return s.metrics[i].help
+	}
+	return MetricHelpDefault
+}
+
+// MetricLabelNames returns the sorted label names of all rows of the metric
+func (s *MetricListSnapshot) MetricLabelNames(name string) []string {
+	if i, exists := s.index[name]; exists {
+		return slices.Clone(s.metrics[i].labelNames)
+	}
+	return nil
+}
+
+// MetricRows returns the sorted rows of the metric, the rows are shared and must not be modified
+func (s *MetricListSnapshot) MetricRows(name string) []MetricRow {
+	if i, exists := s.index[name]; exists {
+		return slices.Clip(s.metrics[i].rows)
+	}
+	return nil
+}
+
+// MarshalCache serializes the metrics (versioned) for the cache, the entry is fresh until expiresAt
+func (s *MetricListSnapshot) MarshalCache(createdAt, expiresAt time.Time) ([]byte, error) {
+	cacheData := metricListCache{
+		Version:   MetricListCacheVersion,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+		List:      make(map[string][]MetricRow, len(s.metrics)),
+		Help:      make(map[string]string, len(s.metrics)),
+	}
+	for _, metric := range s.metrics {
+		cacheData.List[metric.name] = metric.rows
+		cacheData.Help[metric.name] = metric.help
+	}
+	return json.Marshal(cacheData)
+}
+
+// clone copies the labels and timestamp of the row
+func (r MetricRow) clone() MetricRow {
+	ret := MetricRow{
+		Labels: make(prometheus.Labels, len(r.Labels)),
+		Value:  r.Value,
+	}
+	for labelName, labelValue := range r.Labels {
+		ret.Labels[labelName] = labelValue
+	}
+	if r.Timestamp != nil {
+		timestamp := *r.Timestamp
+		ret.Timestamp = &timestamp
+	}
+	return ret
+}
+
+// seriesKey returns the identity of the series of the row (all labels, optionally with timestamp)
+func (r MetricRow) seriesKey(withTimestamp bool) string {
+	labelNames := make([]string, 0, len(r.Labels))
+	for labelName := range r.Labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	key := make([]string, 0, 2*len(labelNames)+1)
+	for _, labelName := range labelNames {
+		key = append(key, labelName, r.Labels[labelName])
+	}
+	if withTimestamp && r.Timestamp != nil {
+		key = append(key, r.Timestamp.Format(time.RFC3339Nano))
+	}
+	return strings.Join(key, "\xff")
+}
+
+// labelKey returns the label values of the row (missing labels are empty) as sort and identity key
+func (r MetricRow) labelKey(labelNames []string) string {
+	labelValues := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		labelValues[i] = r.Labels[labelName]
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (s metricRowSorter) Len() int           { return len(s.rows) }
+func (s metricRowSorter) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s metricRowSorter) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSnapshotIsNotChangedByList(t *testing.T) {
+	list := NewMetricList()
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1})
+
+	snapshot := list.Snapshot()
+	list.List["azurerm_test_metric"][0].Labels["resourceName"] = "changed"
+	list.Add("azurerm_test_metric", MetricRow{Labels: prometheus.Labels{"resourceName": "b"}, Value: 2})
+
+	rows := snapshot.MetricRows("azurerm_test_metric")
+	if len(rows) != 1 || rows[0].Labels["resourceName"] != "a" {
+		t.Errorf("snapshot was changed by the list: %v", rows)
+	}
+}
+
+// TestCachedSnapshotParallelScrapes serves one cached snapshot to parallel scrapes (run with -race)
+func TestCachedSnapshotParallelScrapes(t *testing.T) {
+	list := newTestMetricList(5, 50)
+	timestamp := time.Now()
+	for name := range list.List {
+		// older datapoint of the same series (datapoint policy "all")
+		list.Add(name, MetricRow{Labels: list.List[name][0].Labels, Value: -1, Timestamp: &timestamp})
+	}
+
+	cacheData, err := list.Snapshot().MarshalCache(time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := NewMetricListFromCache(cacheData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			prober := newTestProber(context.Background())
+			prober.settings.Datapoint = DatapointPolicyAll
+			prober.publishCacheEntry(entry)
+
+			families, err := prober.Gatherer().Gather()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			samples := 0
+			for _, family := range families {
+				if strings.HasPrefix(family.GetName(), "azurerm_test_metric_") {
+					samples += len(family.GetMetric())
+				}
+			}
+			// rows and the older datapoint of each metric
+			if expected := 5*50 + 5; samples != expected {
+				errs <- fmt.Errorf("expected %d samples, got %d", expected, samples)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotBuilderCopyOnWrite(t *testing.T) {
+	list := NewMetricList()
+	list.Add("azurerm_test_a", MetricRow{Labels: prometheus.Labels{"resourceName": "b"}, Value: 2})
+	list.Add("azurerm_test_b", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1})
+	list.Add("azurerm_test_c", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1})
+	list.SetMetricHelp("azurerm_test_a", "help a")
+	source := list.Snapshot()
+
+	builder := source.Builder()
+	builder.Add("azurerm_test_a", MetricRow{Labels: prometheus.Labels{"resourceName": "a", "tag_owner": "x"}, Value: 1})
+	builder.Remove("azurerm_test_b")
+	builder.Add("azurerm_test_0", MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1})
+	derived := builder.Build()
+
+	// source is not changed
+	if names := source.MetricNames(); !slices.Equal(names, []string{"azurerm_test_a", "azurerm_test_b", "azurerm_test_c"}) {
+		t.Errorf("source metrics were changed: %v", names)
+	}
+	if rows := source.MetricRows("azurerm_test_a"); len(rows) != 1 || !slices.Equal(source.MetricLabelNames("azurerm_test_a"), []string{"resourceName"}) {
+		t.Errorf("source rows were changed: %v", rows)
+	}
+
+	// changed metrics are sorted, help is kept
+	if names := derived.MetricNames(); !slices.Equal(names, []string{"azurerm_test_0", "azurerm_test_a", "azurerm_test_c"}) {
+		t.Errorf("unexpected derived metrics: %v", names)
+	}
+	rows := derived.MetricRows("azurerm_test_a")
+	if len(rows) != 2 || rows[0].Labels["resourceName"] != "a" || rows[1].Labels["resourceName"] != "b" {
+		t.Errorf("expected sorted rows, got %v", rows)
+	}
+	if labelNames := derived.MetricLabelNames("azurerm_test_a"); !slices.Equal(labelNames, []string{"resourceName", "tag_owner"}) {
+		t.Errorf("unexpected label names %v", labelNames)
+	}
+	if help := derived.MetricHelp("azurerm_test_a"); help != "help a" {
+		t.Errorf("expected help of the source, got %q", help)
+	}
+	if help := derived.MetricHelp("azurerm_test_0"); help != MetricHelpDefault {
+		t.Errorf("expected default help of new metric, got %q", help)
+	}
+
+	// unchanged metrics are shared
+	if &source.MetricRows("azurerm_test_c")[0] != &derived.MetricRows("azurerm_test_c")[0] {
+		t.Error("expected rows of unchanged metric to be shared")
+	}
+
+	// the builder continues with the built snapshot
+	builder.Add("azurerm_test_b", MetricRow{Labels: prometheus.Labels{"resourceName": "c"}, Value: 3})
+	if next := builder.Build(); next.Len() != 4 || derived.Len() != 3 || len(next.MetricRows("azurerm_test_b")) != 1 {
+		t.Errorf("expected re-added metric only in the next snapshot, got %v and %v", next.MetricNames(), derived.MetricNames())
+	}
+}
+
+// TestCachedSnapshotParallelBuilders derives snapshots of one cached snapshot while it's scraped (run with -race)
+func TestCachedSnapshotParallelBuilders(t *testing.T) {
+	cacheData, err := newTestMetricList(5, 50).Snapshot().MarshalCache(time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := NewMetricListFromCache(cacheData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			prober := newTestProber(context.Background())
+			prober.publishCacheEntry(entry)
+			if _, err := prober.Gatherer().Gather(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+
+			builder := entry.List.Builder()
+			builder.Add("azurerm_test_metric_0", MetricRow{Labels: prometheus.Labels{"resourceID": fmt.Sprintf("derived%d", i), "aggregation": "average"}, Value: 1})
+			builder.Remove("azurerm_test_metric_1")
+			if derived := builder.Build(); derived.Rows() != 4*50+1 {
+				t.Errorf("expected %d rows, got %d", 4*50+1, derived.Rows())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if rows := entry.List.Rows(); rows != 5*50 {
+		t.Errorf("cached snapshot was changed, got %d rows", rows)
+	}
+}
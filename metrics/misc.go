@@ -3,6 +3,8 @@ package metrics
 import (
 	"fmt"
 	"net/url"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -38,3 +40,15 @@ func stringToStringList(v string, sep string) (list []string) {
 	}
 	return
 }
+
+// normalizeStringList returns the trimmed, sorted and deduplicated list (without empty values)
+func normalizeStringList(list []string) []string {
+	ret := []string{}
+	for _, val := range list {
+		if val = strings.TrimSpace(val); val != "" {
+			ret = append(ret, val)
+		}
+	}
+	sort.Strings(ret)
+	return slices.Compact(ret)
+}
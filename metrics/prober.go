@@ -4,14 +4,19 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
 	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/webdevops/go-common/azuresdk/armclient"
 	"github.com/webdevops/go-common/utils/to"
@@ -30,25 +35,45 @@ type (
 
 		AzureClient             *armclient.ArmClient
 		AzureResourceTagManager *armclient.ResourceTagManager
+		RateLimitGovernor       *RateLimitGovernor
+		RetryPolicy             *RetryPolicy
+		RequestLimiter          *RequestLimiter
 
 		userAgent string
 
+		// transport and credential of the Azure clients created by the prober (eg. a fake Azure API in tests),
+		// the defaults of AzureClient are used if not set
+		azureTransport  policy.Transporter
+		azureCredential azcore.TokenCredential
+
+		// display names of the subscriptions by id, looked up once per probe
+		subscriptionNames sync.Map
+
 		settings *RequestMetricSettings
 
 		response http.ResponseWriter
 
 		ctx context.Context
 
+		// collection is stopped this duration before the deadline of ctx
+		deadlineMargin time.Duration
+
+		// age of the metrics served from cache
+		cacheAge time.Duration
+
+		// stale metrics were served from cache
+		revalidate bool
+
 		logger *zap.SugaredLogger
 
 		metricsCache struct {
-			cache         *cache.Cache
+			cache         Cache
 			cacheKey      *string
 			cacheDuration *time.Duration
 		}
 
 		serviceDiscoveryCache struct {
-			cache         *cache.Cache
+			cache         Cache
 			cacheDuration *time.Duration
 		}
 
@@ -56,10 +81,17 @@ type (
 
 		metricList *MetricList
 
+		// immutable metrics of the finished collection (or from cache), published and cached
+		metricSnapshot *MetricListSnapshot
+
 		prometheus struct {
-			registry *prometheus.Registry
+			registry  *prometheus.Registry
+			collector *metricListCollector
 		}
 
+		status       *probeStatus
+		statusLabels prometheus.Labels
+
 		callbackSubscriptionFishish func(subscriptionId string)
 
 		ServiceDiscovery AzureServiceDiscovery
@@ -67,6 +99,7 @@ type (
 
 	MetricProbeTarget struct {
 		ResourceId   string
+		Location     string
 		Metrics      []string
 		Aggregations []string
 		Tags         map[string]string
@@ -89,6 +122,11 @@ func (p *MetricProber) Init() {
 	p.targets = map[string][]MetricProbeTarget{}
 
 	p.metricList = NewMetricList()
+	if p.settings != nil {
+		p.metricList.SetMergePolicy(p.settings.MergePolicy, p.settings.Datapoint == DatapointPolicyAll)
+	}
+	p.metricSnapshot = nil
+	p.status = newProbeStatus()
 }
 func (p *MetricProber) RegisterSubscriptionCollectFinishCallback(callback func(subscriptionId string)) {
 	p.callbackSubscriptionFishish = callback
@@ -110,13 +148,83 @@ func (p *MetricProber) SetAzureResourceTagManager(client *armclient.ResourceTagM
 	p.AzureResourceTagManager = client
 }
 
-func (p *MetricProber) EnableMetricsCache(cache *cache.Cache, cacheKey string, cacheDuration *time.Duration) {
+func (p *MetricProber) SetRateLimitGovernor(governor *RateLimitGovernor) {
+	p.RateLimitGovernor = governor
+}
+
+func (p *MetricProber) SetRetryPolicy(retryPolicy *RetryPolicy) {
+	p.RetryPolicy = retryPolicy
+}
+
+func (p *MetricProber) SetRequestLimiter(limiter *RequestLimiter) {
+	p.RequestLimiter = limiter
+}
+
+// SetDeadlineMargin sets the time before the deadline of the probe at which the collection is stopped
+func (p *MetricProber) SetDeadlineMargin(margin time.Duration) {
+	p.deadlineMargin = margin
+}
+
+// azureCred returns the credential of the Azure clients
+func (p *MetricProber) azureCred() azcore.TokenCredential {
+	if p.azureCredential != nil {
+		return p.azureCredential
+	}
+	return p.AzureClient.GetCred()
+}
+
+// armClientOptions returns the client options for arm clients (with rate limit governor and request limiter if enabled)
+// subscription and tag lookups of the AzureClient use its own clients and bypass both
+func (p *MetricProber) armClientOptions() *arm.ClientOptions {
+	clientOpts := p.AzureClient.NewArmClientOptions()
+	if p.azureTransport != nil {
+		clientOpts.Transport = p.azureTransport
+	}
+	if p.RateLimitGovernor != nil {
+		clientOpts.PerCallPolicies = append(
+			clientOpts.PerCallPolicies,
+			p.RateLimitGovernor.Policy(),
+		)
+	}
+	if p.RequestLimiter != nil {
+		clientOpts.PerRetryPolicies = append(
+			clientOpts.PerRetryPolicies,
+			p.RequestLimiter.Policy(),
+		)
+	}
+	return clientOpts
+}
+
+// subscriptionName returns the display name of the subscription (empty if the lookup failed),
+// the name is looked up once per probe (subscriptions are cached by the AzureClient)
+func (p *MetricProber) subscriptionName(subscriptionId string) string {
+	if name, exists := p.subscriptionNames.Load(subscriptionId); exists {
+		return name.(string)
+	}
+
+	name := ""
+	if subscription, err := p.AzureClient.GetCachedSubscription(p.ctx, subscriptionId); err == nil && subscription != nil {
+		name = to.String(subscription.DisplayName)
+	}
+	p.subscriptionNames.Store(subscriptionId, name)
+	return name
+}
+
+// addResourceTagLabels adds the configured resource tags as labels
+func (p *MetricProber) addResourceTagLabels(labels prometheus.Labels, resourceId string) prometheus.Labels {
+	if p.AzureResourceTagManager == nil {
+		return labels
+	}
+	return p.AzureResourceTagManager.AddResourceTagsToPrometheusLabels(p.ctx, labels, resourceId)
+}
+
+func (p *MetricProber) EnableMetricsCache(cache Cache, cacheKey string, cacheDuration *time.Duration) {
 	p.metricsCache.cache = cache
 	p.metricsCache.cacheKey = &cacheKey
 	p.metricsCache.cacheDuration = cacheDuration
 }
 
-func (p *MetricProber) EnableServiceDiscoveryCache(cache *cache.Cache, cacheDuration *time.Duration) {
+func (p *MetricProber) EnableServiceDiscoveryCache(cache Cache, cacheDuration *time.Duration) {
 	p.serviceDiscoveryCache.cache = cache
 	p.serviceDiscoveryCache.cacheDuration = cacheDuration
 }
@@ -138,41 +246,203 @@ func (p *MetricProber) AddTarget(targets ...MetricProbeTarget) {
 	}
 }
 
+// FetchFromCache publishes the cached metrics if fresh (or stale with cache mode stale-while-revalidate,
+// see NeedsRevalidation), returns false if the probe needs to run
 func (p *MetricProber) FetchFromCache() bool {
-	if p.metricsCache.cache == nil {
+	entry := p.loadFromCache()
+	if entry == nil {
 		return false
 	}
 
-	if val, ok := p.metricsCache.cache.Get(*p.metricsCache.cacheKey); ok {
-		p.metricList = val.(*MetricList)
-		p.publishMetricList()
-		return true
+	if entry.IsStale(time.Now()) {
+		if p.settings.CacheMode != CacheModeStaleWhileRevalidate {
+			return false
+		}
+		p.revalidate = true
 	}
 
-	return false
+	p.publishCacheEntry(entry)
+	return true
 }
 
-func (p *MetricProber) SaveToCache() {
+// FetchStaleFromCache publishes the last good cached metrics (up to max stale) if the probe failed,
+// only with cache modes stale-if-error and stale-while-revalidate
+func (p *MetricProber) FetchStaleFromCache() bool {
+	if p.settings.CacheMode != CacheModeStaleIfError && p.settings.CacheMode != CacheModeStaleWhileRevalidate {
+		return false
+	}
+
+	entry := p.loadFromCache()
+	if entry == nil {
+		return false
+	}
+
+	p.logger.Debugf("probe failed, using stale metrics from cache (age %s)", entry.Age(time.Now()).String())
+	p.publishCacheEntry(entry)
+	return true
+}
+
+// NeedsRevalidation returns true if stale metrics were served from cache and need to be refreshed in background
+func (p *MetricProber) NeedsRevalidation() bool {
+	return p.revalidate
+}
+
+// loadFromCache returns the cached metrics (fresh or stale up to max stale), nil if not found
+func (p *MetricProber) loadFromCache() *MetricListCacheEntry {
 	if p.metricsCache.cache == nil {
-		return
+		return nil
+	}
+
+	cacheData, ok, err := p.metricsCache.cache.Get(*p.metricsCache.cacheKey)
+	if err != nil {
+		p.logger.Warnf("unable to fetch metrics from cache: %v", err)
+		return nil
+	} else if !ok {
+		return nil
+	}
+
+	entry, err := NewMetricListFromCache(cacheData)
+	if err != nil {
+		p.logger.Debugf("unable to parse cached metrics: %v", err)
+		return nil
+	}
+
+	if entry.IsStale(time.Now()) && time.Since(entry.ExpiresAt) > p.settings.CacheMaxStale {
+		return nil
+	}
+
+	return entry
+}
+
+func (p *MetricProber) publishCacheEntry(entry *MetricListCacheEntry) {
+	now := time.Now()
+	p.cacheAge = entry.Age(now)
+
+	if p.response != nil {
+		p.response.Header().Add("X-metrics-cache-age", strconv.FormatInt(int64(p.cacheAge.Seconds()), 10))
+		if entry.IsStale(now) {
+			p.response.Header().Add("X-metrics-stale", "true")
+		}
+	}
+
+	p.metricSnapshot = entry.List
+	p.publishMetricList()
+	p.publishProbeStatus()
+}
+
+// isFailed returns true if the probe didn't collect any metrics because of errors
+func (p *MetricProber) isFailed() bool {
+	return p.status.hasErrors() && p.metrics().Len() == 0
+}
+
+func (p *MetricProber) SaveToCache() {
+	if cachedUntil := p.saveToCache(); cachedUntil != nil && p.response != nil {
+		p.response.Header().Add("X-metrics-cached-until", cachedUntil.Format(time.RFC3339))
+	}
+}
+
+// saveToCache stores the metrics in the cache and returns the expiry (nil if not cached)
+func (p *MetricProber) saveToCache() *time.Time {
+	if p.metricsCache.cache == nil || p.metricsCache.cacheDuration == nil {
+		return nil
+	}
+
+	// incomplete metrics would be served until the cache expires
+	if p.status.isPartial() {
+		p.logger.Debug("not saving partial metrics to cache")
+		return nil
+	}
+
+	// keep the last good metrics (served stale on errors)
+	if p.isFailed() {
+		p.logger.Debug("not saving failed probe to cache")
+		return nil
+	}
+
+	cachedUntil := time.Now().Add(*p.metricsCache.cacheDuration)
+	snapshot := p.metrics()
+	cacheData, err := snapshot.MarshalCache(p.status.startTime, cachedUntil)
+	if err != nil {
+		p.logger.Warnf("unable to serialize metrics for cache: %v", err)
+		return nil
+	}
+
+	// stale entries are kept for max stale after expiry
+	ttl := *p.metricsCache.cacheDuration
+	if p.settings.CacheMode == CacheModeStaleIfError || p.settings.CacheMode == CacheModeStaleWhileRevalidate {
+		ttl += p.settings.CacheMaxStale
 	}
 
-	if p.metricsCache.cacheDuration != nil {
-		_ = p.metricsCache.cache.Add(*p.metricsCache.cacheKey, p.metricList, *p.metricsCache.cacheDuration)
-		p.response.Header().Add("X-metrics-cached-until", time.Now().Add(*p.metricsCache.cacheDuration).Format(time.RFC3339))
+	// series are limited by the memory cache
+	if err := setCacheWithSeries(p.metricsCache.cache, *p.metricsCache.cacheKey, cacheData, ttl, int64(snapshot.Rows())); err != nil {
+		p.logger.Warnf("unable to save metrics to cache: %v", err)
+		return nil
 	}
+
+	return &cachedUntil
 }
 
-func (p *MetricProber) Run() {
-	p.collectMetricsFromTargets()
+func (p *MetricProber) Run() error {
+	if err := p.collectWithDeadline(p.collectMetricsFromTargets); err != nil {
+		return err
+	}
 	p.SaveToCache()
 	p.publishMetricList()
+	p.publishProbeStatus()
+	return nil
 }
 
-func (p *MetricProber) RunOnSubscriptionScope() {
-	p.collectMetricsFromSubscriptions()
+func (p *MetricProber) RunOnSubscriptionScope() error {
+	if err := p.collectWithDeadline(p.collectMetricsFromSubscriptions); err != nil {
+		return err
+	}
 	p.SaveToCache()
 	p.publishMetricList()
+	p.publishProbeStatus()
+	return nil
+}
+
+// collectWithDeadline runs the collection until the deadline of the probe minus the safety margin (max 1/4 of
+// the remaining time), so the collected metrics can still be sent. No further requests are started afterwards
+// and the probe is marked as partial. Returns the collision error of merge policy "error".
+func (p *MetricProber) collectWithDeadline(collect func()) error {
+	ctx := p.ctx
+	if deadline, exists := ctx.Deadline(); exists && p.deadlineMargin > 0 {
+		margin := p.deadlineMargin
+		if maxMargin := time.Until(deadline) / 4; margin > maxMargin {
+			margin = maxMargin
+		}
+
+		collectCtx, cancel := context.WithDeadline(ctx, deadline.Add(-margin))
+		p.ctx = collectCtx
+		defer func() {
+			cancel()
+			p.ctx = ctx
+		}()
+	}
+
+	collect()
+
+	if p.ctx.Err() != nil {
+		p.status.setPartial()
+	}
+
+	p.status.addCollisions(p.metricList.Collisions())
+	if err := p.metricList.MergeError(); err != nil {
+		return err
+	}
+
+	// collection is finished, the metrics are not changed anymore
+	p.metricSnapshot = p.metricList.Snapshot()
+	return nil
+}
+
+// metrics returns the immutable metrics of the probe (collected or from cache)
+func (p *MetricProber) metrics() *MetricListSnapshot {
+	if p.metricSnapshot == nil {
+		p.metricSnapshot = p.metricList.Snapshot()
+	}
+	return p.metricSnapshot
 }
 
 func (p *MetricProber) collectMetricsFromSubscriptions() {
@@ -184,7 +454,10 @@ func (p *MetricProber) collectMetricsFromSubscriptions() {
 	go func() {
 		regions, err := p.discoverResourceRegions()
 		if err != nil {
-			p.logger.Error(fmt.Errorf("error getting subscription locations: %w", err))
+			for _, subscriptionId := range p.settings.Subscriptions {
+				p.reportSubscriptionError(subscriptionId, ProbeErrorReasonDiscovery, fmt.Errorf("error getting subscription locations: %w", err))
+			}
+			close(metricsChannel)
 			return
 		}
 
@@ -192,10 +465,14 @@ func (p *MetricProber) collectMetricsFromSubscriptions() {
 			subscriptionRegions := regions[*subscription.SubscriptionID]
 
 			for _, region := range subscriptionRegions {
+				if p.ctx.Err() != nil {
+					p.reportSubscriptionError(*subscription.SubscriptionID, ProbeErrorReasonRequest, p.ctx.Err())
+					return
+				}
+
 				client, err := p.MetricsClient(*subscription.SubscriptionID)
 				if err != nil {
-					// FIXME: find a better way to report errors
-					p.logger.Error(err)
+					p.reportSubscriptionError(*subscription.SubscriptionID, ProbeErrorReasonClient, err)
 					return
 				}
 
@@ -207,6 +484,11 @@ func (p *MetricProber) collectMetricsFromSubscriptions() {
 					}
 					metricList := p.settings.Metrics[i:end]
 
+					if p.ctx.Err() != nil {
+						p.reportSubscriptionError(*subscription.SubscriptionID, ProbeErrorReasonRequest, p.ctx.Err())
+						return
+					}
+
 					resultType := armmonitor.MetricResultTypeData
 					opts := armmonitor.MetricsClientListAtSubscriptionScopeOptions{
 						Interval:            p.settings.Interval,
@@ -238,8 +520,7 @@ func (p *MetricProber) collectMetricsFromSubscriptions() {
 
 					response, err := client.ListAtSubscriptionScope(p.ctx, region, &opts)
 					if err != nil {
-						// FIXME: find a better way to report errors
-						p.logger.Error(err)
+						p.reportSubscriptionError(*subscription.SubscriptionID, ProbeErrorReasonRequest, err)
 						return
 					}
 
@@ -258,21 +539,13 @@ func (p *MetricProber) collectMetricsFromSubscriptions() {
 			}
 		})
 		if err != nil {
-			// FIXME: find a better way to report errors
-			p.logger.Error(err)
+			p.reportSubscriptionError("", ProbeErrorReasonDiscovery, err)
 		}
 
 		close(metricsChannel)
 	}()
 
-	for result := range metricsChannel {
-		metric := MetricRow{
-			Labels: result.Labels,
-			Value:  result.Value,
-		}
-		p.metricList.Add(result.Name, metric)
-		p.metricList.SetMetricHelp(result.Name, result.Help)
-	}
+	p.addMetricsFromChannel(metricsChannel)
 }
 
 func (p *MetricProber) discoverResourceRegions() (map[string][]string, error) {
@@ -318,31 +591,90 @@ func (p *MetricProber) collectMetricsFromTargets() {
 			go func(subscriptionId string, targetList []MetricProbeTarget) {
 				defer wgSubscription.Done()
 
+				for _, target := range targetList {
+					p.status.setTargetUp(target.ResourceId, true)
+				}
+
 				wgSubscriptionResource := sizedwaitgroup.New(p.Conf.Prober.ConcurrencySubscriptionResource)
 				client, err := p.MetricsClient(subscriptionId)
 				if err != nil {
-					// FIXME: find a better way to report errors
-					p.logger.Error(err)
+					p.reportSubscriptionError(subscriptionId, ProbeErrorReasonClient, err)
+					for _, target := range targetList {
+						p.status.setTargetUp(target.ResourceId, false)
+					}
 					return
 				}
 
+				// query multiple resources per request using the batch api,
+				// resources without known region are still fetched using the arm api
+				if p.settings.Api == MetricApiBatch {
+					batchClient, err := p.MetricsBatchClient()
+					if err != nil {
+						p.reportSubscriptionError(subscriptionId, ProbeErrorReasonClient, err)
+						for _, target := range targetList {
+							p.status.setTargetUp(target.ResourceId, false)
+						}
+						return
+					}
+
+					var groupList []*metricsBatchGroup
+					groupList, targetList = p.buildMetricsBatchGroups(subscriptionId, targetList)
+					for _, group := range groupList {
+						wgSubscriptionResource.Add()
+						go func(group *metricsBatchGroup) {
+							defer wgSubscriptionResource.Done()
+
+							// FetchMetricsBatch returns the error of the canceled ctx before any request
+							if err := p.FetchMetricsBatch(batchClient, group, metricsChannel); err != nil {
+								reason := probeErrorReason(err, ProbeErrorReasonRequest)
+								p.logger.With(zap.String("region", group.Region), zap.String("resourceType", group.ResourceType), zap.String("reason", reason)).Warn(err)
+								p.status.addError(subscriptionId, reason)
+								for _, target := range group.Targets {
+									p.status.setTargetUp(target.ResourceId, false)
+								}
+							}
+						}(group)
+					}
+				}
+
 				for _, target := range targetList {
 					wgSubscriptionResource.Add()
 					go func(target MetricProbeTarget) {
 						defer wgSubscriptionResource.Done()
 
-						// request metrics in 20 metrics chunks (azure metric api limitation)
-						for i := 0; i < len(target.Metrics); i += AzureMetricApiMaxMetricNumber {
-							end := i + AzureMetricApiMaxMetricNumber
-							if end > len(target.Metrics) {
-								end = len(target.Metrics)
-							}
-							metricList := target.Metrics[i:end]
+						// probe is gone or timed out, don't start any further requests
+						if p.ctx.Err() != nil {
+							p.reportTargetError(subscriptionId, target, ProbeErrorReasonRequest, p.ctx.Err())
+							return
+						}
+
+						// expand metric name patterns
+						queryList, err := p.buildMetricQueries(target)
+						if err != nil {
+							p.reportTargetError(subscriptionId, target, ProbeErrorReasonQuery, err)
+							return
+						}
 
-							if result, err := p.FetchMetricsFromTarget(client, target, metricList, target.Aggregations); err == nil {
-								result.SendMetricToChannel(metricsChannel)
-							} else {
-								p.logger.With(zap.String("resourceID", target.ResourceId)).Warn(err)
+						for _, query := range queryList {
+							// request metrics in 20 metrics chunks (azure metric api limitation)
+							for i := 0; i < len(query.Metrics); i += AzureMetricApiMaxMetricNumber {
+								end := i + AzureMetricApiMaxMetricNumber
+								if end > len(query.Metrics) {
+									end = len(query.Metrics)
+								}
+								metricList := query.Metrics[i:end]
+
+								// no further chunk requests after the deadline, the fetched chunks are still published
+								if p.ctx.Err() != nil {
+									p.reportTargetError(subscriptionId, target, ProbeErrorReasonRequest, p.ctx.Err())
+									return
+								}
+
+								if result, err := p.FetchMetricsFromTarget(client, target, metricList, query.Aggregations); err == nil {
+									result.SendMetricToChannel(metricsChannel)
+								} else {
+									p.reportTargetError(subscriptionId, target, ProbeErrorReasonRequest, err)
+								}
 							}
 						}
 					}(target)
@@ -358,10 +690,21 @@ func (p *MetricProber) collectMetricsFromTargets() {
 		close(metricsChannel)
 	}()
 
+	p.addMetricsFromChannel(metricsChannel)
+}
+
+// addMetricsFromChannel adds the metrics of the channel to the metric list until the channel is closed,
+// the channel is always drained (also after the deadline), so producers never block
+func (p *MetricProber) addMetricsFromChannel(metricsChannel <-chan PrometheusMetricResult) {
 	for result := range metricsChannel {
+		if !p.settings.relabelMetric(&result) {
+			continue
+		}
+
 		metric := MetricRow{
-			Labels: result.Labels,
-			Value:  result.Value,
+			Labels:    result.Labels,
+			Value:     result.Value,
+			Timestamp: result.Timestamp,
 		}
 		p.metricList.Add(result.Name, metric)
 		p.metricList.SetMetricHelp(result.Name, result.Help)
@@ -369,23 +712,40 @@ func (p *MetricProber) collectMetricsFromTargets() {
 }
 
 func (p *MetricProber) publishMetricList() {
-	if p.metricList == nil {
-		return
-	}
-
-	// create prometheus metrics and set rows
-	for _, metricName := range p.metricList.GetMetricNames() {
-		gauge := prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: metricName,
-				Help: p.metricList.GetMetricHelp(metricName),
-			},
-			p.metricList.GetMetricLabelNames(metricName),
-		)
-		p.prometheus.registry.MustRegister(gauge)
+	// gauges are always exposed with scrape time, timestamps of datapoints are only used if enabled
+	timestamps := p.settings.MetricTimestamp || p.settings.Datapoint == DatapointPolicyAll
+
+	p.prometheus.collector = newMetricListCollector(p.metrics(), timestamps)
+	if err := p.prometheus.registry.Register(p.prometheus.collector); err != nil {
+		// eg. invalid metric or label names, the probe status is still published
+		p.logger.Errorf("unable to register metrics: %v", err)
+		p.prometheus.collector = nil
+	}
+}
 
-		for _, row := range p.metricList.GetMetricList(metricName) {
-			gauge.With(row.Labels).Set(row.Value)
-		}
+// Gatherer returns the gatherer for the probe response, with datapoint policy "all"
+// the older datapoints of each series are added to the gathered metrics
+func (p *MetricProber) Gatherer() prometheus.Gatherer {
+	if p.settings.Datapoint != DatapointPolicyAll {
+		return p.prometheus.registry
 	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := p.prometheus.registry.Gather()
+		if err != nil {
+			return families, err
+		}
+
+		if p.prometheus.collector == nil {
+			return families, nil
+		}
+
+		for _, family := range families {
+			if err := p.prometheus.collector.appendHistory(family); err != nil {
+				return families, err
+			}
+		}
+
+		return families, nil
+	})
 }
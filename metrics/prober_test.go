@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+func newTestProber(ctx context.Context) *MetricProber {
+	settings := RequestMetricSettings{
+		Name:        PrometheusMetricNameDefault,
+		Datapoint:   DatapointPolicyDefault,
+		MergePolicy: MergePolicyDefault,
+	}
+	prober := NewMetricProber(ctx, zap.NewNop().Sugar(), nil, &settings, config.Opts{})
+	prober.SetPrometheusRegistry(prometheus.NewRegistry())
+	return prober
+}
+
+// testMetricNames returns count metric names (metric0, metric1, ...)
+func testMetricNames(count int) []string {
+	ret := []string{}
+	for i := 0; i < count; i++ {
+		ret = append(ret, fmt.Sprintf("metric%d", i))
+	}
+	return ret
+}
+
+// blockingAzureHandler answers the first chunk of every target, all further requests block until they are canceled
+func blockingAzureHandler(req *http.Request, body []byte) (int, any) {
+	if strings.HasPrefix(req.URL.Query().Get("metricnames"), "metric0,") {
+		return fakeAzureMetricsResponse(req, body)
+	}
+	<-req.Context().Done()
+	return http.StatusGatewayTimeout, nil
+}
+
+func TestCollectWithDeadlinePublishesMetricsFetchedBeforeMargin(t *testing.T) {
+	const resources = 20
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	transport := &fakeAzureTransport{handler: blockingAzureHandler}
+	prober := newTestAzureProber(ctx, transport)
+	prober.SetDeadlineMargin(100 * time.Millisecond)
+
+	// three chunks per target, only the first one is answered before the deadline
+	metricNames := testMetricNames(AzureMetricApiMaxMetricNumber*2 + 5)
+	for i := 0; i < resources; i++ {
+		prober.AddTarget(MetricProbeTarget{ResourceId: testResourceId("Microsoft.KeyVault/vaults", i), Metrics: metricNames})
+	}
+
+	if err := prober.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !prober.status.isPartial() {
+		t.Error("collection stopped at the deadline must be partial")
+	}
+
+	if rows := prober.metrics().MetricRows(PrometheusMetricNameDefault); len(rows) != resources*AzureMetricApiMaxMetricNumber {
+		t.Errorf("expected %d published rows of the first chunks, got %d", resources*AzureMetricApiMaxMetricNumber, len(rows))
+	}
+
+	// no chunk request is started after the deadline
+	if requests := len(transport.Requests("/providers/Microsoft.Insights/metrics")); requests != resources*2 {
+		t.Errorf("expected %d requests (two chunks per target), got %d", resources*2, requests)
+	}
+}
+
+func TestCanceledProbeLeavesNoProducerGoroutines(t *testing.T) {
+	testCases := []struct {
+		name string
+		api  string
+	}{
+		{"arm api", MetricApiArm},
+		{"batch api", MetricApiBatch},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// all Azure requests block until the probe is canceled
+			transport := &fakeAzureTransport{handler: func(req *http.Request, body []byte) (int, any) {
+				<-req.Context().Done()
+				return http.StatusGatewayTimeout, nil
+			}}
+			prober := newTestAzureProber(ctx, transport)
+			prober.settings.Api = testCase.api
+
+			// counted after the Azure client is created (its cache runs a cleanup goroutine)
+			goroutines := runtime.NumGoroutine()
+
+			metricNames := testMetricNames(AzureMetricApiMaxMetricNumber*2 + 5)
+			for i := 0; i < 30; i++ {
+				prober.AddTarget(MetricProbeTarget{ResourceId: testResourceId("Microsoft.KeyVault/vaults", i), Location: "westeurope", Metrics: metricNames})
+			}
+
+			time.AfterFunc(50*time.Millisecond, cancel)
+			if err := prober.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !prober.status.isPartial() {
+				t.Error("canceled collection must be partial")
+			}
+			if len(transport.Requests("")) == 0 {
+				t.Error("expected requests before the probe was canceled")
+			}
+
+			// producers finish after the channel is drained
+			deadline := time.Now().Add(2 * time.Second)
+			for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if leaked := runtime.NumGoroutine() - goroutines; leaked > 0 {
+				t.Errorf("canceled probe left %d goroutines behind", leaked)
+			}
+		})
+	}
+}
+
+func TestFetchFromCacheServesStaleMetricsWithAge(t *testing.T) {
+	cache := NewMemoryCache(MemoryCacheConfig{})
+	defer cache.Close() // nolint:errcheck
+
+	list := NewMetricList()
+	list.Add(PrometheusMetricNameDefault, MetricRow{Labels: prometheus.Labels{"resourceName": "a"}, Value: 1})
+	cacheData, err := list.Snapshot().MarshalCache(time.Now().Add(-2*time.Minute), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("list:test", cacheData, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		cacheMode  string
+		cached     bool
+		revalidate bool
+	}{
+		{CacheModeFresh, false, false},
+		{CacheModeStaleIfError, false, false},
+		{CacheModeStaleWhileRevalidate, true, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.cacheMode, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			settings := RequestMetricSettings{
+				Name:          PrometheusMetricNameDefault,
+				Datapoint:     DatapointPolicyDefault,
+				MergePolicy:   MergePolicyDefault,
+				CacheMode:     testCase.cacheMode,
+				CacheMaxStale: time.Hour,
+			}
+			cacheDuration := time.Minute
+			prober := NewMetricProber(context.Background(), zap.NewNop().Sugar(), response, &settings, config.Opts{})
+			prober.SetPrometheusRegistry(prometheus.NewRegistry())
+			prober.EnableMetricsCache(cache, "list:test", &cacheDuration)
+
+			if cached := prober.FetchFromCache(); cached != testCase.cached {
+				t.Fatalf("expected cached=%v, got %v", testCase.cached, cached)
+			}
+			if prober.NeedsRevalidation() != testCase.revalidate {
+				t.Errorf("expected revalidate=%v", testCase.revalidate)
+			}
+			if !testCase.cached {
+				return
+			}
+
+			if response.Header().Get("X-metrics-stale") != "true" {
+				t.Error("expected stale header")
+			}
+			if age, err := strconv.Atoi(response.Header().Get("X-metrics-cache-age")); err != nil || age < 120 {
+				t.Errorf("expected cache age of at least 120s, got %q", response.Header().Get("X-metrics-cache-age"))
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	ProbeTargetUpName          = "azurerm_probe_target_up"
+	ProbeErrorsName            = "azurerm_probe_errors_total"
+	ProbeDurationName          = "azurerm_probe_duration_seconds"
+	ProbeTargetsDiscoveredName = "azurerm_probe_targets_discovered"
+	ProbePartialName           = "azurerm_probe_partial"
+	ProbeCacheAgeName          = "azurerm_probe_cache_age_seconds"
+	ProbeSeriesCollisionsName  = "azurerm_probe_series_collisions"
+)
+
+const (
+	ProbeErrorReasonClient    = "client"
+	ProbeErrorReasonDiscovery = "discovery"
+	ProbeErrorReasonQuery     = "query"
+	ProbeErrorReasonRequest   = "request"
+	ProbeErrorReasonThrottled = "throttled"
+	ProbeErrorReasonAuth      = "unauthorized"
+	ProbeErrorReasonNotFound  = "notfound"
+	ProbeErrorReasonTimeout   = "timeout"
+	ProbeErrorReasonCanceled  = "canceled"
+	ProbeErrorReasonLimited   = "limited"
+	ProbeErrorReasonTemplate  = "template"
+	ProbeErrorReasonCollision = "collision"
+)
+
+type (
+	// probeStatus collects the health of one probe run (target status and errors),
+	// exposed as metrics in the probe response
+	probeStatus struct {
+		lock sync.Mutex
+
+		startTime time.Time
+
+		// up status by resource id (lowercase)
+		targetUp map[string]bool
+
+		// error count by subscription and reason
+		errors map[probeStatusErrorKey]float64
+
+		// collection was stopped at the deadline, metrics are incomplete
+		partial bool
+
+		// rows merged by the merge policy by metric name
+		collisions map[string]float64
+	}
+
+	probeStatusErrorKey struct {
+		subscriptionId string
+		reason         string
+	}
+)
+
+func newProbeStatus() *probeStatus {
+	return &probeStatus{
+		startTime:  time.Now(),
+		targetUp:   map[string]bool{},
+		errors:     map[probeStatusErrorKey]float64{},
+		collisions: map[string]float64{},
+	}
+}
+
+// probeErrorReason classifies an Azure API error, fallback is used for unknown errors
+func probeErrorReason(err error, fallback string) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ProbeErrorReasonTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ProbeErrorReasonCanceled
+	}
+
+	if errors.Is(err, ErrRequestLimiterMaxWait) {
+		return ProbeErrorReasonLimited
+	}
+
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.StatusCode {
+		case http.StatusTooManyRequests:
+			return ProbeErrorReasonThrottled
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ProbeErrorReasonAuth
+		case http.StatusNotFound:
+			return ProbeErrorReasonNotFound
+		}
+	}
+
+	return fallback
+}
+
+func (s *probeStatus) setPartial() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.partial = true
+}
+
+func (s *probeStatus) isPartial() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.partial
+}
+
+func (s *probeStatus) hasErrors() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.errors) > 0
+}
+
+func (s *probeStatus) addError(subscriptionId, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors[probeStatusErrorKey{subscriptionId: strings.ToLower(subscriptionId), reason: reason}]++
+}
+
+func (s *probeStatus) addCollisions(collisions map[string]int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for metricName, count := range collisions {
+		s.collisions[metricName] += float64(count)
+	}
+}
+
+// setTargetUp sets the status of a target, a target stays down after the first failed request
+func (s *probeStatus) setTargetUp(resourceId string, up bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resourceId = strings.ToLower(resourceId)
+	if val, exists := s.targetUp[resourceId]; exists && !val {
+		return
+	}
+	s.targetUp[resourceId] = up
+}
+
+// SetProbeStatusLabels sets additional labels for the probe status metrics
+// (eg. to distinguish multiple probes exposed in one response)
+func (p *MetricProber) SetProbeStatusLabels(labels prometheus.Labels) {
+	p.statusLabels = labels
+}
+
+// reportSubscriptionError logs and counts an error which affects the whole subscription
+func (p *MetricProber) reportSubscriptionError(subscriptionId, reason string, err error) {
+	reason = probeErrorReason(err, reason)
+	p.logger.With(zap.String("subscriptionID", subscriptionId), zap.String("reason", reason)).Error(err)
+	p.status.addError(subscriptionId, reason)
+}
+
+// reportTargetError logs and counts an error of a target and marks the target as down
+func (p *MetricProber) reportTargetError(subscriptionId string, target MetricProbeTarget, reason string, err error) {
+	reason = probeErrorReason(err, reason)
+	p.logger.With(zap.String("resourceID", target.ResourceId), zap.String("reason", reason)).Warn(err)
+	p.status.addError(subscriptionId, reason)
+	p.status.setTargetUp(target.ResourceId, false)
+}
+
+// registerStatusCollector registers a probe status metric, a metric of the probe with the same name
+// (eg. a templated metric name) is kept and the collision is counted as probe error
+func (p *MetricProber) registerStatusCollector(collector prometheus.Collector, name string) bool {
+	if err := p.prometheus.registry.Register(collector); err != nil {
+		p.logger.With(zap.String("metric", name), zap.String("reason", ProbeErrorReasonCollision)).Warnf("unable to publish probe status metric: %v", err)
+		p.status.errors[probeStatusErrorKey{reason: ProbeErrorReasonCollision}]++
+		return false
+	}
+	return true
+}
+
+func (p *MetricProber) publishProbeStatus() {
+	s := p.status
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	targetUpGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        ProbeTargetUpName,
+			Help:        "Azure monitor probe target status (1 if all metric requests of the target succeeded)",
+			ConstLabels: p.statusLabels,
+		},
+		[]string{"resourceID"},
+	)
+	if p.registerStatusCollector(targetUpGauge, ProbeTargetUpName) {
+		for resourceId, up := range s.targetUp {
+			val := 0.0
+			if up {
+				val = 1
+			}
+			targetUpGauge.WithLabelValues(resourceId).Set(val)
+		}
+	}
+
+	targetsGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        ProbeTargetsDiscoveredName,
+			Help:        "Azure monitor probe number of discovered targets",
+			ConstLabels: p.statusLabels,
+		},
+		[]string{"subscriptionID"},
+	)
+	if p.registerStatusCollector(targetsGauge, ProbeTargetsDiscoveredName) {
+		for subscriptionId, targetList := range p.targets {
+			targetsGauge.WithLabelValues(strings.ToLower(subscriptionId)).Set(float64(len(targetList)))
+		}
+	}
+
+	durationGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:        ProbeDurationName,
+			Help:        "Azure monitor probe duration",
+			ConstLabels: p.statusLabels,
+		},
+	)
+	if p.registerStatusCollector(durationGauge, ProbeDurationName) {
+		durationGauge.Set(time.Since(s.startTime).Seconds())
+	}
+
+	partialGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:        ProbePartialName,
+			Help:        "Azure monitor probe partial result (1 if the collection was stopped at the deadline)",
+			ConstLabels: p.statusLabels,
+		},
+	)
+	if p.registerStatusCollector(partialGauge, ProbePartialName) && s.partial {
+		partialGauge.Set(1)
+	}
+
+	cacheAgeGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:        ProbeCacheAgeName,
+			Help:        "Azure monitor probe age of metrics served from cache (0 if collected by the probe)",
+			ConstLabels: p.statusLabels,
+		},
+	)
+	if p.registerStatusCollector(cacheAgeGauge, ProbeCacheAgeName) {
+		cacheAgeGauge.Set(p.cacheAge.Seconds())
+	}
+
+	// collisions of this probe run (the registry is created per probe, so this is a gauge, not a counter)
+	collisionsGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        ProbeSeriesCollisionsName,
+			Help:        "Azure monitor probe rows with duplicate name and labels merged by the merge policy in the probe run",
+			ConstLabels: p.statusLabels,
+		},
+		[]string{"metric"},
+	)
+	if p.registerStatusCollector(collisionsGauge, ProbeSeriesCollisionsName) {
+		for metricName, count := range s.collisions {
+			collisionsGauge.WithLabelValues(metricName).Set(count)
+		}
+	}
+
+	// errors are published last so collisions of the other status metrics are included,
+	// the registry is created per probe so the counter contains only the errors of this probe run
+	errorsCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        ProbeErrorsName,
+			Help:        "Azure monitor probe errors of the probe run",
+			ConstLabels: p.statusLabels,
+		},
+		[]string{"subscriptionID", "reason"},
+	)
+	if err := p.prometheus.registry.Register(errorsCounter); err != nil {
+		p.logger.With(zap.String("metric", ProbeErrorsName), zap.String("reason", ProbeErrorReasonCollision)).Warnf("unable to publish probe status metric: %v", err)
+		return
+	}
+
+	for key, count := range s.errors {
+		errorsCounter.WithLabelValues(key.subscriptionId, key.reason).Add(count)
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPublishProbeStatusKeepsMetricsWithStatusNames(t *testing.T) {
+	prober := newTestProber(context.Background())
+	prober.status.addError(testSubscriptionId, ProbeErrorReasonQuery)
+
+	// metric of the probe named like a status metric (eg. by the metric name template)
+	userGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: ProbePartialName, Help: "test"})
+	userGauge.Set(42)
+	prober.prometheus.registry.MustRegister(userGauge)
+
+	prober.publishProbeStatus()
+
+	families, err := prober.prometheus.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	familyByName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		familyByName[family.GetName()] = family
+	}
+
+	if family := familyByName[ProbePartialName]; family == nil || family.GetMetric()[0].GetGauge().GetValue() != 42 {
+		t.Errorf("expected metric of the probe to be kept, got %v", family)
+	}
+
+	errorsFamily := familyByName[ProbeErrorsName]
+	if errorsFamily == nil || errorsFamily.GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("expected counter %s, got %v", ProbeErrorsName, errorsFamily)
+	}
+
+	errorsByReason := map[string]float64{}
+	for _, metric := range errorsFamily.GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "reason" {
+				errorsByReason[label.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+
+	if errorsByReason[ProbeErrorReasonQuery] != 1 || errorsByReason[ProbeErrorReasonCollision] != 1 {
+		t.Errorf("expected query and collision errors, got %v", errorsByReason)
+	}
+}
@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"crypto/md5" // #nosec G501
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RelabelActionReplace   = "replace"
+	RelabelActionKeep      = "keep"
+	RelabelActionDrop      = "drop"
+	RelabelActionLabelMap  = "labelmap"
+	RelabelActionLabelDrop = "labeldrop"
+	RelabelActionHashMod   = "hashmod"
+
+	// label of the metric name in relabel rules (same as Prometheus)
+	relabelMetricNameLabel = "__name__"
+
+	// labels with this prefix are removed after relabeling (temporary labels)
+	relabelReservedLabelPrefix = "__"
+
+	staticLabelParamPrefix = "label."
+)
+
+type (
+	// RelabelConfig is a relabel rule in Prometheus relabel_config syntax
+	RelabelConfig struct {
+		SourceLabels []string `yaml:"source_labels"`
+		Separator    string   `yaml:"separator"`
+		Regex        string   `yaml:"regex"`
+		Modulus      uint64   `yaml:"modulus"`
+		TargetLabel  string   `yaml:"target_label"`
+		Replacement  string   `yaml:"replacement"`
+		Action       string   `yaml:"action"`
+
+		// anchored regex, set by compile
+		regex *regexp.Regexp
+	}
+)
+
+// UnmarshalYAML sets the Prometheus defaults of unset fields
+func (c *RelabelConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain RelabelConfig
+	config := plain{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelActionReplace,
+	}
+	if err := value.Decode(&config); err != nil {
+		return err
+	}
+	*c = RelabelConfig(config)
+	return nil
+}
+
+// compile validates the rule and compiles its regex
+func (c *RelabelConfig) compile() error {
+	c.Action = strings.ToLower(c.Action)
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex \"%s\": %w", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case RelabelActionReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action \"%s\" requires target_label", c.Action)
+		}
+		if !strings.Contains(c.TargetLabel, "$") && !metricLabelName.MatchString(c.TargetLabel) {
+			return fmt.Errorf("relabel target_label \"%s\" is not a valid label name", c.TargetLabel)
+		}
+	case RelabelActionHashMod:
+		if c.TargetLabel == "" || c.Modulus == 0 {
+			return fmt.Errorf("relabel action \"%s\" requires target_label and modulus", c.Action)
+		}
+		if !metricLabelName.MatchString(c.TargetLabel) {
+			return fmt.Errorf("relabel target_label \"%s\" is not a valid label name", c.TargetLabel)
+		}
+	case RelabelActionKeep, RelabelActionDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action \"%s\" requires source_labels", c.Action)
+		}
+	case RelabelActionLabelMap, RelabelActionLabelDrop:
+	default:
+		return fmt.Errorf("invalid relabel action \"%s\"", c.Action)
+	}
+
+	return nil
+}
+
+// apply applies the rule to the labels (metric name as __name__), returns false if the metric is dropped
+func (c *RelabelConfig) apply(labels map[string]string) bool {
+	values := make([]string, len(c.SourceLabels))
+	for i, labelName := range c.SourceLabels {
+		values[i] = labels[labelName]
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case RelabelActionKeep:
+		return c.regex.MatchString(value)
+	case RelabelActionDrop:
+		return !c.regex.MatchString(value)
+	case RelabelActionReplace:
+		match := c.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, match))
+		if !metricLabelName.MatchString(target) {
+			return true
+		}
+		if replacement := string(c.regex.ExpandString(nil, c.Replacement, value, match)); replacement != "" {
+			labels[target] = replacement
+		} else {
+			delete(labels, target)
+		}
+	case RelabelActionHashMod:
+		sum := md5.Sum([]byte(value)) // #nosec G401
+		labels[c.TargetLabel] = fmt.Sprintf("%d", binary.BigEndian.Uint64(sum[8:])%c.Modulus)
+	case RelabelActionLabelMap:
+		mapped := map[string]string{}
+		for labelName, labelValue := range labels {
+			if c.regex.MatchString(labelName) {
+				if target := c.regex.ReplaceAllString(labelName, c.Replacement); metricLabelName.MatchString(target) {
+					mapped[target] = labelValue
+				}
+			}
+		}
+		for labelName, labelValue := range mapped {
+			labels[labelName] = labelValue
+		}
+	case RelabelActionLabelDrop:
+		for labelName := range labels {
+			if labelName != relabelMetricNameLabel && c.regex.MatchString(labelName) {
+				delete(labels, labelName)
+			}
+		}
+	}
+
+	return true
+}
+
+// parseRelabelConfigs parses the rules of the parameter "relabel" (YAML or JSON, one rule or a list of rules per parameter)
+func parseRelabelConfigs(params url.Values) ([]*RelabelConfig, error) {
+	ret := []*RelabelConfig{}
+	for _, value := range params["relabel"] {
+		node := yaml.Node{}
+		if err := yaml.Unmarshal([]byte(value), &node); err != nil {
+			return nil, fmt.Errorf("parameter \"relabel\" is not valid: %w", err)
+		}
+		if len(node.Content) == 0 {
+			continue
+		}
+
+		rules := []*RelabelConfig{}
+		if node.Content[0].Kind == yaml.SequenceNode {
+			if err := node.Content[0].Decode(&rules); err != nil {
+				return nil, fmt.Errorf("parameter \"relabel\" is not valid: %w", err)
+			}
+		} else {
+			rule := RelabelConfig{}
+			if err := node.Content[0].Decode(&rule); err != nil {
+				return nil, fmt.Errorf("parameter \"relabel\" is not valid: %w", err)
+			}
+			rules = append(rules, &rule)
+		}
+		ret = append(ret, rules...)
+	}
+	return ret, nil
+}
+
+// parseStaticLabels returns the labels of the parameters "label.<name>"
+func parseStaticLabels(params url.Values) (map[string]string, error) {
+	ret := map[string]string{}
+	for param := range params {
+		if labelName, found := strings.CutPrefix(param, staticLabelParamPrefix); found {
+			ret[labelName] = params.Get(param)
+		}
+	}
+	return ret, validateStaticLabels(ret)
+}
+
+func validateStaticLabels(labels map[string]string) error {
+	for labelName := range labels {
+		if !metricLabelName.MatchString(labelName) || strings.HasPrefix(labelName, relabelReservedLabelPrefix) {
+			return fmt.Errorf("static label \"%s\" is not a valid label name", labelName)
+		}
+	}
+	return nil
+}
+
+// compileRelabelConfigs validates static labels and compiles the relabel rules
+func (s *RequestMetricSettings) compileRelabelConfigs() error {
+	if err := validateStaticLabels(s.StaticLabels); err != nil {
+		return err
+	}
+
+	for _, rule := range s.RelabelConfigs {
+		if rule == nil {
+			return fmt.Errorf("relabel rule is empty")
+		}
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relabelMetric adds the static labels and applies the relabel rules to the metric,
+// returns false if the metric is dropped
+func (s *RequestMetricSettings) relabelMetric(metric *PrometheusMetricResult) bool {
+	if len(s.StaticLabels) == 0 && len(s.RelabelConfigs) == 0 {
+		return true
+	}
+
+	for labelName, labelValue := range s.StaticLabels {
+		metric.Labels[labelName] = labelValue
+	}
+
+	if len(s.RelabelConfigs) == 0 {
+		return true
+	}
+
+	metric.Labels[relabelMetricNameLabel] = metric.Name
+	for _, rule := range s.RelabelConfigs {
+		if !rule.apply(metric.Labels) {
+			return false
+		}
+	}
+
+	metric.Name = metricNameNotAllowedChars.ReplaceAllString(metric.Labels[relabelMetricNameLabel], "")
+	for labelName := range metric.Labels {
+		if strings.HasPrefix(labelName, relabelReservedLabelPrefix) {
+			delete(metric.Labels, labelName)
+		}
+	}
+
+	// metric name was removed or replaced by an invalid name (eg. leading digit), which would fail the registration
+	return model.IsValidMetricName(model.LabelValue(metric.Name))
+}
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"maps"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabelConfigApply(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     RelabelConfig
+		labels   map[string]string
+		expected map[string]string
+		keep     bool
+	}{
+		{
+			name:     "replace",
+			rule:     RelabelConfig{SourceLabels: []string{"resourceGroup"}, Separator: ";", Regex: "(.*)", Replacement: "$1", TargetLabel: "rg", Action: RelabelActionReplace},
+			labels:   map[string]string{"resourceGroup": "example"},
+			expected: map[string]string{"resourceGroup": "example", "rg": "example"},
+			keep:     true,
+		},
+		{
+			name:     "replace with multiple source labels",
+			rule:     RelabelConfig{SourceLabels: []string{"a", "b"}, Separator: ";", Regex: "(.*);(.*)", Replacement: "$2-$1", TargetLabel: "c", Action: RelabelActionReplace},
+			labels:   map[string]string{"a": "foo", "b": "bar"},
+			expected: map[string]string{"a": "foo", "b": "bar", "c": "bar-foo"},
+			keep:     true,
+		},
+		{
+			name:     "replace without match",
+			rule:     RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "bar", Replacement: "$1", TargetLabel: "b", Action: RelabelActionReplace},
+			labels:   map[string]string{"a": "foo"},
+			expected: map[string]string{"a": "foo"},
+			keep:     true,
+		},
+		{
+			name:     "replace with empty value removes label",
+			rule:     RelabelConfig{SourceLabels: []string{"missing"}, Separator: ";", Regex: "(.*)", Replacement: "$1", TargetLabel: "a", Action: RelabelActionReplace},
+			labels:   map[string]string{"a": "foo"},
+			expected: map[string]string{},
+			keep:     true,
+		},
+		{
+			name:     "replace with target label of regex group",
+			rule:     RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "(.*)", Replacement: "value", TargetLabel: "label_$1", Action: RelabelActionReplace},
+			labels:   map[string]string{"a": "foo"},
+			expected: map[string]string{"a": "foo", "label_foo": "value"},
+			keep:     true,
+		},
+		{
+			name:     "keep",
+			rule:     RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "fo+", Action: RelabelActionKeep},
+			labels:   map[string]string{"a": "foo"},
+			expected: map[string]string{"a": "foo"},
+			keep:     true,
+		},
+		{
+			name:   "keep without match",
+			rule:   RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "f", Action: RelabelActionKeep},
+			labels: map[string]string{"a": "foo"},
+			keep:   false,
+		},
+		{
+			name:   "drop",
+			rule:   RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "foo", Action: RelabelActionDrop},
+			labels: map[string]string{"a": "foo"},
+			keep:   false,
+		},
+		{
+			name:     "drop without match",
+			rule:     RelabelConfig{SourceLabels: []string{"a"}, Separator: ";", Regex: "bar", Action: RelabelActionDrop},
+			labels:   map[string]string{"a": "foo"},
+			expected: map[string]string{"a": "foo"},
+			keep:     true,
+		},
+		{
+			name:     "labelmap",
+			rule:     RelabelConfig{Regex: "dimension(.+)", Replacement: "dim_$1", Action: RelabelActionLabelMap},
+			labels:   map[string]string{"dimensionApi": "GetSecret", "metric": "ServiceApiHit"},
+			expected: map[string]string{"dimensionApi": "GetSecret", "dim_Api": "GetSecret", "metric": "ServiceApiHit"},
+			keep:     true,
+		},
+		{
+			name:     "labeldrop",
+			rule:     RelabelConfig{Regex: "tag_.*|__name__", Action: RelabelActionLabelDrop},
+			labels:   map[string]string{"__name__": "azurerm", "tag_owner": "ops", "tag_env": "prod", "metric": "cpu"},
+			expected: map[string]string{"__name__": "azurerm", "metric": "cpu"},
+			keep:     true,
+		},
+		{
+			// same input and output as the hashmod test of Prometheus (model/relabel/relabel_test.go)
+			name:     "hashmod",
+			rule:     RelabelConfig{SourceLabels: []string{"c"}, Separator: ";", Regex: "(.*)", TargetLabel: "d", Modulus: 1000, Action: RelabelActionHashMod},
+			labels:   map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			expected: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+			keep:     true,
+		},
+		{
+			name:     "hashmod with multiple source labels",
+			rule:     RelabelConfig{SourceLabels: []string{"a", "b"}, Separator: ";", Regex: "(.*)", TargetLabel: "d", Modulus: 1000, Action: RelabelActionHashMod},
+			labels:   map[string]string{"a": "foo", "b": "bar"},
+			expected: map[string]string{"a": "foo", "b": "bar", "d": "750"},
+			keep:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := testCase.rule.compile(); err != nil {
+				t.Fatal(err)
+			}
+
+			labels := maps.Clone(testCase.labels)
+			if keep := testCase.rule.apply(labels); keep != testCase.keep {
+				t.Fatalf("expected keep %v, got %v", testCase.keep, keep)
+			}
+			if testCase.keep && !maps.Equal(labels, testCase.expected) {
+				t.Errorf("expected labels %v, got %v", testCase.expected, labels)
+			}
+		})
+	}
+}
+
+func TestRelabelConfigCompile(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rule  RelabelConfig
+		valid bool
+	}{
+		{"replace", RelabelConfig{Regex: "(.*)", TargetLabel: "rg", Action: "Replace"}, true},
+		{"replace without target label", RelabelConfig{Regex: "(.*)", Action: RelabelActionReplace}, false},
+		{"replace with invalid target label", RelabelConfig{Regex: "(.*)", TargetLabel: "1rg", Action: RelabelActionReplace}, false},
+		{"invalid regex", RelabelConfig{Regex: "(.*", TargetLabel: "rg", Action: RelabelActionReplace}, false},
+		{"hashmod", RelabelConfig{Regex: "(.*)", TargetLabel: "shard", Modulus: 2, Action: RelabelActionHashMod}, true},
+		{"hashmod without modulus", RelabelConfig{Regex: "(.*)", TargetLabel: "shard", Action: RelabelActionHashMod}, false},
+		{"keep without source labels", RelabelConfig{Regex: "(.*)", Action: RelabelActionKeep}, false},
+		{"drop", RelabelConfig{SourceLabels: []string{"a"}, Regex: "(.*)", Action: RelabelActionDrop}, true},
+		{"labeldrop", RelabelConfig{Regex: "tag_.*", Action: RelabelActionLabelDrop}, true},
+		{"unknown action", RelabelConfig{Regex: "(.*)", Action: "labelkeep"}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.rule.compile()
+			if testCase.valid && err != nil {
+				t.Errorf("expected valid rule, got %v", err)
+			}
+			if !testCase.valid && err == nil {
+				t.Error("expected error for invalid rule")
+			}
+		})
+	}
+}
+
+func TestParseRelabelConfigs(t *testing.T) {
+	params := url.Values{}
+	params.Add("relabel", "{source_labels: [resourceGroup], target_label: rg}")
+	params.Add("relabel", `[{"action": "labeldrop", "regex": "tag_.*"}, {"action": "hashmod", "source_labels": ["resourceID"], "target_label": "shard", "modulus": 4}]`)
+	params.Add("relabel", "")
+
+	rules, err := parseRelabelConfigs(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(rules))
+	}
+
+	// unset fields use the defaults of Prometheus
+	if rule := rules[0]; rule.Action != RelabelActionReplace || rule.Separator != ";" || rule.Regex != "(.*)" || rule.Replacement != "$1" {
+		t.Errorf("expected defaults of Prometheus, got %+v", *rule)
+	}
+	if rule := rules[2]; rule.Action != RelabelActionHashMod || rule.Modulus != 4 || rule.TargetLabel != "shard" {
+		t.Errorf("unexpected hashmod rule %+v", *rule)
+	}
+
+	if _, err := parseRelabelConfigs(url.Values{"relabel": {"{source_labels: resourceGroup"}}); err == nil {
+		t.Error("expected error for invalid YAML")
+	}
+}
+
+func TestParseStaticLabels(t *testing.T) {
+	labels, err := parseStaticLabels(url.Values{"label.team": {"ops"}, "label.env": {"prod"}, "name": {"azurerm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"team": "ops", "env": "prod"}; !maps.Equal(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+
+	for _, labelName := range []string{"1team", "team-name", "__name__", ""} {
+		if err := validateStaticLabels(map[string]string{labelName: "ops"}); err == nil {
+			t.Errorf("expected error for static label %q", labelName)
+		}
+	}
+}
+
+func TestRelabelMetric(t *testing.T) {
+	testCases := []struct {
+		name           string
+		rules          []*RelabelConfig
+		expectedName   string
+		expectedLabels prometheus.Labels
+		keep           bool
+	}{
+		{
+			name:           "static labels",
+			expectedName:   "azurerm_cpu",
+			expectedLabels: prometheus.Labels{"resourceGroup": "example", "team": "ops"},
+			keep:           true,
+		},
+		{
+			name:           "rename metric",
+			rules:          []*RelabelConfig{{SourceLabels: []string{"__name__"}, Separator: ";", Regex: "azurerm_(.*)", Replacement: "azure_$1", TargetLabel: "__name__", Action: RelabelActionReplace}},
+			expectedName:   "azure_cpu",
+			expectedLabels: prometheus.Labels{"resourceGroup": "example", "team": "ops"},
+			keep:           true,
+		},
+		{
+			name: "temporary labels",
+			rules: []*RelabelConfig{
+				{SourceLabels: []string{"resourceGroup"}, Separator: ";", Regex: "(.*)", Replacement: "$1", TargetLabel: "__tmp", Action: RelabelActionReplace},
+				{SourceLabels: []string{"__tmp"}, Separator: ";", Regex: "(.*)", Replacement: "rg_$1", TargetLabel: "rg", Action: RelabelActionReplace},
+			},
+			expectedName:   "azurerm_cpu",
+			expectedLabels: prometheus.Labels{"resourceGroup": "example", "rg": "rg_example", "team": "ops"},
+			keep:           true,
+		},
+		{
+			name:  "drop metric",
+			rules: []*RelabelConfig{{SourceLabels: []string{"team"}, Separator: ";", Regex: "ops", Action: RelabelActionDrop}},
+			keep:  false,
+		},
+		{
+			name:  "empty metric name",
+			rules: []*RelabelConfig{{SourceLabels: []string{"missing"}, Separator: ";", Regex: "(.*)", Replacement: "$1", TargetLabel: "__name__", Action: RelabelActionReplace}},
+			keep:  false,
+		},
+		{
+			name:  "invalid metric name",
+			rules: []*RelabelConfig{{Separator: ";", Regex: "(.*)", Replacement: "5xx", TargetLabel: "__name__", Action: RelabelActionReplace}},
+			keep:  false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			settings := RequestMetricSettings{
+				StaticLabels:   map[string]string{"team": "ops"},
+				RelabelConfigs: testCase.rules,
+			}
+			if err := settings.compileRelabelConfigs(); err != nil {
+				t.Fatal(err)
+			}
+
+			metric := PrometheusMetricResult{Name: "azurerm_cpu", Labels: prometheus.Labels{"resourceGroup": "example"}}
+			if keep := settings.relabelMetric(&metric); keep != testCase.keep {
+				t.Fatalf("expected keep %v, got %v", testCase.keep, keep)
+			}
+			if !testCase.keep {
+				return
+			}
+
+			if metric.Name != testCase.expectedName {
+				t.Errorf("expected name %q, got %q", testCase.expectedName, metric.Name)
+			}
+			if !maps.Equal(metric.Labels, testCase.expectedLabels) {
+				t.Errorf("expected labels %v, got %v", testCase.expectedLabels, metric.Labels)
+			}
+		})
+	}
+}
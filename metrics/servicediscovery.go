@@ -30,17 +30,17 @@ type (
 )
 
 func (sd *AzureServiceDiscovery) ResourcesClient(subscriptionId string) (*armresources.Client, error) {
-	return armresources.NewClient(subscriptionId, sd.prober.AzureClient.GetCred(), sd.prober.AzureClient.NewArmClientOptions())
+	return armresources.NewClient(subscriptionId, sd.prober.azureCred(), sd.prober.armClientOptions())
 }
 
 func (sd *AzureServiceDiscovery) publishTargetList(targetList []MetricProbeTarget) {
 	sd.prober.AddTarget(targetList...)
 }
 
-func (sd *AzureServiceDiscovery) fetchResourceList(subscriptionId, filter string) (resourceList []AzureResource, err error) {
+func (sd *AzureServiceDiscovery) fetchResourceList(ctx context.Context, subscriptionId, filter string) (resourceList []AzureResource, err error) {
 	// nolint:gosec
 	cacheKey := fmt.Sprintf(
-		"%x",
+		"servicediscovery:%x",
 		string(sha1.New().Sum([]byte(fmt.Sprintf("%v:%v", subscriptionId, filter)))),
 	)
 
@@ -58,7 +58,7 @@ func (sd *AzureServiceDiscovery) fetchResourceList(subscriptionId, filter string
 		pager := client.NewListPager(&opts)
 
 		for pager.More() {
-			result, err := pager.NextPage(sd.prober.ctx)
+			result, err := pager.NextPage(ctx)
 			if err != nil {
 				err = fmt.Errorf("servicediscovery failed: %w", err)
 				return resourceList, err
@@ -74,8 +74,9 @@ func (sd *AzureServiceDiscovery) fetchResourceList(subscriptionId, filter string
 				resourceList = append(
 					resourceList,
 					AzureResource{
-						ID:   to.String(resource.ID),
-						Tags: to.StringMap(resource.Tags),
+						ID:       to.String(resource.ID),
+						Location: to.String(resource.Location),
+						Tags:     to.StringMap(resource.Tags),
 					},
 				)
 			}
@@ -96,13 +97,13 @@ func (sd *AzureServiceDiscovery) fetchFromCache(cacheKey string) (resourceList [
 	cache := sd.prober.serviceDiscoveryCache.cache
 
 	if cache != nil {
-		if v, ok := cache.Get(cacheKey); ok {
-			if cacheData, ok := v.([]byte); ok {
-				if err := json.Unmarshal(cacheData, &resourceList); err == nil {
-					status = true
-				} else {
-					contextLogger.Debug("unable to parse cached servicediscovery")
-				}
+		if cacheData, ok, err := cache.Get(cacheKey); err != nil {
+			contextLogger.Warnf("unable to fetch servicediscovery from cache: %v", err)
+		} else if ok {
+			if err := json.Unmarshal(cacheData, &resourceList); err == nil {
+				status = true
+			} else {
+				contextLogger.Debug("unable to parse cached servicediscovery")
 			}
 		}
 	}
@@ -119,21 +120,25 @@ func (sd *AzureServiceDiscovery) saveToCache(cacheKey string, resourceList []Azu
 	if cache != nil {
 		contextLogger.Debug("saving servicedisccovery to cache")
 		if cacheData, err := json.Marshal(resourceList); err == nil {
-			cache.Set(cacheKey, cacheData, *cacheDuration)
+			if err := cache.Set(cacheKey, cacheData, *cacheDuration); err != nil {
+				contextLogger.Warnf("unable to save servicediscovery to cache: %v", err)
+				return
+			}
 			contextLogger.Debugf("saved servicediscovery to cache for %s", cacheDuration.String())
 		}
 	}
 }
 
-func (sd *AzureServiceDiscovery) FindSubscriptionResources(subscriptionId, filter string) {
+func (sd *AzureServiceDiscovery) FindSubscriptionResources(ctx context.Context, subscriptionId, filter string) {
 	var targetList []MetricProbeTarget
 
-	if resourceList, err := sd.fetchResourceList(subscriptionId, filter); err == nil {
+	if resourceList, err := sd.fetchResourceList(ctx, subscriptionId, filter); err == nil {
 		for _, resource := range resourceList {
 			targetList = append(
 				targetList,
 				MetricProbeTarget{
 					ResourceId:   resource.ID,
+					Location:     resource.Location,
 					Metrics:      sd.prober.settings.Metrics,
 					Aggregations: sd.prober.settings.Aggregations,
 					Tags:         resource.Tags,
@@ -141,17 +146,31 @@ func (sd *AzureServiceDiscovery) FindSubscriptionResources(subscriptionId, filte
 			)
 		}
 	} else {
-		sd.prober.logger.Error(err)
+		sd.prober.reportSubscriptionError(subscriptionId, ProbeErrorReasonDiscovery, err)
 		return
 	}
 
 	sd.publishTargetList(targetList)
 }
 
+// FindFirstSubscriptionResource returns the first resource matching the filter (eg. as sample of a resource type)
+func (sd *AzureServiceDiscovery) FindFirstSubscriptionResource(ctx context.Context, subscriptionId, filter string) (*AzureResource, error) {
+	resourceList, err := sd.fetchResourceList(ctx, subscriptionId, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resourceList) == 0 {
+		return nil, nil
+	}
+
+	return &resourceList[0], nil
+}
+
 func (sd *AzureServiceDiscovery) FindSubscriptionResourcesWithScrapeTags(ctx context.Context, subscriptionId, filter, metricTagName, aggregationTagName string) {
 	var targetList []MetricProbeTarget
 
-	if resourceList, err := sd.fetchResourceList(subscriptionId, filter); err == nil {
+	if resourceList, err := sd.fetchResourceList(ctx, subscriptionId, filter); err == nil {
 		for _, resource := range resourceList {
 			if metrics, ok := resource.Tags[metricTagName]; ok && metrics != "" {
 				if aggregations, ok := resource.Tags[aggregationTagName]; ok && aggregations != "" {
@@ -159,6 +178,7 @@ func (sd *AzureServiceDiscovery) FindSubscriptionResourcesWithScrapeTags(ctx con
 						targetList,
 						MetricProbeTarget{
 							ResourceId:   resource.ID,
+							Location:     resource.Location,
 							Metrics:      stringToStringList(metrics, ","),
 							Aggregations: stringToStringList(aggregations, ","),
 						},
@@ -168,7 +188,7 @@ func (sd *AzureServiceDiscovery) FindSubscriptionResourcesWithScrapeTags(ctx con
 			}
 		}
 	} else {
-		sd.prober.logger.Error(err)
+		sd.prober.reportSubscriptionError(subscriptionId, ProbeErrorReasonDiscovery, err)
 		return
 	}
 
@@ -178,7 +198,7 @@ func (sd *AzureServiceDiscovery) FindSubscriptionResourcesWithScrapeTags(ctx con
 func (sd *AzureServiceDiscovery) FindResourceGraph(ctx context.Context, subscriptions []string, resourceType, filter string) error {
 	var targetList []MetricProbeTarget
 
-	client, err := armresourcegraph.NewClient(sd.prober.AzureClient.GetCred(), sd.prober.AzureClient.NewArmClientOptions())
+	client, err := armresourcegraph.NewClient(sd.prober.azureCred(), sd.prober.armClientOptions())
 	if err != nil {
 		return err
 	}
@@ -187,7 +207,7 @@ func (sd *AzureServiceDiscovery) FindResourceGraph(ctx context.Context, subscrip
 		filter = "| " + filter
 	}
 
-	queryTemplate := `Resources | where type =~ "%s" %s | project id, tags`
+	queryTemplate := `Resources | where type =~ "%s" %s | project id, location, tags`
 
 	query := strings.TrimSpace(fmt.Sprintf(
 		queryTemplate,
@@ -229,10 +249,12 @@ func (sd *AzureServiceDiscovery) FindResourceGraph(ctx context.Context, subscrip
 
 					if val, ok := resultRow["id"]; ok && val != "" {
 						if resourceId, ok := val.(string); ok {
+							resourceLocation, _ := resultRow["location"].(string)
 							targetList = append(
 								targetList,
 								MetricProbeTarget{
 									ResourceId:   resourceId,
+									Location:     resourceLocation,
 									Metrics:      sd.prober.settings.Metrics,
 									Aggregations: sd.prober.settings.Aggregations,
 									Tags:         sd.resourceTagsToStringMap(resultRow["tags"]),
@@ -1,13 +1,18 @@
 package metrics
 
 import (
+	"crypto/sha1" // #nosec G505
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	iso8601 "github.com/channelmeter/iso8601duration"
+	"github.com/webdevops/go-common/utils/to"
 
 	"github.com/webdevops/azure-metrics-exporter/config"
 )
@@ -18,29 +23,51 @@ const (
 
 type (
 	RequestMetricSettings struct {
-		Name            string
-		Subscriptions   []string
-		ResourceType    string
-		Filter          string
-		Timespan        string
-		Interval        *string
-		Metrics         []string
-		MetricNamespace string
-		Aggregations    []string
-		Regions         []string
+		Name            string   `yaml:"name"`
+		Subscriptions   []string `yaml:"subscriptions"`
+		ResourceType    string   `yaml:"resourceType"`
+		Filter          string   `yaml:"filter"`
+		Timespan        string   `yaml:"timespan"`
+		Interval        *string  `yaml:"interval"`
+		Metrics         []string `yaml:"metrics"`
+		MetricNamespace string   `yaml:"metricNamespace"`
+		Aggregations    []string `yaml:"aggregations"`
+		Regions         []string `yaml:"regions"`
 
 		// needed for dimension support
-		MetricTop     *int32
-		MetricFilter  string
-		MetricOrderBy string
+		MetricTop     *int32 `yaml:"metricTop"`
+		MetricFilter  string `yaml:"metricFilter"`
+		MetricOrderBy string `yaml:"metricOrderBy"`
 
-		ValidateDimensions bool
+		ValidateDimensions bool `yaml:"validateDimensions"`
 
-		MetricTemplate string
-		HelpTemplate   string
+		MetricTemplate string `yaml:"template"`
+		HelpTemplate   string `yaml:"help"`
+		LabelsTemplate string `yaml:"labels"`
+
+		// parsed Go templates (set by parseTemplates)
+		templates *metricTemplates
+
+		// use timestamp of Azure datapoint
+		MetricTimestamp bool `yaml:"timestamp"`
+
+		// selection of datapoints if timespan contains multiple intervals
+		Datapoint string `yaml:"datapoint"`
+
+		// merge of rows with the same metric name and labels
+		MergePolicy string `yaml:"merge"`
+
+		// static labels (param label.<name>) and relabel rules, applied before metrics are added to the list
+		StaticLabels   map[string]string `yaml:"staticLabels"`
+		RelabelConfigs []*RelabelConfig  `yaml:"relabelConfigs"`
+
+		// metrics api (arm or batch)
+		Api string `yaml:"api"`
 
 		// cache
-		Cache *time.Duration
+		Cache         *time.Duration `yaml:"-"`
+		CacheMode     string         `yaml:"-"`
+		CacheMaxStale time.Duration  `yaml:"-"`
 	}
 )
 
@@ -73,16 +100,17 @@ func NewRequestMetricSettings(r *http.Request, opts config.Opts) (RequestMetricS
 	// param name
 	ret.Name = paramsGetWithDefault(params, "name", PrometheusMetricNameDefault)
 
-	// param subscription
+	// param subscription (sorted and deduplicated, each subscription is only probed once)
 	if subscriptionList, err := paramsGetListRequired(params, "subscription"); err == nil {
-		for _, subscription := range subscriptionList {
-			subscription = strings.TrimSpace(subscription)
-			ret.Subscriptions = append(ret.Subscriptions, subscription)
-		}
+		ret.Subscriptions = normalizeStringList(subscriptionList)
 	} else {
 		return ret, err
 	}
 
+	if len(ret.Subscriptions) == 0 {
+		return ret, fmt.Errorf("parameter \"subscription\" is missing")
+	}
+
 	// param region
 	if val, err := paramsGetList(params, "region"); err == nil {
 		ret.Regions = val
@@ -114,6 +142,10 @@ func NewRequestMetricSettings(r *http.Request, opts config.Opts) (RequestMetricS
 		return ret, err
 	}
 
+	if err := validateMetricNamePatterns(ret.Metrics); err != nil {
+		return ret, err
+	}
+
 	// param metricNamespace
 	ret.MetricNamespace = paramsGetWithDefault(params, "metricNamespace", "")
 
@@ -146,6 +178,56 @@ func NewRequestMetricSettings(r *http.Request, opts config.Opts) (RequestMetricS
 	// param help
 	ret.HelpTemplate = paramsGetWithDefault(params, "help", opts.Metrics.Help)
 
+	// param labels
+	ret.LabelsTemplate = paramsGetWithDefault(params, "labels", opts.Metrics.Labels)
+
+	if err := ret.parseTemplates(); err != nil {
+		return ret, err
+	}
+
+	// param timestamp
+	if val, err := strconv.ParseBool(paramsGetWithDefault(params, "timestamp", strconv.FormatBool(opts.Metrics.Timestamp))); err == nil {
+		ret.MetricTimestamp = val
+	} else {
+		return ret, err
+	}
+
+	// param datapoint
+	ret.Datapoint = paramsGetWithDefault(params, "datapoint", DatapointPolicyDefault)
+	if err := validateDatapointPolicy(ret.Datapoint); err != nil {
+		return ret, err
+	}
+
+	// param merge
+	ret.MergePolicy = paramsGetWithDefault(params, "merge", MergePolicyDefault)
+	if err := validateMergePolicy(ret.MergePolicy); err != nil {
+		return ret, err
+	}
+
+	// param label.<name>
+	if val, err := parseStaticLabels(params); err == nil {
+		ret.StaticLabels = val
+	} else {
+		return ret, err
+	}
+
+	// param relabel
+	if val, err := parseRelabelConfigs(params); err == nil {
+		ret.RelabelConfigs = val
+	} else {
+		return ret, err
+	}
+
+	if err := ret.compileRelabelConfigs(); err != nil {
+		return ret, err
+	}
+
+	// param api
+	ret.Api = paramsGetWithDefault(params, "api", MetricApiArm)
+	if err := validateMetricApi(ret.Api); err != nil {
+		return ret, err
+	}
+
 	// param cache (timespan as default)
 	if opts.Prober.Cache {
 		cacheDefaultDuration, err := iso8601.FromString(ret.Timespan)
@@ -164,6 +246,20 @@ func NewRequestMetricSettings(r *http.Request, opts config.Opts) (RequestMetricS
 				return ret, err
 			}
 		}
+
+		// param cacheMode
+		ret.CacheMode = paramsGetWithDefault(params, "cacheMode", opts.Cache.Mode)
+		if err := validateCacheMode(ret.CacheMode); err != nil {
+			return ret, err
+		}
+
+		// param cacheMaxStale
+		ret.CacheMaxStale = opts.Cache.MaxStale
+		if val := params.Get("cacheMaxStale"); val != "" {
+			if ret.CacheMaxStale, err = time.ParseDuration(val); err != nil {
+				return ret, fmt.Errorf("parameter \"cacheMaxStale\" is invalid: %w", err)
+			}
+		}
 	}
 
 	return ret, nil
@@ -181,6 +277,82 @@ func (s *RequestMetricSettings) CacheDuration(requestTime time.Time) (ret *time.
 	return
 }
 
+// CacheKey returns the cache key of the probe (prefix and hash of the normalized settings and discoverer), the
+// same probe with reordered or duplicated parameters uses the same key. Cache settings are not part of the key.
+func (s *RequestMetricSettings) CacheKey(prefix string, discoverer TargetDiscoverer) (string, error) {
+	normalized := *s
+	normalized.Subscriptions = normalizeStringList(s.Subscriptions)
+	normalized.Metrics = normalizeStringList(s.Metrics)
+	normalized.Aggregations = normalizeStringList(s.Aggregations)
+	normalized.Regions = normalizeStringList(s.Regions)
+	normalized.ResourceType = strings.TrimSpace(s.ResourceType)
+	normalized.Filter = strings.TrimSpace(s.Filter)
+	normalized.MetricNamespace = strings.TrimSpace(s.MetricNamespace)
+	normalized.MetricFilter = strings.TrimSpace(s.MetricFilter)
+	normalized.MetricOrderBy = strings.TrimSpace(s.MetricOrderBy)
+	normalized.Cache = nil
+	normalized.CacheMode = ""
+	normalized.CacheMaxStale = 0
+
+	if static, ok := discoverer.(StaticTargetDiscoverer); ok {
+		static.ResourceIds = normalizeStringList(static.ResourceIds)
+		discoverer = static
+	}
+
+	data, err := json.Marshal(struct {
+		Settings       RequestMetricSettings
+		DiscovererType string
+		Discoverer     TargetDiscoverer
+	}{
+		Settings:       normalized,
+		DiscovererType: fmt.Sprintf("%T", discoverer),
+		Discoverer:     discoverer,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to build cache key: %w", err)
+	}
+
+	return fmt.Sprintf("%s:%x", prefix, sha1.Sum(data)), nil // #nosec G401
+}
+
+// Clone returns a deep copy of the settings (slices, maps and pointers are not shared),
+// parsed templates and compiled relabel regexps are immutable and shared
+func (s *RequestMetricSettings) Clone() RequestMetricSettings {
+	ret := *s
+	ret.Subscriptions = slices.Clone(s.Subscriptions)
+	ret.Metrics = slices.Clone(s.Metrics)
+	ret.Aggregations = slices.Clone(s.Aggregations)
+	ret.Regions = slices.Clone(s.Regions)
+	ret.StaticLabels = maps.Clone(s.StaticLabels)
+
+	if s.Interval != nil {
+		ret.Interval = to.StringPtr(*s.Interval)
+	}
+
+	if s.MetricTop != nil {
+		metricTop := *s.MetricTop
+		ret.MetricTop = &metricTop
+	}
+
+	if s.Cache != nil {
+		cache := *s.Cache
+		ret.Cache = &cache
+	}
+
+	if s.RelabelConfigs != nil {
+		ret.RelabelConfigs = make([]*RelabelConfig, len(s.RelabelConfigs))
+		for i, rule := range s.RelabelConfigs {
+			if rule != nil {
+				ruleCopy := *rule
+				ruleCopy.SourceLabels = slices.Clone(rule.SourceLabels)
+				ret.RelabelConfigs[i] = &ruleCopy
+			}
+		}
+	}
+
+	return ret
+}
+
 func (s *RequestMetricSettings) SetMetrics(val string) {
 	s.Metrics = stringToStringList(val, ",")
 }
@@ -188,3 +360,8 @@ func (s *RequestMetricSettings) SetMetrics(val string) {
 func (s *RequestMetricSettings) SetAggregations(val string) {
 	s.Aggregations = stringToStringList(val, ",")
 }
+
+// HasMetricNamePatterns checks if metrics contain wildcards or regexps (needs metric definitions of targets)
+func (s *RequestMetricSettings) HasMetricNamePatterns() bool {
+	return hasMetricNamePatterns(s.Metrics)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+)
+
+func TestNewRequestMetricSettingsNormalizesSubscriptions(t *testing.T) {
+	r := httptest.NewRequest("GET", "/probe/metrics/list?subscription=bbb,aaa&subscription=+aaa+&subscription=", nil)
+
+	settings, err := NewRequestMetricSettings(r, config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"aaa", "bbb"}; !slices.Equal(settings.Subscriptions, expected) {
+		t.Errorf("expected subscriptions %v, got %v", expected, settings.Subscriptions)
+	}
+}
+
+func TestNewRequestMetricSettingsRequiresSubscription(t *testing.T) {
+	r := httptest.NewRequest("GET", "/probe/metrics/list?subscription=+,", nil)
+
+	if _, err := NewRequestMetricSettings(r, config.Opts{}); err == nil {
+		t.Error("expected error for empty subscriptions")
+	}
+}
+
+func TestCacheKeyOfReorderedSettings(t *testing.T) {
+	first := RequestMetricSettings{Subscriptions: []string{"aaa", "bbb"}, Metrics: []string{"cpu", "memory"}}
+	second := RequestMetricSettings{Subscriptions: []string{"bbb", "aaa", "aaa"}, Metrics: []string{"memory", " cpu"}}
+	other := RequestMetricSettings{Subscriptions: []string{"aaa"}, Metrics: []string{"cpu", "memory"}}
+
+	firstKey, err := first.CacheKey("list", ResourceFilterDiscoverer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := second.CacheKey("list", ResourceFilterDiscoverer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := other.CacheKey("list", ResourceFilterDiscoverer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if firstKey != secondKey {
+		t.Errorf("reordered settings must use the same key: %s != %s", firstKey, secondKey)
+	}
+	if firstKey == otherKey {
+		t.Error("different settings must use different keys")
+	}
+
+	resourceKey, err := first.CacheKey("list", StaticTargetDiscoverer{ResourceIds: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resourceKey == firstKey {
+		t.Error("different discoverers must use different keys")
+	}
+}
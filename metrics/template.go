@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/monitor/armmonitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// templates containing this delimiter use the Go text/template syntax instead of {placeholder}
+	metricTemplateDelimiter = "{{"
+)
+
+type (
+	// metricTemplates are the parsed Go templates of the metric name, help and labels (nil if not used)
+	metricTemplates struct {
+		name   *template.Template
+		help   *template.Template
+		labels *template.Template
+
+		// fields used in the name template, removed from the labels (same as placeholders)
+		nameFields map[string]bool
+	}
+)
+
+var (
+	metricTemplateFuncs = template.FuncMap{
+		"snakecase":  templateSnakeCase,
+		"lower":      strings.ToLower,
+		"trimSuffix": func(suffix, value string) string { return strings.TrimSuffix(value, suffix) },
+		"default": func(defaultValue, value string) string {
+			if value == "" {
+				return defaultValue
+			}
+			return value
+		},
+		"unitSuffix": templateUnitSuffix,
+	}
+
+	metricTemplateUnitSuffixes = map[string]string{
+		string(armmonitor.MetricUnitBitsPerSecond):  "bits_per_second",
+		string(armmonitor.MetricUnitByteSeconds):    "byte_seconds",
+		string(armmonitor.MetricUnitBytes):          "bytes",
+		string(armmonitor.MetricUnitBytesPerSecond): "bytes_per_second",
+		string(armmonitor.MetricUnitCores):          "cores",
+		string(armmonitor.MetricUnitCount):          "count",
+		string(armmonitor.MetricUnitCountPerSecond): "count_per_second",
+		string(armmonitor.MetricUnitMilliCores):     "millicores",
+		string(armmonitor.MetricUnitMilliSeconds):   "milliseconds",
+		string(armmonitor.MetricUnitNanoCores):      "nanocores",
+		string(armmonitor.MetricUnitPercent):        "percent",
+		string(armmonitor.MetricUnitSeconds):        "seconds",
+		string(armmonitor.MetricUnitUnspecified):    "",
+	}
+
+	metricTemplateUnderscore = regexp.MustCompile(`_+`)
+
+	// example data for validating templates while parsing the request
+	metricTemplateExampleData = map[string]string{
+		"name":           PrometheusMetricNameDefault,
+		"type":           "Microsoft.KeyVault/vaults",
+		"resourceID":     "/subscriptions/xxx/resourcegroups/example/providers/microsoft.keyvault/vaults/example",
+		"subscriptionID": "xxx",
+		"resourceGroup":  "example",
+		"resourceName":   "example",
+		"metric":         "ServiceApiLatency",
+		"dimension":      "example",
+		"unit":           "MilliSeconds",
+		"aggregation":    "average",
+		"interval":       "PT1M",
+		"timespan":       "PT1M",
+	}
+)
+
+// IsGoTemplate returns true if the template uses the Go text/template syntax
+func IsGoTemplate(value string) bool {
+	return strings.Contains(value, metricTemplateDelimiter)
+}
+
+// parseTemplates parses and validates the Go templates of metric name, help and labels
+// (placeholder templates of name and help are applied while building the metrics)
+func (s *RequestMetricSettings) parseTemplates() error {
+	templates := metricTemplates{
+		nameFields: map[string]bool{},
+	}
+
+	var err error
+	if IsGoTemplate(s.MetricTemplate) {
+		if templates.name, err = parseMetricTemplate("template", s.MetricTemplate); err != nil {
+			return err
+		}
+		metricTemplateFields(templates.name.Root, templates.nameFields)
+		delete(templates.nameFields, "name")
+		delete(templates.nameFields, "type")
+	}
+
+	if IsGoTemplate(s.HelpTemplate) {
+		if templates.help, err = parseMetricTemplate("help", s.HelpTemplate); err != nil {
+			return err
+		}
+	}
+
+	// labels template is always a Go template
+	if strings.TrimSpace(s.LabelsTemplate) != "" {
+		if templates.labels, err = parseMetricTemplate("labels", s.LabelsTemplate); err != nil {
+			return err
+		}
+	}
+
+	// find errors of function calls and label output before the first probe
+	if _, err := templates.renderName(metricTemplateExampleData); err != nil {
+		return err
+	}
+	if _, err := templates.renderHelp(metricTemplateExampleData); err != nil {
+		return err
+	}
+	if _, err := templates.renderLabels(metricTemplateExampleData); err != nil {
+		return err
+	}
+
+	s.templates = &templates
+	return nil
+}
+
+func parseMetricTemplate(param, value string) (*template.Template, error) {
+	// missing labels are empty (same as placeholders)
+	tmpl, err := template.New(param).Option("missingkey=zero").Funcs(metricTemplateFuncs).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("parameter \"%s\" is not a valid template: %w", param, err)
+	}
+	return tmpl, nil
+}
+
+// metricTemplateFields collects the fields (eg. {{ .metric }}) used in the template
+func metricTemplateFields(node parse.Node, fields map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node != nil {
+			for _, child := range node.Nodes {
+				metricTemplateFields(child, fields)
+			}
+		}
+	case *parse.ActionNode:
+		metricTemplateFields(node.Pipe, fields)
+	case *parse.PipeNode:
+		if node != nil {
+			for _, cmd := range node.Cmds {
+				metricTemplateFields(cmd, fields)
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			metricTemplateFields(arg, fields)
+		}
+	case *parse.FieldNode:
+		if len(node.Ident) >= 1 {
+			fields[node.Ident[0]] = true
+		}
+	case *parse.IfNode:
+		metricTemplateFields(&node.BranchNode, fields)
+	case *parse.WithNode:
+		metricTemplateFields(&node.BranchNode, fields)
+	case *parse.RangeNode:
+		metricTemplateFields(&node.BranchNode, fields)
+	case *parse.BranchNode:
+		metricTemplateFields(node.Pipe, fields)
+		metricTemplateFields(node.List, fields)
+		metricTemplateFields(node.ElseList, fields)
+	}
+}
+
+// metricTemplateData returns the template data of a metric: all labels, name and type
+func metricTemplateData(labels prometheus.Labels, name, resourceType string) map[string]string {
+	data := make(map[string]string, len(labels)+2)
+	for labelName, labelValue := range labels {
+		data[labelName] = labelValue
+	}
+	data["name"] = name
+	data["type"] = resourceType
+	return data
+}
+
+func (t *metricTemplates) execute(tmpl *template.Template, data map[string]string) (string, error) {
+	buf := strings.Builder{}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to execute template \"%s\": %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+func (t *metricTemplates) renderName(data map[string]string) (string, error) {
+	if t.name == nil {
+		return "", nil
+	}
+	return t.execute(t.name, data)
+}
+
+func (t *metricTemplates) renderHelp(data map[string]string) (string, error) {
+	if t.help == nil {
+		return "", nil
+	}
+	return t.execute(t.help, data)
+}
+
+// renderLabels returns the labels of the labels template, the output is a list of name=value pairs
+// separated by comma or newline; empty values remove the label
+func (t *metricTemplates) renderLabels(data map[string]string) (map[string]string, error) {
+	ret := map[string]string{}
+	if t.labels == nil {
+		return ret, nil
+	}
+
+	output, err := t.execute(t.labels, data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range strings.FieldsFunc(output, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		labelName, labelValue, found := strings.Cut(pair, "=")
+		labelName = strings.TrimSpace(labelName)
+		if !found || !metricLabelName.MatchString(labelName) {
+			return nil, fmt.Errorf("template \"labels\" returned invalid label \"%s\" (expected name=value)", pair)
+		}
+		ret[labelName] = strings.TrimSpace(labelValue)
+	}
+
+	return ret, nil
+}
+
+// templateSnakeCase converts eg. "ServiceApiLatency" or "Percentage CPU" to "service_api_latency" and "percentage_cpu"
+func templateSnakeCase(value string) string {
+	runes := []rune(value)
+	buf := strings.Builder{}
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				buf.WriteRune('_')
+			}
+			buf.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune('_')
+		}
+	}
+	return strings.Trim(metricTemplateUnderscore.ReplaceAllString(buf.String(), "_"), "_")
+}
+
+// templateUnitSuffix converts the Azure metric unit to a metric name suffix (eg. "BytesPerSecond" to "bytes_per_second")
+func templateUnitSuffix(unit string) string {
+	if suffix, exists := metricTemplateUnitSuffixes[unit]; exists {
+		return suffix
+	}
+	return templateSnakeCase(unit)
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseTemplates(t *testing.T) {
+	testCases := []struct {
+		name     string
+		settings RequestMetricSettings
+		valid    bool
+	}{
+		{"placeholders", RequestMetricSettings{MetricTemplate: "{name}_{metric}", HelpTemplate: "{metric}"}, true},
+		{"name template", RequestMetricSettings{MetricTemplate: "{{ .name }}_{{ .metric | snakecase }}"}, true},
+		{"help template", RequestMetricSettings{HelpTemplate: "Azure metric {{ .metric }} ({{ .unit }})"}, true},
+		{"labels template", RequestMetricSettings{LabelsTemplate: "team={{ .resourceGroup }}\nmetric="}, true},
+		{"functions", RequestMetricSettings{MetricTemplate: `{{ .metric | trimSuffix "Latency" | default "x" | lower }}_{{ unitSuffix .unit }}`}, true},
+		{"syntax error", RequestMetricSettings{MetricTemplate: "{{ .name "}, false},
+		{"unknown function", RequestMetricSettings{MetricTemplate: "{{ .name | camelcase }}"}, false},
+		{"invalid label name", RequestMetricSettings{LabelsTemplate: "1team={{ .resourceGroup }}"}, false},
+		{"label without value", RequestMetricSettings{LabelsTemplate: "team"}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.settings.parseTemplates()
+			if testCase.valid && err != nil {
+				t.Errorf("expected valid templates, got %v", err)
+			}
+			if !testCase.valid && err == nil {
+				t.Error("expected error for invalid templates")
+			}
+		})
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	settings := RequestMetricSettings{
+		MetricTemplate: "{{ .name }}_{{ .metric | snakecase }}_{{ unitSuffix .unit }}",
+		HelpTemplate:   "Azure metric {{ .metric }} of {{ .type }}",
+		LabelsTemplate: "team={{ .resourceGroup }}, unit=",
+	}
+	if err := settings.parseTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := metricTemplateData(prometheus.Labels{"metric": "ServiceApiLatency", "unit": "MilliSeconds", "resourceGroup": "example"}, "azurerm", "Microsoft.KeyVault/vaults")
+
+	if name, err := settings.templates.renderName(data); err != nil || name != "azurerm_service_api_latency_milliseconds" {
+		t.Errorf("unexpected name %q (%v)", name, err)
+	}
+
+	if help, err := settings.templates.renderHelp(data); err != nil || help != "Azure metric ServiceApiLatency of Microsoft.KeyVault/vaults" {
+		t.Errorf("unexpected help %q (%v)", help, err)
+	}
+
+	labels, err := settings.templates.renderLabels(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"team": "example", "unit": ""}; !maps.Equal(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+
+	if expected := map[string]bool{"metric": true, "unit": true}; !maps.Equal(settings.templates.nameFields, expected) {
+		t.Errorf("expected name fields %v, got %v", expected, settings.templates.nameFields)
+	}
+}
+
+func TestMetricTemplateFields(t *testing.T) {
+	testCases := []struct {
+		template string
+		expected map[string]bool
+	}{
+		{"azurerm", map[string]bool{}},
+		{"{{ .metric }}", map[string]bool{"metric": true}},
+		{"{{ .metric | snakecase }}_{{ unitSuffix .unit }}", map[string]bool{"metric": true, "unit": true}},
+		{`{{ if .dimension }}{{ .dimension }}{{ else }}{{ .metric }}{{ end }}`, map[string]bool{"dimension": true, "metric": true}},
+		{"{{ with .resourceName }}{{ . }}{{ end }}", map[string]bool{"resourceName": true}},
+	}
+
+	for _, testCase := range testCases {
+		tmpl, err := parseMetricTemplate("template", testCase.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := map[string]bool{}
+		metricTemplateFields(tmpl.Root, fields)
+		if !maps.Equal(fields, testCase.expected) {
+			t.Errorf("%s: expected fields %v, got %v", testCase.template, testCase.expected, fields)
+		}
+	}
+}
+
+func TestTemplateSnakeCase(t *testing.T) {
+	testCases := map[string]string{
+		"ServiceApiLatency":  "service_api_latency",
+		"Percentage CPU":     "percentage_cpu",
+		"HTTPServerErrors":   "http_server_errors",
+		"Http5xx":            "http5xx",
+		"Data Usage (Bytes)": "data_usage_bytes",
+		"already_snake_case": "already_snake_case",
+		"Requests/Sec":       "requests_sec",
+		"":                   "",
+	}
+
+	for value, expected := range testCases {
+		if result := templateSnakeCase(value); result != expected {
+			t.Errorf("snakecase(%q): expected %q, got %q", value, expected, result)
+		}
+	}
+}
+
+func TestTemplateUnitSuffix(t *testing.T) {
+	testCases := map[string]string{
+		"BytesPerSecond": "bytes_per_second",
+		"MilliSeconds":   "milliseconds",
+		"Unspecified":    "",
+		"CountPerMinute": "count_per_minute",
+	}
+
+	for unit, expected := range testCases {
+		if result := templateUnitSuffix(unit); result != expected {
+			t.Errorf("unitSuffix(%q): expected %q, got %q", unit, expected, result)
+		}
+	}
+}
+
+func TestIsGoTemplate(t *testing.T) {
+	testCases := map[string]bool{
+		"{name}_{metric}":     false,
+		"{{ .name }}":         true,
+		"azurerm_{{.metric}}": true,
+		"":                    false,
+	}
+
+	for value, expected := range testCases {
+		if result := IsGoTemplate(value); result != expected {
+			t.Errorf("IsGoTemplate(%q): expected %v, got %v", value, expected, result)
+		}
+	}
+}
+
+func TestBuildMetricInvalidName(t *testing.T) {
+	testCases := []struct {
+		name         string
+		template     string
+		defaultName  string
+		expectedName string
+		valid        bool
+		errors       bool
+	}{
+		{"valid template", "{{ .name }}_{{ .metric | snakecase }}", "azurerm", "azurerm_service_api_latency", true, false},
+		{"empty name", "{{ .missing }}", "azurerm", "azurerm", true, true},
+		{"leading digit", "{{ .missing }}5xx", "azurerm", "azurerm", true, true},
+		{"invalid default name", "{{ .missing }}", "5xx", "", false, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			prober := newTestProber(context.Background())
+			prober.settings.Name = testCase.defaultName
+			prober.settings.MetricTemplate = testCase.template
+			if err := prober.settings.parseTemplates(); err != nil {
+				t.Fatal(err)
+			}
+
+			result := AzureInsightBaseMetricsResult{prober: prober}
+			metric, valid := result.buildMetric(prometheus.Labels{"subscriptionID": "xxx", "metric": "ServiceApiLatency"}, 1, nil)
+			if valid != testCase.valid {
+				t.Fatalf("expected valid %v, got %v", testCase.valid, valid)
+			}
+			if valid && metric.Name != testCase.expectedName {
+				t.Errorf("expected name %q, got %q", testCase.expectedName, metric.Name)
+			}
+
+			if prober.status.hasErrors() != testCase.errors {
+				t.Errorf("expected errors %v, got %v", testCase.errors, prober.status.hasErrors())
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+type (
+	// metricProbeHandler is the common http handler of all metric probes,
+	// the probes only differ in settings parsing and target discovery
+	metricProbeHandler struct {
+		url            string
+		cachePrefix    string
+		timeoutDefault float64
+
+		newSettings func(r *http.Request, opts config.Opts) (metrics.RequestMetricSettings, error)
+
+		// newDiscoverer returns the target discoverer of the request, without discoverer
+		// the probe is running on subscription scope
+		newDiscoverer func(r *http.Request, settings metrics.RequestMetricSettings) (metrics.TargetDiscoverer, error)
+	}
+
+	// probeRevalidations runs the background refreshes of stale cached metrics (cache mode stale-while-revalidate),
+	// at most one per cache key, all refreshes are canceled on shutdown
+	probeRevalidations struct {
+		ctx     context.Context
+		lock    sync.Mutex
+		running map[string]struct{}
+		wg      sync.WaitGroup
+	}
+)
+
+func (h *metricProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var timeoutSeconds float64
+	var discoverer metrics.TargetDiscoverer
+
+	startTime := probeStartTime(r)
+	contextLogger := buildContextLoggerFromRequest(r)
+	registry := prometheus.NewRegistry()
+
+	// If a timeout is configured via the Prometheus header, add it to the request.
+	timeoutSeconds, err = getPrometheusTimeout(r, h.timeoutDefault)
+	if err != nil {
+		contextLogger.Warnln(err)
+		http.Error(w, fmt.Sprintf("failed to parse timeout from Prometheus header: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// probe is canceled if the client is gone (eg. Prometheus scrape timeout),
+	// the timeout starts when the request was received (including the wait for admission)
+	ctx, cancel := context.WithDeadline(r.Context(), startTime.Add(time.Duration(timeoutSeconds*float64(time.Second))))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	var settings metrics.RequestMetricSettings
+	if settings, err = h.newSettings(r, opts); err != nil {
+		contextLogger.Warnln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err = paramsGetListRequired(r.URL.Query(), "subscription"); err != nil {
+		contextLogger.Warnln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.newDiscoverer != nil {
+		if discoverer, err = h.newDiscoverer(r, settings); err != nil {
+			contextLogger.Warnln(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cacheKey, err := settings.CacheKey(h.cachePrefix, discoverer)
+	if err != nil {
+		contextLogger.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("X-metrics-cache-key", cacheKey)
+	prober := h.newProber(ctx, contextLogger, w, settings, registry, cacheKey, startTime)
+
+	if !prober.FetchFromCache() {
+		prober.RegisterSubscriptionCollectFinishCallback(func(subscriptionId string) {
+			// global stats counter
+			prometheusCollectTime.With(prometheus.Labels{
+				"subscriptionID": subscriptionId,
+				"handler":        h.url,
+				"filter":         settings.Filter,
+			}).Observe(time.Since(startTime).Seconds())
+		})
+
+		// identical probes running at the same time share one result
+		coalesced, err := prober.RunCoalesced(cacheKey, discoverer)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			probeAbandoned(contextLogger, h.url)
+			return
+		}
+		if err != nil {
+			contextLogger.Errorln(err)
+			http.Error(w, err.Error(), probeErrorStatusCode(err))
+			return
+		}
+
+		if coalesced {
+			w.Header().Add("X-metrics-coalesced", "true")
+			for _, subscriptionId := range settings.Subscriptions {
+				prometheusMetricRequests.With(prometheus.Labels{
+					"subscriptionID": subscriptionId,
+					"handler":        h.url,
+					"filter":         settings.Filter,
+					"result":         "coalesced",
+				}).Inc()
+			}
+		}
+	} else {
+		result := "cached"
+		if prober.NeedsRevalidation() {
+			// stale metrics were served, refresh the cache in background
+			result = "stale"
+			timeout := time.Duration(timeoutSeconds * float64(time.Second))
+			if !probeRevalidation.start(cacheKey, timeout, func(ctx context.Context) {
+				h.revalidate(ctx, contextLogger, settings, cacheKey, discoverer)
+			}) {
+				contextLogger.Debug("revalidation of cached metrics is already running")
+			}
+		}
+
+		w.Header().Add("X-metrics-cached", "true")
+		for _, subscriptionId := range settings.Subscriptions {
+			prometheusMetricRequests.With(prometheus.Labels{
+				"subscriptionID": subscriptionId,
+				"handler":        h.url,
+				"filter":         settings.Filter,
+				"result":         result,
+			}).Inc()
+		}
+	}
+
+	promhttp.HandlerFor(prober.Gatherer(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// newProber creates the prober of a probe request (w is nil for background probes)
+func (h *metricProbeHandler) newProber(ctx context.Context, contextLogger *zap.SugaredLogger, w http.ResponseWriter, settings metrics.RequestMetricSettings, registry *prometheus.Registry, cacheKey string, startTime time.Time) *metrics.MetricProber {
+	prober := metrics.NewMetricProber(ctx, contextLogger, w, &settings, opts)
+	prober.SetUserAgent(UserAgent + gitTag)
+	prober.SetAzureClient(AzureClient)
+	prober.SetAzureResourceTagManager(AzureResourceTagManager)
+	prober.SetRateLimitGovernor(AzureRateLimitGovernor)
+	prober.SetRetryPolicy(AzureRetryPolicy)
+	prober.SetRequestLimiter(AzureRequestLimiter)
+	prober.SetDeadlineMargin(opts.Prober.DeadlineMargin)
+	prober.SetPrometheusRegistry(registry)
+	if settings.Cache != nil {
+		prober.EnableMetricsCache(metricsCache, cacheKey, settings.CacheDuration(startTime))
+	}
+
+	if opts.Azure.ServiceDiscovery.CacheDuration.Seconds() > 0 {
+		prober.EnableServiceDiscoveryCache(azureCache, opts.Azure.ServiceDiscovery.CacheDuration)
+	}
+
+	return prober
+}
+
+// revalidate refreshes stale cached metrics (coalesced with running probes of the same key)
+func (h *metricProbeHandler) revalidate(ctx context.Context, contextLogger *zap.SugaredLogger, settings metrics.RequestMetricSettings, cacheKey string, discoverer metrics.TargetDiscoverer) {
+	prober := h.newProber(ctx, contextLogger, nil, settings, prometheus.NewRegistry(), cacheKey, time.Now())
+	if _, err := prober.RunCoalesced(cacheKey, discoverer); err != nil {
+		contextLogger.Warnf("unable to revalidate cached metrics: %v", err)
+		return
+	}
+	contextLogger.Debug("revalidated cached metrics")
+}
+
+func newProbeRevalidations(ctx context.Context) *probeRevalidations {
+	return &probeRevalidations{
+		ctx:     ctx,
+		running: map[string]struct{}{},
+	}
+}
+
+// start runs the revalidation of the cache key in background with the timeout, returns false if a revalidation
+// of the key is already running or the exporter is shutting down
+func (r *probeRevalidations) start(cacheKey string, timeout time.Duration, revalidate func(ctx context.Context)) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ctx.Err() != nil {
+		return false
+	}
+
+	if _, exists := r.running[cacheKey]; exists {
+		return false
+	}
+	r.running[cacheKey] = struct{}{}
+
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.running, cacheKey)
+			r.lock.Unlock()
+			r.wg.Done()
+		}()
+
+		ctx, cancel := context.WithTimeout(r.ctx, timeout)
+		defer cancel()
+		revalidate(ctx)
+	}()
+
+	return true
+}
+
+// wait blocks until all running revalidations are finished
+func (r *probeRevalidations) wait() {
+	r.wg.Wait()
+}
+
+// probeErrorStatusCode returns the http status of a failed probe run: 400 for colliding series (merge policy "error",
+// caused by the probe parameters), 504 if the probe timed out and 502 for failed Azure requests
+func probeErrorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, metrics.ErrMetricCollision):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// probeAbandoned counts a probe which was abandoned by the client, nobody is reading the response anymore
+func probeAbandoned(contextLogger *zap.SugaredLogger, handler string) {
+	contextLogger.Debug("probe abandoned by client")
+	prometheusProbeAbandoned.With(prometheus.Labels{"handler": handler}).Inc()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+
+	"github.com/webdevops/azure-metrics-exporter/config"
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+func probeMetricsDefinitionsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var timeoutSeconds float64
+
+	contextLogger := buildContextLoggerFromRequest(r)
+	registry := prometheus.NewRegistry()
+
+	// If a timeout is configured via the Prometheus header, add it to the request.
+	timeoutSeconds, err = getPrometheusTimeout(r, config.ProbeMetricsDefinitionsTimeoutDefault)
+	if err != nil {
+		contextLogger.Warnln(err)
+		http.Error(w, fmt.Sprintf("failed to parse timeout from Prometheus header: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// probe is canceled if the client is gone (eg. Prometheus scrape timeout),
+	// the timeout starts when the request was received (including the wait for admission)
+	ctx, cancel := context.WithDeadline(r.Context(), probeStartTime(r).Add(time.Duration(timeoutSeconds*float64(time.Second))))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		format = "json"
+	case "prometheus":
+	default:
+		err := fmt.Errorf("parameter \"format\" must be \"json\" or \"prometheus\"")
+		contextLogger.Warnln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// target or sample resource of resourceType/filter
+	target := r.URL.Query().Get("target")
+	if target != "" {
+		if _, err := armclient.ParseResourceId(target); err != nil {
+			contextLogger.Warnln(err)
+			http.Error(w, fmt.Sprintf("parameter \"target\" is not a valid resource id: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var settings metrics.RequestMetricSettings
+	if target != "" {
+		settings, err = metrics.NewRequestMetricSettings(r, opts)
+	} else {
+		settings, err = metrics.NewRequestMetricSettingsForAzureResourceApi(r, opts)
+	}
+	if err != nil {
+		contextLogger.Warnln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prober := metrics.NewMetricProber(ctx, contextLogger, w, &settings, opts)
+	prober.SetUserAgent(UserAgent + gitTag)
+	prober.SetAzureClient(AzureClient)
+	prober.SetAzureResourceTagManager(AzureResourceTagManager)
+	prober.SetRateLimitGovernor(AzureRateLimitGovernor)
+	prober.SetRetryPolicy(AzureRetryPolicy)
+	prober.SetRequestLimiter(AzureRequestLimiter)
+	prober.SetPrometheusRegistry(registry)
+
+	if opts.Azure.ServiceDiscovery.CacheDuration.Seconds() > 0 {
+		prober.EnableServiceDiscoveryCache(azureCache, opts.Azure.ServiceDiscovery.CacheDuration)
+	}
+
+	if target == "" {
+		for _, subscription := range settings.Subscriptions {
+			resource, err := prober.ServiceDiscovery.FindFirstSubscriptionResource(ctx, subscription, settings.Filter)
+			if errors.Is(ctx.Err(), context.Canceled) {
+				probeAbandoned(contextLogger, config.ProbeMetricsDefinitionsUrl)
+				return
+			}
+			if err != nil {
+				// discovery failed at Azure (eg. throttling or timeout), not a client error
+				contextLogger.Errorln(err)
+				http.Error(w, err.Error(), probeErrorStatusCode(err))
+				return
+			}
+
+			if resource != nil {
+				target = resource.ID
+				break
+			}
+		}
+
+		if target == "" {
+			err := fmt.Errorf("no resource found for filter \"%s\"", settings.Filter)
+			contextLogger.Warnln(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	definitionList, err := prober.FetchMetricDefinitions(target)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		probeAbandoned(contextLogger, config.ProbeMetricsDefinitionsUrl)
+		return
+	}
+	if err != nil {
+		contextLogger.Errorln(err)
+		http.Error(w, err.Error(), probeErrorStatusCode(err))
+		return
+	}
+
+	switch format {
+	case "prometheus":
+		prober.PublishMetricDefinitions(definitionList)
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+	default:
+		w.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(definitionList); err != nil {
+			contextLogger.Error(err)
+		}
+	}
+}
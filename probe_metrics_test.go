@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+
+	"github.com/webdevops/azure-metrics-exporter/metrics"
+)
+
+func TestProbeErrorStatusCode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"series collision", fmt.Errorf("probe failed: %w", metrics.ErrMetricCollision), http.StatusBadRequest},
+		{"timeout", fmt.Errorf("unable to fetch metric definitions: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"throttled", &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, http.StatusBadGateway},
+		{"unauthorized", &azcore.ResponseError{StatusCode: http.StatusForbidden}, http.StatusBadGateway},
+		{"request limiter", metrics.ErrRequestLimiterMaxWait, http.StatusBadGateway},
+		{"unknown", errors.New("connection reset"), http.StatusBadGateway},
+	}
+
+	for _, testCase := range testCases {
+		if statusCode := probeErrorStatusCode(testCase.err); statusCode != testCase.expected {
+			t.Errorf("%s: expected status code %d, got %d", testCase.name, testCase.expected, statusCode)
+		}
+	}
+}
+
+func TestProbeRevalidationsRunOncePerKey(t *testing.T) {
+	revalidations := newProbeRevalidations(context.Background())
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	blockingRevalidate := func(ctx context.Context) {
+		runs.Add(1)
+		<-release
+	}
+
+	if !revalidations.start("list:a", time.Minute, blockingRevalidate) {
+		t.Fatal("expected revalidation to start")
+	}
+	for i := 0; i < 5; i++ {
+		if revalidations.start("list:a", time.Minute, blockingRevalidate) {
+			t.Error("expected no second revalidation of the running key")
+		}
+	}
+	if !revalidations.start("list:b", time.Minute, blockingRevalidate) {
+		t.Error("expected revalidation of another key to start")
+	}
+
+	close(release)
+	revalidations.wait()
+	if count := runs.Load(); count != 2 {
+		t.Errorf("expected 2 revalidations, got %d", count)
+	}
+
+	// finished revalidations can run again
+	if !revalidations.start("list:a", time.Minute, func(ctx context.Context) {}) {
+		t.Error("expected revalidation to start after the previous one finished")
+	}
+	revalidations.wait()
+}
+
+func TestProbeRevalidationsCanceledOnShutdown(t *testing.T) {
+	ctx, shutdown := context.WithCancel(context.Background())
+	revalidations := newProbeRevalidations(ctx)
+
+	errs := make(chan error, 1)
+	revalidations.start("list:a", time.Minute, func(ctx context.Context) {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	})
+
+	shutdown()
+	revalidations.wait()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected revalidation to be canceled by the shutdown, got %v", err)
+	}
+
+	if revalidations.start("list:b", time.Minute, func(ctx context.Context) {}) {
+		t.Error("expected no revalidation after the shutdown")
+	}
+}